@@ -1,16 +1,89 @@
 package rye
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cactus/go-statsd-client/statsd"
+)
+
+const (
+	// Access token hash prefix
+	TOKEN_HASH_SHA256 = "sha256:"
+
+	CONTEXT_ACCESS_TOKEN_CLIENT = "rye-middlewareaccesstoken-client"
 )
 
+// AccessTokenClient describes the client an access token was issued to.
+type AccessTokenClient struct {
+	ID     string
+	Scopes []string
+
+	// NotBefore and Expires, if set, bound when the token is valid.
+	NotBefore time.Time
+	Expires   time.Time
+}
+
+// AccessTokenConfig is used to configure an access token registry.
+type AccessTokenConfig struct {
+	// HeaderName and QueryParamName are shorthands for a `TokenHeader` and
+	// a `TokenQuery` location, checked in that order before Locations.
+	HeaderName     string
+	QueryParamName string
+
+	// Locations lists where the token can be passed, in priority order; the
+	// first location holding a token is used. A token passed in the query
+	// string is redacted by `MiddlewareRouteLogger`.
+	Locations []TokenLocation
+
+	// Tokens maps plain tokens to their client, and TokenHashes maps token
+	// hashes to theirs. See `NewMiddlewareAccessTokenHashes` for the
+	// supported hash formats.
+	Tokens      map[string]AccessTokenClient
+	TokenHashes map[string]AccessTokenClient
+
+	// Source, if set, provides the tokens instead of Tokens and TokenHashes,
+	// ie. `NewFileTokenSource`, `NewEnvTokenSource` or a `TokenSourceFunc`.
+	Source TokenSource
+
+	// ReloadInterval, if set, reloads the tokens periodically. Sources which
+	// implement SourceWatcher are also reloaded whenever they change.
+	ReloadInterval time.Duration
+
+	// OverlapWindow keeps the tokens of the previous set valid for that long
+	// after a reload, so that old and new tokens are both accepted while
+	// clients rotate. A reload which doesn't change the tokens retires
+	// nothing, and only the last few sets replaced are kept.
+	OverlapWindow time.Duration
+
+	// OnReloadError is called when a reload fails; the current tokens stay
+	// in place. Defaults to logging the error.
+	OnReloadError func(error)
+
+	// Statter, if set, receives a counter per client for every accepted
+	// request (access_token.<client>.accepted) and every request rejected
+	// because the token was not yet or no longer valid
+	// (access_token.<client>.rejected), and a counter for every unknown
+	// token (access_token.invalid).
+	Statter  statsd.Statter
+	StatRate float32
+}
+
 type accessTokens struct {
-	paramName      string
-	tokens         []string
-	getFunc        func(string, *http.Request) string
+	locations      []TokenLocation
+	tokens         tokenLookup
 	missingMessage string
+
+	statter  statsd.Statter
+	statRate float32
+	now      func() time.Time
 }
 
 /*
@@ -25,7 +98,7 @@ Example usage:
 		})).Methods("POST")
 */
 func NewMiddlewareAccessToken(headerName string, tokens []string) func(rw http.ResponseWriter, req *http.Request) *Response {
-	return newAccessTokenHandler(headerName, tokens, "header")
+	return newAccessTokens([]TokenLocation{TokenHeader(headerName)}, newPlainTokenSet(tokens)).handle
 }
 
 /*
@@ -40,65 +113,324 @@ Example usage:
 		})).Methods("POST")
 */
 func NewMiddlewareAccessQueryToken(queryParamName string, tokens []string) func(rw http.ResponseWriter, req *http.Request) *Response {
-	return newAccessTokenHandler(queryParamName, tokens, "query")
+	return newAccessTokens([]TokenLocation{TokenQuery(queryParamName)}, newPlainTokenSet(tokens)).handle
 }
 
-func newAccessTokenHandler(name string, tokens []string, tokenType string) func(rw http.ResponseWriter, req *http.Request) *Response {
-	a := &accessTokens{
-		paramName: name,
-		tokens:    tokens,
+/*
+NewMiddlewareAccessTokenHashes creates a new handler to verify access tokens
+passed as a header against hashes of the tokens, so that the tokens themselves
+never need to be part of the configuration. An error is returned if any of the
+hashes can't be parsed. Supported hash formats:
+
+	sha256:<hex digest>            (see `HashAccessToken`)
+	$2a$, $2b$ or $2y$...          bcrypt
+	$argon2id$v=19$m=,t=,p=$...    argon2id, in the PHC string format
+	$5$ or $6$...                  SHA-crypt (SHA-256 or SHA-512)
+
+SHA-256 hashes are looked up in a map, so they suit large token sets. The
+others are deliberately slow and every one of them has to be tried in
+turn, so keep those sets small; a token that matched is remembered (by its
+SHA-256 digest) so that it is only verified the slow way once.
+
+Example usage:
+
+	atMiddleware, err := rye.NewMiddlewareAccessTokenHashes(tokenHeaderName, []string{
+		"sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+	})
+	if err != nil {
+		log.Fatalf("Invalid access token hashes: %v", err)
+	}
+*/
+func NewMiddlewareAccessTokenHashes(headerName string, hashes []string) (func(rw http.ResponseWriter, req *http.Request) *Response, error) {
+	tokens, err := newHashedTokenSet(hashes)
+	if err != nil {
+		return nil, err
 	}
 
-	switch tokenType {
+	return newAccessTokens([]TokenLocation{TokenHeader(headerName)}, tokens).handle, nil
+}
 
-	case "query":
-		a.getFunc = func(s string, r *http.Request) string {
-			q, ok := r.URL.Query()[s]
-			if !ok {
-				return ""
-			}
+/*
+NewMiddlewareAccessQueryTokenHashes creates a new handler to verify access
+tokens passed as a query parameter against hashes of the tokens. See
+`NewMiddlewareAccessTokenHashes` for the supported hash formats.
+*/
+func NewMiddlewareAccessQueryTokenHashes(queryParamName string, hashes []string) (func(rw http.ResponseWriter, req *http.Request) *Response, error) {
+	tokens, err := newHashedTokenSet(hashes)
+	if err != nil {
+		return nil, err
+	}
 
-			return q[0]
-		}
-		a.missingMessage = fmt.Sprintf("No access token found; ensure you pass the '%s' parameter", name)
+	return newAccessTokens([]TokenLocation{TokenQuery(queryParamName)}, tokens).handle, nil
+}
 
-	default:
-		// default to using the header
-		a.getFunc = func(s string, r *http.Request) string {
-			return r.Header.Get(s)
+/*
+NewMiddlewareAccessTokenRegistry creates a new handler to verify access tokens
+which each identify a client, with its scopes and an optional validity period.
+
+The client of the matched token is put into the context, and can be read by
+later handlers with `rye.AccessTokenClientFromContext(r)`. An error is
+returned if a token hash can't be parsed, or if no location is configured.
+
+If the tokens come from a `Source` which is reloaded, the reloads last for the
+life of the process; use `NewAccessTokenRegistry` to be able to stop them.
+
+Example usage:
+
+	atMiddleware, err := rye.NewMiddlewareAccessTokenRegistry(rye.AccessTokenConfig{
+		HeaderName: "X-Access-Token",
+		TokenHashes: map[string]rye.AccessTokenClient{
+			"sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08": {
+				ID:      "billing-service",
+				Scopes:  []string{"invoices:read"},
+				Expires: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		Statter:  statter,
+		StatRate: 1,
+	})
+	if err != nil {
+		log.Fatalf("Invalid access token configuration: %v", err)
+	}
+
+OR, accepting the token in several places:
+
+	atMiddleware, err := rye.NewMiddlewareAccessTokenRegistry(rye.AccessTokenConfig{
+		Locations: []rye.TokenLocation{
+			rye.TokenAuthScheme("ApiKey"),
+			rye.TokenCookie("access_token"),
+			rye.TokenQuery("access_token"),
+		},
+		TokenHashes: tokenHashes,
+	})
+*/
+func NewMiddlewareAccessTokenRegistry(config AccessTokenConfig) (func(rw http.ResponseWriter, req *http.Request) *Response, error) {
+	registry, err := NewAccessTokenRegistry(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return registry.Handle, nil
+}
+
+/*
+AccessTokenClientFromContext returns the client of the access token a request
+was authorized with, by `NewMiddlewareAccessTokenRegistry`.
+
+	func handler(rw http.ResponseWriter, r *http.Request) *rye.Response {
+		if client, ok := rye.AccessTokenClientFromContext(r); ok {
+			log.Infof("request from %s", client.ID)
 		}
-		a.missingMessage = fmt.Sprintf("No access token found; ensure you pass '%s' in header", name)
+		return nil
 	}
+*/
+func AccessTokenClientFromContext(r *http.Request) (*AccessTokenClient, bool) {
+	client, ok := r.Context().Value(CONTEXT_ACCESS_TOKEN_CLIENT).(*AccessTokenClient)
+	return client, ok
+}
 
-	return a.handle
+// HashAccessToken returns the SHA-256 hash of a token, in the format accepted
+// by `NewMiddlewareAccessTokenHashes`.
+func HashAccessToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return TOKEN_HASH_SHA256 + hex.EncodeToString(digest[:])
 }
 
-func (a *accessTokens) handle(rw http.ResponseWriter, r *http.Request) *Response {
-	token := a.getFunc(a.paramName, r)
+func newAccessTokens(locations []TokenLocation, tokens tokenLookup) *accessTokens {
+	return &accessTokens{
+		locations:      locations,
+		tokens:         tokens,
+		missingMessage: missingTokenMessage("access token", locations),
+		now:            time.Now,
+	}
+}
 
-	if token == "" {
+func (a *accessTokens) handle(rw http.ResponseWriter, r *http.Request) *Response {
+	token, _, ok := extractToken(r, a.locations)
+	if !ok {
 		return &Response{
 			Err:        errors.New(a.missingMessage),
 			StatusCode: http.StatusUnauthorized,
 		}
 	}
 
-	if ok := stringListContains(a.tokens, token); !ok {
+	client, ok := a.tokens.lookup(token)
+	if !ok {
+		a.report("access_token.invalid")
+
 		return &Response{
 			Err:        errors.New("Unauthorized request: invalid access token"),
 			StatusCode: http.StatusUnauthorized,
 		}
 	}
 
+	// Tokens given as a plain list carry no client, so their principal is
+	// anonymous
+	if client == nil {
+		return &Response{
+			Context: ContextWithPrincipal(r.Context(), &Principal{AuthMethod: AUTH_METHOD_ACCESS_TOKEN}),
+		}
+	}
+
+	if err := client.valid(a.now()); err != nil {
+		a.report("access_token." + client.ID + ".rejected")
+
+		return &Response{
+			Err:        err,
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	a.report("access_token." + client.ID + ".accepted")
+
+	ctx := context.WithValue(r.Context(), CONTEXT_ACCESS_TOKEN_CLIENT, client)
+
+	return &Response{
+		Context: ContextWithPrincipal(ctx, &Principal{
+			Subject:    client.ID,
+			AuthMethod: AUTH_METHOD_ACCESS_TOKEN,
+			Scopes:     client.Scopes,
+			Expires:    client.Expires,
+			Details:    client,
+		}),
+	}
+}
+
+func (a *accessTokens) report(stat string) {
+	if a.statter == nil {
+		return
+	}
+
+	go a.statter.Inc(stat, 1, a.statRate)
+}
+
+// valid checks the token is within its validity period
+func (c *AccessTokenClient) valid(now time.Time) error {
+	if !c.NotBefore.IsZero() && now.Before(c.NotBefore) {
+		return errors.New("Unauthorized request: access token is not valid yet")
+	}
+
+	if !c.Expires.IsZero() && !now.Before(c.Expires) {
+		return errors.New("Unauthorized request: access token has expired")
+	}
+
 	return nil
 }
 
-func stringListContains(stringList []string, element string) bool {
-	for _, v := range stringList {
-		if v == element {
-			return true
+/*********
+ Token set
+*********/
+
+// tokenLookup finds the client of a valid token
+type tokenLookup interface {
+	lookup(token string) (*AccessTokenClient, bool)
+}
+
+// tokenSet holds the valid tokens by their SHA-256 digest, along with their
+// client if they have one. Looking a token up by its digest doesn't leak how
+// much of it matched a valid token, unlike comparing the tokens themselves.
+type tokenSet struct {
+	digests map[[sha256.Size]byte]*AccessTokenClient
+
+	// slow holds the password hashes, which can't be looked up
+	slow []slowToken
+
+	// verified remembers the digests of tokens that matched a slow hash
+	verified sync.Map
+}
+
+// slowToken checks a token against a single slow hash
+type slowToken struct {
+	verify func(token []byte) bool
+	client *AccessTokenClient
+}
+
+func newPlainTokenSet(tokens []string) *tokenSet {
+	s := &tokenSet{digests: make(map[[sha256.Size]byte]*AccessTokenClient, len(tokens))}
+
+	for _, token := range tokens {
+		s.digests[sha256.Sum256([]byte(token))] = nil
+	}
+
+	return s
+}
+
+func newHashedTokenSet(hashes []string) (*tokenSet, error) {
+	s := &tokenSet{digests: make(map[[sha256.Size]byte]*AccessTokenClient, len(hashes))}
+
+	for _, hash := range hashes {
+		if err := s.addHash(hash, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func newTokenRegistry(tokens, hashes map[string]AccessTokenClient) (*tokenSet, error) {
+	s := &tokenSet{digests: make(map[[sha256.Size]byte]*AccessTokenClient, len(tokens)+len(hashes))}
+
+	for token, client := range tokens {
+		client := client
+		s.digests[sha256.Sum256([]byte(token))] = &client
+	}
+
+	for hash, client := range hashes {
+		client := client
+		if err := s.addHash(hash, &client); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *tokenSet) addHash(hash string, client *AccessTokenClient) error {
+	hash = strings.TrimSpace(hash)
+
+	switch {
+	case strings.HasPrefix(hash, TOKEN_HASH_SHA256):
+		digest, err := hex.DecodeString(hash[len(TOKEN_HASH_SHA256):])
+		if err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("invalid SHA-256 token hash: %v", hash)
+		}
+
+		var key [sha256.Size]byte
+		copy(key[:], digest)
+		s.digests[key] = client
+
+	case isPasswordHash(hash):
+		verify, err := newHashVerifier(hash)
+		if err != nil {
+			return fmt.Errorf("invalid token hash: %v", err)
+		}
+		s.slow = append(s.slow, slowToken{verify: verify, client: client})
+
+	default:
+		return fmt.Errorf("unsupported token hash: %v", hash)
+	}
+
+	return nil
+}
+
+func (s *tokenSet) lookup(token string) (*AccessTokenClient, bool) {
+	digest := sha256.Sum256([]byte(token))
+
+	if client, ok := s.digests[digest]; ok {
+		return client, true
+	}
+
+	if client, ok := s.verified.Load(digest); ok {
+		return client.(*AccessTokenClient), true
+	}
+
+	for _, t := range s.slow {
+		if t.verify([]byte(token)) {
+			s.verified.Store(digest, t.client)
+			return t.client, true
 		}
 	}
 
-	return false
+	return nil, false
 }
@@ -0,0 +1,367 @@
+package rye
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessTokenSet is a set of tokens, and token hashes, with their clients.
+type AccessTokenSet struct {
+	Tokens      map[string]AccessTokenClient
+	TokenHashes map[string]AccessTokenClient
+}
+
+// TokenSource provides the tokens of an AccessTokenRegistry.
+type TokenSource interface {
+	Load() (AccessTokenSet, error)
+}
+
+// TokenSourceFunc adapts a callback to a TokenSource. The tokens it returns
+// are cached by the registry until its next reload.
+type TokenSourceFunc func() (AccessTokenSet, error)
+
+// Load calls f
+func (f TokenSourceFunc) Load() (AccessTokenSet, error) {
+	return f()
+}
+
+/*
+AccessTokenRegistry verifies access tokens which can be rotated at runtime,
+see `AccessTokenConfig` for how its tokens are loaded and reloaded.
+
+A reload failing on a source error or a single invalid hash keeps the
+current tokens, and is reported through `OnReloadError`. With an
+`OverlapWindow`, the tokens of the previous set stay valid for that
+long after a reload, so that clients can move over to a new token.
+
+Use its `Handle` method as the middleware.
+*/
+type AccessTokenRegistry struct {
+	*accessTokens
+	reloader
+
+	config AccessTokenConfig
+
+	// generation holds the current *tokenGeneration
+	generation atomic.Value
+}
+
+// maxRetiredTokenSets caps the sets still accepted during their overlap
+// window, as every one of them is checked for an invalid token
+const maxRetiredTokenSets = 3
+
+// tokenGeneration is the current token set, along with the sets it replaced
+// that are still within their overlap window
+type tokenGeneration struct {
+	current *tokenSet
+	loaded  AccessTokenSet
+	retired []retiredTokenSet
+}
+
+type retiredTokenSet struct {
+	tokens *tokenSet
+	until  time.Time
+}
+
+/*
+NewAccessTokenRegistry creates a new access token registry. The initial load
+must succeed, otherwise an error is returned.
+
+Example usage:
+
+	registry, err := rye.NewAccessTokenRegistry(rye.AccessTokenConfig{
+		HeaderName:    "X-Access-Token",
+		Source:        rye.NewFileTokenSource("/etc/myapp/tokens.json"),
+		OverlapWindow: time.Hour,
+	})
+	if err != nil {
+		log.Fatalf("Unable to load access tokens: %v", err)
+	}
+	defer registry.Close()
+
+	routes.Handle("/some/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			registry.Handle,
+			yourHandler,
+		})).Methods("POST")
+*/
+func NewAccessTokenRegistry(config AccessTokenConfig) (*AccessTokenRegistry, error) {
+	if config.Source == nil {
+		config.Source = TokenSourceFunc(func() (AccessTokenSet, error) {
+			return AccessTokenSet{Tokens: config.Tokens, TokenHashes: config.TokenHashes}, nil
+		})
+	}
+
+	if config.OnReloadError == nil {
+		config.OnReloadError = func(err error) {
+			log.Errorf("Unable to reload access tokens: %v", err)
+		}
+	}
+
+	reg := &AccessTokenRegistry{config: config}
+
+	var locations []TokenLocation
+	if config.HeaderName != "" {
+		locations = append(locations, TokenHeader(config.HeaderName))
+	}
+	if config.QueryParamName != "" {
+		locations = append(locations, TokenQuery(config.QueryParamName))
+	}
+	locations = append(locations, config.Locations...)
+
+	if len(locations) == 0 {
+		return nil, errors.New("no access token location configured")
+	}
+
+	reg.accessTokens = newAccessTokens(locations, reg)
+
+	reg.statter = config.Statter
+	reg.statRate = config.StatRate
+
+	if err := reg.start(reg.load, config.OnReloadError, config.Source, config.ReloadInterval); err != nil {
+		return nil, err
+	}
+
+	return reg, nil
+}
+
+// Handle verifies the request's access token; it meets the rye.Handler type.
+func (reg *AccessTokenRegistry) Handle(rw http.ResponseWriter, r *http.Request) *Response {
+	return reg.handle(rw, r)
+}
+
+func (reg *AccessTokenRegistry) load() error {
+	set, err := reg.config.Source.Load()
+	if err != nil {
+		return err
+	}
+
+	prev, _ := reg.generation.Load().(*tokenGeneration)
+
+	// Reloading the same tokens must not retire them, or every reload
+	// would add a copy of the set to check
+	if prev != nil && sameTokenClients(prev.loaded.Tokens, set.Tokens) &&
+		sameTokenClients(prev.loaded.TokenHashes, set.TokenHashes) {
+		return nil
+	}
+
+	tokens, err := newTokenRegistry(set.Tokens, set.TokenHashes)
+	if err != nil {
+		return err
+	}
+
+	// Keep a copy, as a source may well update its maps in place
+	loaded := AccessTokenSet{
+		Tokens:      make(map[string]AccessTokenClient, len(set.Tokens)),
+		TokenHashes: make(map[string]AccessTokenClient, len(set.TokenHashes)),
+	}
+	for k, v := range set.Tokens {
+		loaded.Tokens[k] = v
+	}
+	for k, v := range set.TokenHashes {
+		loaded.TokenHashes[k] = v
+	}
+
+	next := &tokenGeneration{current: tokens, loaded: loaded}
+
+	if prev != nil && reg.config.OverlapWindow > 0 {
+		now := reg.now()
+
+		next.retired = append(next.retired, retiredTokenSet{
+			tokens: prev.current,
+			until:  now.Add(reg.config.OverlapWindow),
+		})
+
+		for _, r := range prev.retired {
+			if now.Before(r.until) && len(next.retired) < maxRetiredTokenSets {
+				next.retired = append(next.retired, r)
+			}
+		}
+	}
+
+	reg.generation.Store(next)
+	return nil
+}
+
+// sameTokenClients compares two token maps, nil being the same as empty
+func sameTokenClients(a, b map[string]AccessTokenClient) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for token, client := range a {
+		other, ok := b[token]
+		if !ok || !reflect.DeepEqual(client, other) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lookup checks the current tokens, then those still in their overlap window
+func (reg *AccessTokenRegistry) lookup(token string) (*AccessTokenClient, bool) {
+	g := reg.generation.Load().(*tokenGeneration)
+
+	if client, ok := g.current.lookup(token); ok {
+		return client, true
+	}
+
+	now := reg.now()
+	for _, r := range g.retired {
+		if !now.Before(r.until) {
+			continue
+		}
+
+		if client, ok := r.tokens.lookup(token); ok {
+			return client, true
+		}
+	}
+
+	return nil, false
+}
+
+/*****************
+ File token source
+*****************/
+
+type fileTokenSource struct {
+	path string
+}
+
+// fileTokenEntry is a single token in a token file
+type fileTokenEntry struct {
+	Client    string    `json:"client"`
+	Token     string    `json:"token"`
+	TokenHash string    `json:"token_hash"`
+	Scopes    []string  `json:"scopes"`
+	NotBefore time.Time `json:"not_before"`
+	Expires   time.Time `json:"expires"`
+}
+
+/*
+NewFileTokenSource creates a TokenSource which reads tokens from a JSON file.
+Each entry carries either a plain `token` or a `token_hash`, and the times are
+in RFC 3339 format:
+
+	[
+		{"client": "billing", "token_hash": "sha256:9f86d0...", "scopes": ["invoices:read"]},
+		{"client": "reports", "token": "s3cr3t", "expires": "2027-01-01T00:00:00Z"}
+	]
+
+The source watches the file, so a registry using it reloads whenever the file
+is written, created or replaced (ie. by an atomic rename).
+*/
+func NewFileTokenSource(path string) TokenSource {
+	return &fileTokenSource{path: filepath.Clean(path)}
+}
+
+func (f *fileTokenSource) Load() (AccessTokenSet, error) {
+	set := AccessTokenSet{
+		Tokens:      make(map[string]AccessTokenClient),
+		TokenHashes: make(map[string]AccessTokenClient),
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return set, err
+	}
+
+	var entries []fileTokenEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return set, fmt.Errorf("%v: %v", f.path, err)
+	}
+
+	for i, e := range entries {
+		client := AccessTokenClient{
+			ID:        e.Client,
+			Scopes:    e.Scopes,
+			NotBefore: e.NotBefore,
+			Expires:   e.Expires,
+		}
+
+		switch {
+		case e.Token != "" && e.TokenHash == "":
+			set.Tokens[e.Token] = client
+		case e.TokenHash != "" && e.Token == "":
+			set.TokenHashes[e.TokenHash] = client
+		default:
+			return set, fmt.Errorf("%v: entry %d: expected either a token or a token_hash", f.path, i)
+		}
+	}
+
+	return set, nil
+}
+
+// Watch reloads whenever the token file changes
+func (f *fileTokenSource) Watch(changed func()) (func(), error) {
+	return watchFile(f.path, changed)
+}
+
+/****************
+ Env token source
+****************/
+
+type envTokenSource struct {
+	prefix string
+}
+
+/*
+NewEnvTokenSource creates a TokenSource which reads tokens from the
+environment variables starting with prefix. The rest of the variable name,
+lowercased, is the client ID and its value is a comma separated list of
+tokens. Values in one of the formats accepted by
+`NewMiddlewareAccessTokenHashes` are taken as hashes.
+
+	ACCESS_TOKEN_BILLING=sha256:9f86d0...,sha256:60303a...
+
+	source := rye.NewEnvTokenSource("ACCESS_TOKEN_")
+
+The environment is only read on load, so set a `ReloadInterval` to pick up
+changes.
+*/
+func NewEnvTokenSource(prefix string) TokenSource {
+	return &envTokenSource{prefix: prefix}
+}
+
+func (e *envTokenSource) Load() (AccessTokenSet, error) {
+	set := AccessTokenSet{
+		Tokens:      make(map[string]AccessTokenClient),
+		TokenHashes: make(map[string]AccessTokenClient),
+	}
+
+	for _, env := range os.Environ() {
+		i := strings.Index(env, "=")
+		if i < 0 || !strings.HasPrefix(env[:i], e.prefix) {
+			continue
+		}
+
+		client := AccessTokenClient{ID: strings.ToLower(env[len(e.prefix):i])}
+
+		for _, token := range splitHeaderList(env[i+1:]) {
+			if isTokenHash(token) {
+				set.TokenHashes[token] = client
+			} else {
+				set.Tokens[token] = client
+			}
+		}
+	}
+
+	return set, nil
+}
+
+// isTokenHash checks if s is in one of the supported hash formats
+func isTokenHash(s string) bool {
+	return strings.HasPrefix(s, TOKEN_HASH_SHA256) || isPasswordHash(s)
+}
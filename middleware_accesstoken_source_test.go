@@ -0,0 +1,224 @@
+package rye
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AccessToken Sources", func() {
+
+	var (
+		response *httptest.ResponseRecorder
+		set      AccessTokenSet
+		loadErr  error
+		source   TokenSource
+	)
+
+	check := func(handler Handler, token string) *Response {
+		request := &http.Request{Header: http.Header{}}
+		request.Header.Set("X-Access-Token", token)
+		return handler(response, request)
+	}
+
+	BeforeEach(func() {
+		response = httptest.NewRecorder()
+		set = AccessTokenSet{Tokens: map[string]AccessTokenClient{"old": {ID: "billing"}}}
+		loadErr = nil
+		source = TokenSourceFunc(func() (AccessTokenSet, error) {
+			return set, loadErr
+		})
+	})
+
+	Describe("AccessTokenRegistry", func() {
+		var (
+			now       time.Time
+			reloadErr error
+			registry  *AccessTokenRegistry
+		)
+
+		BeforeEach(func() {
+			var err error
+			registry, err = NewAccessTokenRegistry(AccessTokenConfig{
+				HeaderName:    "X-Access-Token",
+				Source:        source,
+				OverlapWindow: time.Hour,
+				OnReloadError: func(err error) { reloadErr = err },
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			now = time.Now()
+			registry.now = func() time.Time { return now }
+		})
+
+		It("should fail if the initial load fails", func() {
+			loadErr = errors.New("boom")
+			_, err := NewAccessTokenRegistry(AccessTokenConfig{HeaderName: "X-Access-Token", Source: source})
+			Expect(err).To(MatchError("boom"))
+		})
+
+		It("should accept old and new tokens within the overlap window", func() {
+			set = AccessTokenSet{Tokens: map[string]AccessTokenClient{"new": {ID: "billing"}}}
+			Expect(registry.Reload()).To(Succeed())
+
+			Expect(check(registry.Handle, "new").Err).To(BeNil())
+			Expect(check(registry.Handle, "old").Err).To(BeNil())
+
+			now = now.Add(time.Hour)
+			Expect(check(registry.Handle, "new").Err).To(BeNil())
+			Expect(check(registry.Handle, "old").Error()).To(ContainSubstring("invalid access token"))
+		})
+
+		It("should drop retired sets once their window has passed", func() {
+			set = AccessTokenSet{Tokens: map[string]AccessTokenClient{"new": {ID: "billing"}}}
+			Expect(registry.Reload()).To(Succeed())
+
+			now = now.Add(2 * time.Hour)
+			set = AccessTokenSet{Tokens: map[string]AccessTokenClient{"newer": {ID: "billing"}}}
+			Expect(registry.Reload()).To(Succeed())
+
+			Expect(check(registry.Handle, "new").Err).To(BeNil())
+			Expect(check(registry.Handle, "old").Err).To(HaveOccurred())
+		})
+
+		It("should not retire tokens a reload left unchanged", func() {
+			for i := 0; i < 5; i++ {
+				Expect(registry.Reload()).To(Succeed())
+			}
+			Expect(registry.generation.Load().(*tokenGeneration).retired).To(BeEmpty())
+
+			set.Tokens["new"] = AccessTokenClient{ID: "billing"}
+			Expect(registry.Reload()).To(Succeed())
+			Expect(check(registry.Handle, "new").Err).To(BeNil())
+			Expect(registry.generation.Load().(*tokenGeneration).retired).To(HaveLen(1))
+		})
+
+		It("should cap the retired sets", func() {
+			for _, token := range []string{"a", "b", "c", "d", "e"} {
+				set = AccessTokenSet{Tokens: map[string]AccessTokenClient{token: {ID: "billing"}}}
+				Expect(registry.Reload()).To(Succeed())
+			}
+
+			Expect(registry.generation.Load().(*tokenGeneration).retired).To(HaveLen(maxRetiredTokenSets))
+			Expect(check(registry.Handle, "d").Err).To(BeNil())
+			Expect(check(registry.Handle, "old").Err).To(HaveOccurred())
+		})
+
+		It("should keep the current tokens when a reload fails", func() {
+			loadErr = errors.New("vault unavailable")
+			Expect(registry.Reload()).To(HaveOccurred())
+			Expect(reloadErr).To(MatchError("vault unavailable"))
+
+			loadErr = nil
+			set = AccessTokenSet{TokenHashes: map[string]AccessTokenClient{"sha256:nope": {ID: "billing"}}}
+			Expect(registry.Reload()).To(HaveOccurred())
+
+			Expect(check(registry.Handle, "old").Err).To(BeNil())
+		})
+	})
+
+	Describe("NewFileTokenSource", func() {
+		var (
+			dir  string
+			path string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "rye-tokens")
+			Expect(err).ToNot(HaveOccurred())
+
+			path = filepath.Join(dir, "tokens.json")
+			Expect(ioutil.WriteFile(path, []byte(`[
+				{"client": "billing", "token_hash": "`+HashAccessToken("one")+`", "scopes": ["invoices:read"]},
+				{"client": "reports", "token": "two", "expires": "2027-01-01T00:00:00Z"}
+			]`), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should parse the tokens", func() {
+			loaded, err := NewFileTokenSource(path).Load()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(loaded.TokenHashes).To(Equal(map[string]AccessTokenClient{
+				HashAccessToken("one"): {ID: "billing", Scopes: []string{"invoices:read"}},
+			}))
+			Expect(loaded.Tokens).To(Equal(map[string]AccessTokenClient{
+				"two": {ID: "reports", Expires: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+			}))
+		})
+
+		It("should reject entries with no token or both", func() {
+			Expect(ioutil.WriteFile(path, []byte(`[{"client": "billing"}]`), 0644)).To(Succeed())
+			_, err := NewFileTokenSource(path).Load()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("entry 0: expected either a token or a token_hash"))
+		})
+
+		It("should reload when the file is replaced", func() {
+			registry, err := NewAccessTokenRegistry(AccessTokenConfig{
+				HeaderName:    "X-Access-Token",
+				Source:        NewFileTokenSource(path),
+				OnReloadError: func(err error) {},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defer registry.Close()
+
+			Expect(check(registry.Handle, "three").Err).To(HaveOccurred())
+
+			tmp := filepath.Join(dir, "tokens.json.tmp")
+			Expect(ioutil.WriteFile(tmp, []byte(`[{"client": "billing", "token": "three"}]`), 0644)).To(Succeed())
+			Expect(os.Rename(tmp, path)).To(Succeed())
+
+			Eventually(func() error {
+				return check(registry.Handle, "three").Err
+			}).Should(BeNil())
+
+			// No overlap window, so the old tokens are gone
+			Expect(check(registry.Handle, "two").Err).To(HaveOccurred())
+		})
+	})
+
+	Describe("NewEnvTokenSource", func() {
+		BeforeEach(func() {
+			os.Setenv("RYE_TEST_TOKEN_BILLING", "plain, "+HashAccessToken("hashed"))
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("RYE_TEST_TOKEN_BILLING")
+		})
+
+		It("should load plain and hashed tokens per client", func() {
+			loaded, err := NewEnvTokenSource("RYE_TEST_TOKEN_").Load()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(loaded.Tokens).To(Equal(map[string]AccessTokenClient{"plain": {ID: "billing"}}))
+			Expect(loaded.TokenHashes).To(Equal(map[string]AccessTokenClient{HashAccessToken("hashed"): {ID: "billing"}}))
+		})
+
+		It("should pick up changes on reload", func() {
+			registry, err := NewAccessTokenRegistry(AccessTokenConfig{
+				HeaderName: "X-Access-Token",
+				Source:     NewEnvTokenSource("RYE_TEST_TOKEN_"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(check(registry.Handle, "hashed").Err).To(BeNil())
+
+			os.Setenv("RYE_TEST_TOKEN_BILLING", "rotated")
+			Expect(registry.Reload()).To(Succeed())
+
+			Expect(check(registry.Handle, "rotated").Err).To(BeNil())
+			Expect(check(registry.Handle, "hashed").Err).To(HaveOccurred())
+		})
+	})
+})
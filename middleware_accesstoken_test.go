@@ -1,10 +1,18 @@
 package rye
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"time"
+
+	"github.com/InVisionApp/rye/fakes/statsdfakes"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -28,6 +36,18 @@ var _ = Describe("AccessToken Middleware", func() {
 		token2 = "test2"
 	})
 
+	// expectAnonymous checks a plain list token was accepted, with an
+	// anonymous principal
+	expectAnonymous := func(resp *Response, description ...interface{}) {
+		Expect(resp).ToNot(BeNil(), description...)
+		Expect(resp.Err).To(BeNil(), description...)
+
+		principal, ok := PrincipalFromContext((&http.Request{}).WithContext(resp.Context))
+		Expect(ok).To(BeTrue(), description...)
+		Expect(principal.AuthMethod).To(Equal(AUTH_METHOD_ACCESS_TOKEN))
+		Expect(principal.Subject).To(BeEmpty())
+	}
+
 	Context("header token", func() {
 		var (
 			tokenHeaderName = "at-hname"
@@ -41,16 +61,16 @@ var _ = Describe("AccessToken Middleware", func() {
 		})
 
 		Context("when a valid token is used", func() {
-			It("should return nil", func() {
+			It("should set an anonymous principal", func() {
 				request.Header.Add(tokenHeaderName, token1)
 				resp := testHandler(response, request)
-				Expect(resp).To(BeNil())
+				expectAnonymous(resp)
 			})
 
-			It("should return nil", func() {
+			It("should set an anonymous principal", func() {
 				request.Header.Add(tokenHeaderName, token2)
 				resp := testHandler(response, request)
-				Expect(resp).To(BeNil())
+				expectAnonymous(resp)
 			})
 		})
 
@@ -112,9 +132,9 @@ var _ = Describe("AccessToken Middleware", func() {
 				qParams = fmt.Sprintf("%s=%s", qParamName, token1)
 			})
 
-			It("should return nil", func() {
+			It("should set an anonymous principal", func() {
 				resp := testHandler(response, request)
-				Expect(resp).To(BeNil())
+				expectAnonymous(resp)
 			})
 		})
 
@@ -123,9 +143,9 @@ var _ = Describe("AccessToken Middleware", func() {
 				qParams = fmt.Sprintf("%s=%s", qParamName, token2)
 			})
 
-			It("should return nil", func() {
+			It("should set an anonymous principal", func() {
 				resp := testHandler(response, request)
-				Expect(resp).To(BeNil())
+				expectAnonymous(resp)
 			})
 		})
 
@@ -191,4 +211,263 @@ var _ = Describe("AccessToken Middleware", func() {
 		})
 
 	})
+	Context("hashed tokens", func() {
+		var (
+			tokenHeaderName = "at-hname"
+			hashes          []string
+		)
+
+		BeforeEach(func() {
+			bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-token"), bcrypt.MinCost)
+			Expect(err).ToNot(HaveOccurred())
+
+			salt := []byte("somesalt")
+			argon2Hash := fmt.Sprintf("$argon2id$v=19$m=1024,t=1,p=1$%s$%s",
+				base64.RawStdEncoding.EncodeToString(salt),
+				base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("argon2-token"), salt, 1, 1024, 1, 32)))
+
+			hashes = []string{HashAccessToken(token1), string(bcryptHash), argon2Hash}
+
+			request = &http.Request{
+				Header: map[string][]string{},
+			}
+		})
+
+		It("should accept tokens matching any kind of hash", func() {
+			mw, err := NewMiddlewareAccessTokenHashes(tokenHeaderName, hashes)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, token := range []string{token1, "bcrypt-token", "argon2-token", "bcrypt-token"} {
+				request.Header.Set(tokenHeaderName, token)
+				expectAnonymous(mw(response, request), token)
+			}
+		})
+
+		It("should reject tokens matching no hash", func() {
+			mw, err := NewMiddlewareAccessTokenHashes(tokenHeaderName, hashes)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, token := range []string{token2, "bcrypt-tokens", HashAccessToken(token1)} {
+				request.Header.Set(tokenHeaderName, token)
+				resp := mw(response, request)
+				Expect(resp).ToNot(BeNil(), token)
+				Expect(resp.Error()).To(ContainSubstring("invalid access token"))
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			}
+		})
+
+		It("should verify query tokens", func() {
+			mw, err := NewMiddlewareAccessQueryTokenHashes("token", hashes)
+			Expect(err).ToNot(HaveOccurred())
+
+			u, _ := url.Parse("http://doesntmatter.io/blah?token=" + token1)
+			expectAnonymous(mw(response, &http.Request{URL: u}))
+		})
+
+		It("should reject invalid hashes", func() {
+			for _, hash := range []string{"sha256:abc", "md5:abc", "$2a$10$short", "$argon2id$v=19$m=1024$salt$key"} {
+				mw, err := NewMiddlewareAccessTokenHashes(tokenHeaderName, []string{hash})
+				Expect(mw).To(BeNil())
+				Expect(err).To(HaveOccurred(), hash)
+			}
+		})
+	})
+	Context("token registry", func() {
+		var (
+			config      AccessTokenConfig
+			now         time.Time
+			inc         chan string
+			fakeStatter *statsdfakes.FakeStatter
+		)
+
+		newRegistry := func() func(http.ResponseWriter, *http.Request) *Response {
+			mw, err := NewMiddlewareAccessTokenRegistry(config)
+			Expect(err).ToNot(HaveOccurred())
+			return mw
+		}
+
+		BeforeEach(func() {
+			now = time.Now()
+
+			// Each spec's stub sends to its own channel, so late sends can't
+			// reach the next spec's
+			ch := make(chan string, 1)
+			inc = ch
+			fakeStatter = &statsdfakes.FakeStatter{}
+			fakeStatter.IncStub = func(name string, value int64, rate float32) error {
+				ch <- name
+				return nil
+			}
+
+			config = AccessTokenConfig{
+				HeaderName: "X-Access-Token",
+				Tokens: map[string]AccessTokenClient{
+					token1: {ID: "billing", Scopes: []string{"invoices:read"}},
+					"old":  {ID: "legacy", Expires: now.Add(-time.Minute)},
+					"new":  {ID: "future", NotBefore: now.Add(time.Hour)},
+				},
+				TokenHashes: map[string]AccessTokenClient{
+					HashAccessToken(token2): {ID: "reports", Expires: now.Add(time.Hour)},
+				},
+				Statter:  fakeStatter,
+				StatRate: 1,
+			}
+
+			request = &http.Request{
+				Header: map[string][]string{},
+			}
+		})
+
+		It("should put the client into the context", func() {
+			request.Header.Set("X-Access-Token", token1)
+			resp := newRegistry()(response, request)
+			Expect(resp).ToNot(BeNil())
+			Expect(resp.Err).To(BeNil())
+
+			client, ok := AccessTokenClientFromContext(request.WithContext(resp.Context))
+			Expect(ok).To(BeTrue())
+			Expect(client.ID).To(Equal("billing"))
+			Expect(client.Scopes).To(Equal([]string{"invoices:read"}))
+
+			Eventually(inc).Should(Receive(Equal("access_token.billing.accepted")))
+		})
+
+		It("should accept hashed tokens within their validity period", func() {
+			request.Header.Set("X-Access-Token", token2)
+			resp := newRegistry()(response, request)
+			Expect(resp.Err).To(BeNil())
+
+			client, _ := AccessTokenClientFromContext(request.WithContext(resp.Context))
+			Expect(client.ID).To(Equal("reports"))
+
+			Eventually(inc).Should(Receive(Equal("access_token.reports.accepted")))
+		})
+
+		It("should reject expired tokens", func() {
+			request.Header.Set("X-Access-Token", "old")
+			resp := newRegistry()(response, request)
+			Expect(resp.Error()).To(ContainSubstring("access token has expired"))
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+			Eventually(inc).Should(Receive(Equal("access_token.legacy.rejected")))
+		})
+
+		It("should reject tokens which are not valid yet", func() {
+			request.Header.Set("X-Access-Token", "new")
+			resp := newRegistry()(response, request)
+			Expect(resp.Error()).To(ContainSubstring("access token is not valid yet"))
+
+			Eventually(inc).Should(Receive(Equal("access_token.future.rejected")))
+		})
+
+		It("should reject unknown tokens", func() {
+			request.Header.Set("X-Access-Token", "blah")
+			resp := newRegistry()(response, request)
+			Expect(resp.Error()).To(ContainSubstring("invalid access token"))
+
+			Eventually(inc).Should(Receive(Equal("access_token.invalid")))
+		})
+
+		It("should read the token from a query parameter", func() {
+			config.HeaderName = ""
+			config.QueryParamName = "token"
+
+			u, _ := url.Parse("http://doesntmatter.io/blah?token=" + token1)
+			resp := newRegistry()(response, &http.Request{URL: u})
+			Expect(resp.Err).To(BeNil())
+
+			Eventually(inc).Should(Receive(Equal("access_token.billing.accepted")))
+		})
+
+		It("should require a header or query parameter", func() {
+			config.HeaderName = ""
+			_, err := NewMiddlewareAccessTokenRegistry(config)
+			Expect(err).To(MatchError("no access token location configured"))
+		})
+
+		It("should reject invalid hashes", func() {
+			config.TokenHashes = map[string]AccessTokenClient{"sha256:nope": {ID: "x"}}
+			_, err := NewMiddlewareAccessTokenRegistry(config)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context("token locations", func() {
+		var config AccessTokenConfig
+
+		newRegistry := func() func(http.ResponseWriter, *http.Request) *Response {
+			mw, err := NewMiddlewareAccessTokenRegistry(config)
+			Expect(err).ToNot(HaveOccurred())
+			return mw
+		}
+
+		BeforeEach(func() {
+			config = AccessTokenConfig{
+				Locations: []TokenLocation{
+					TokenHeader("X-Access-Token"),
+					TokenAuthScheme("ApiKey"),
+					TokenQuery("access_token"),
+					TokenCookie("access_token"),
+					TokenForm("access_token"),
+				},
+				Tokens: map[string]AccessTokenClient{token1: {ID: "one"}, token2: {ID: "two"}},
+			}
+
+			request = httptest.NewRequest("GET", "/blah?page=2", nil)
+		})
+
+		clientID := func(resp *Response) string {
+			Expect(resp).ToNot(BeNil())
+			Expect(resp.Err).To(BeNil())
+
+			client, ok := AccessTokenClientFromContext(request.WithContext(resp.Context))
+			Expect(ok).To(BeTrue())
+			return client.ID
+		}
+
+		It("should read the token from a header", func() {
+			request.Header.Set("X-Access-Token", token1)
+			Expect(clientID(newRegistry()(response, request))).To(Equal("one"))
+		})
+
+		It("should read the token from an Authorization scheme", func() {
+			request.Header.Set("Authorization", "apikey "+token1)
+			Expect(clientID(newRegistry()(response, request))).To(Equal("one"))
+
+			request.Header.Set("Authorization", "ApiKeys "+token1)
+			Expect(newRegistry()(response, request).Error()).To(ContainSubstring("No access token found"))
+		})
+
+		It("should read the token from a cookie", func() {
+			request.AddCookie(&http.Cookie{Name: "access_token", Value: token1})
+			Expect(clientID(newRegistry()(response, request))).To(Equal("one"))
+		})
+
+		It("should read the token from a form field", func() {
+			request = httptest.NewRequest("POST", "/blah", strings.NewReader("access_token="+token1))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			Expect(clientID(newRegistry()(response, request))).To(Equal("one"))
+		})
+
+		It("should use the first location holding a token", func() {
+			request.Header.Set("Authorization", "ApiKey "+token2)
+			request.AddCookie(&http.Cookie{Name: "access_token", Value: token1})
+			Expect(clientID(newRegistry()(response, request))).To(Equal("two"))
+		})
+
+		It("should not modify the request when reading a query token", func() {
+			request = httptest.NewRequest("GET", "/blah?page=2&access_token="+token1, nil)
+			Expect(clientID(newRegistry()(response, request))).To(Equal("one"))
+
+			Expect(request.URL.RawQuery).To(Equal("page=2&access_token=" + token1))
+			Expect(request.RequestURI).To(Equal("/blah?page=2&access_token=" + token1))
+		})
+
+		It("should list every location when no token is found", func() {
+			resp := newRegistry()(response, request)
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(resp.Error()).To(Equal("No access token found; ensure you pass 'X-Access-Token' in header or " +
+				"'Authorization: ApiKey' header or the 'access_token' parameter or the 'access_token' cookie or " +
+				"the 'access_token' form field"))
+		})
+	})
 })
@@ -2,13 +2,14 @@ package rye
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
-
-	jwt "github.com/dgrijalva/jwt-go"
+	"sync/atomic"
 )
 
 /*
@@ -30,6 +31,10 @@ Example usage:
 
 type AuthFunc func(context.Context, string) *Response
 
+// errInvalidAuth is returned by the AuthFuncs here for credentials they can't
+// parse, or which don't match
+var errInvalidAuth = errors.New("unauthorized: invalid authentication provided")
+
 func NewMiddlewareAuth(authFunc AuthFunc) func(rw http.ResponseWriter, req *http.Request) *Response {
 	return func(rw http.ResponseWriter, r *http.Request) *Response {
 		auth := r.Header.Get("Authorization")
@@ -44,6 +49,117 @@ func NewMiddlewareAuth(authFunc AuthFunc) func(rw http.ResponseWriter, req *http
 	}
 }
 
+// CredentialExtractor finds credentials at a location in the request, and
+// passes them on to the AuthFunc as `Scheme + " " + credentials`, as if they
+// came in the Authorization header. Scheme defaults to the location's scheme
+// for `TokenAuthScheme` locations, and to "Bearer" otherwise.
+type CredentialExtractor struct {
+	Location TokenLocation
+	Scheme   string
+}
+
+// authorization returns the credentials at the location, as an Authorization
+// header value
+func (e CredentialExtractor) authorization(r *http.Request) (string, bool) {
+	credentials := e.Location.extract(r)
+	if credentials == "" {
+		return "", false
+	}
+
+	scheme := e.Scheme
+	if scheme == "" {
+		scheme = "Bearer"
+		if e.Location.Kind == TOKEN_LOCATION_AUTH_SCHEME {
+			scheme = e.Location.Name
+		}
+	}
+
+	return scheme + " " + credentials, true
+}
+
+/*
+NewMiddlewareAuthWithExtractors works like NewMiddlewareAuth, but looks for the
+credentials at each of the extractors' locations in turn, rather than only in
+the Authorization header. The first credentials found are validated. Query
+parameters holding credentials are redacted by `MiddlewareRouteLogger`.
+
+This lets ie. browser apps pass a JWT in an HttpOnly cookie, and websocket
+clients in a query parameter. Cookies are sent by browsers on cross-site
+requests too, so use `NewMiddlewareCSRF` along with cookie credentials.
+
+Example usage:
+
+	routes.Handle("/some/route", myMWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareAuthWithExtractors(rye.NewJWTAuthFunc("secret"),
+				rye.CredentialExtractor{Location: rye.TokenAuthScheme("Bearer")},
+				rye.CredentialExtractor{Location: rye.TokenCookie("session")},
+				rye.CredentialExtractor{Location: rye.TokenQuery("access_token")},
+			),
+			yourHandler,
+		})).Methods("GET")
+*/
+func NewMiddlewareAuthWithExtractors(authFunc AuthFunc, extractors ...CredentialExtractor) func(rw http.ResponseWriter, req *http.Request) *Response {
+	return func(rw http.ResponseWriter, r *http.Request) *Response {
+		for _, e := range extractors {
+			auth, ok := e.authorization(r)
+			if !ok {
+				continue
+			}
+
+			return authFunc(r.Context(), auth)
+		}
+
+		return &Response{
+			Err:        errors.New("unauthorized: no authentication provided"),
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+}
+
+/*
+NewMiddlewareAuthWithChallenge works like NewMiddlewareAuth, and also sets the
+`WWW-Authenticate` header to challenge on every 401 it returns, so that
+clients such as browsers know how to authenticate. See `BasicChallenge`.
+
+Example usage:
+
+	routes.Handle("/some/route", myMWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareAuthWithChallenge(authFunc, rye.BasicChallenge("admin", "UTF-8")),
+			yourHandler,
+		})).Methods("GET")
+*/
+func NewMiddlewareAuthWithChallenge(authFunc AuthFunc, challenge string) func(rw http.ResponseWriter, req *http.Request) *Response {
+	handler := NewMiddlewareAuth(authFunc)
+
+	return func(rw http.ResponseWriter, r *http.Request) *Response {
+		resp := handler(rw, r)
+
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			rw.Header().Set("WWW-Authenticate", challenge)
+		}
+
+		return resp
+	}
+}
+
+// BasicChallenge returns a Basic auth challenge for the realm (RFC 7617); the
+// charset, if set, tells clients how to encode the credentials.
+func BasicChallenge(realm, charset string) string {
+	challenge := "Basic realm=" + quoteString(realm)
+	if charset != "" {
+		challenge += ", charset=" + quoteString(charset)
+	}
+
+	return challenge
+}
+
+// quoteString quotes s as an HTTP quoted-string
+func quoteString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
 /***********
  Basic Auth
 ***********/
@@ -59,7 +175,7 @@ const AUTH_USERNAME_KEY = "request-username"
 // basicAuth.authenticate meets the AuthFunc type
 func (b basicAuth) authenticate(ctx context.Context, auth string) *Response {
 	errResp := &Response{
-		Err:        errors.New("unauthorized: invalid authentication provided"),
+		Err:        errInvalidAuth,
 		StatusCode: http.StatusUnauthorized,
 	}
 
@@ -70,19 +186,132 @@ func (b basicAuth) authenticate(ctx context.Context, auth string) *Response {
 	}
 
 	// get the password
-	pass, ok := b[u]
+	pass, known := b[u]
+
+	// compare the password digests, so that the time taken tells nothing
+	// about how much of the password matched, or whether the user exists
+	want := sha256.Sum256([]byte(pass))
+	got := sha256.Sum256([]byte(p))
+	if subtle.ConstantTimeCompare(want[:], got[:]) != 1 || !known {
+		return errResp
+	}
+
+	// add username and principal to the context
+	return &Response{
+		Context: basicAuthContext(ctx, u, &Principal{Subject: u, AuthMethod: AUTH_METHOD_BASIC}),
+	}
+}
+
+// basicAuthContext adds the username and principal of a Basic auth user to ctx
+func basicAuthContext(ctx context.Context, username string, principal *Principal) context.Context {
+	ctx = context.WithValue(ctx, AUTH_USERNAME_KEY, username)
+	return ContextWithPrincipal(ctx, principal)
+}
+
+/*
+NewBasicAuthHashFunc creates an AuthFunc for Basic auth which checks passwords
+against hashes, rather than plain passwords. An error is returned if any of the
+hashes can't be parsed. Supported hash formats:
+
+	$2a$, $2b$ or $2y$...          bcrypt
+	$argon2id$v=19$m=,t=,p=$...    argon2id, in the PHC string format
+	$5$ or $6$...                  SHA-crypt (SHA-256 or SHA-512)
+
+Requests for unknown users are checked against one of the existing hashes, so
+they take as long to fail as a wrong password does. See `NewHtpasswd` to load
+the hashes from an htpasswd file.
+
+Example usage:
+
+	authFunc, err := rye.NewBasicAuthHashFunc(map[string]string{
+		"user1": "$2y$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+	})
+	if err != nil {
+		log.Fatalf("Invalid password hashes: %v", err)
+	}
+
+	routes.Handle("/some/route", myMWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareAuth(authFunc),
+			yourHandler,
+		})).Methods("POST")
+*/
+func NewBasicAuthHashFunc(userHashes map[string]string) (AuthFunc, error) {
+	table, err := newPasswordTable(userHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &hashedBasicAuth{}
+	h.table.Store(table)
+
+	return h.authenticate, nil
+}
+
+type hashedBasicAuth struct {
+	// table holds the current *passwordTable and is swapped atomically on reload
+	table atomic.Value
+}
+
+// passwordTable is a parsed, immutable set of password hashes
+type passwordTable struct {
+	verifiers map[string]func(password []byte) bool
+
+	// dummy is checked for unknown users, to take as long as a known one
+	dummy func(password []byte) bool
+}
+
+func newPasswordTable(userHashes map[string]string) (*passwordTable, error) {
+	t := &passwordTable{
+		verifiers: make(map[string]func([]byte) bool, len(userHashes)),
+		dummy:     func([]byte) bool { return false },
+	}
+
+	// Pick the dummy deterministically, from the first user by name
+	first := ""
+
+	for user, hash := range userHashes {
+		verify, err := newHashVerifier(strings.TrimSpace(hash))
+		if err != nil {
+			return nil, fmt.Errorf("user %v: %v", user, err)
+		}
+
+		if len(t.verifiers) == 0 || user < first {
+			first = user
+			t.dummy = verify
+		}
+
+		t.verifiers[user] = verify
+	}
+
+	return t, nil
+}
+
+// hashedBasicAuth.authenticate meets the AuthFunc type
+func (h *hashedBasicAuth) authenticate(ctx context.Context, auth string) *Response {
+	errResp := &Response{
+		Err:        errInvalidAuth,
+		StatusCode: http.StatusUnauthorized,
+	}
+
+	u, p, ok := parseBasicAuth(auth)
 	if !ok {
 		return errResp
 	}
 
-	// compare the password
-	if pass != p {
+	t := h.table.Load().(*passwordTable)
+
+	verify, known := t.verifiers[u]
+	if !known {
+		verify = t.dummy
+	}
+
+	if !verify([]byte(p)) || !known {
 		return errResp
 	}
 
-	// add username to the context
 	return &Response{
-		Context: context.WithValue(ctx, AUTH_USERNAME_KEY, u),
+		Context: basicAuthContext(ctx, u, &Principal{Subject: u, AuthMethod: AUTH_METHOD_BASIC}),
 	}
 }
 
@@ -105,47 +334,3 @@ func parseBasicAuth(auth string) (username, password string, ok bool) {
 	}
 	return cs[:s], cs[s+1:], true
 }
-
-/****
- JWT
-****/
-
-type jwtAuth struct {
-	secret string
-}
-
-func NewJWTAuthFunc(secret string) AuthFunc {
-	j := &jwtAuth{secret: secret}
-	return j.authenticate
-}
-
-const bearerPrefix = "Bearer "
-
-func (j *jwtAuth) authenticate(ctx context.Context, auth string) *Response {
-	// Remove 'Bearer' prefix
-	if !strings.HasPrefix(auth, bearerPrefix) && !strings.HasPrefix(auth, strings.ToLower(bearerPrefix)) {
-		return &Response{
-			Err:        errors.New("unauthorized: invalid authentication provided"),
-			StatusCode: http.StatusUnauthorized,
-		}
-	}
-
-	token := auth[len(bearerPrefix):]
-
-	_, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method")
-		}
-		return []byte(j.secret), nil
-	})
-	if err != nil {
-		return &Response{
-			Err:        err,
-			StatusCode: http.StatusUnauthorized,
-		}
-	}
-
-	return &Response{
-		Context: context.WithValue(ctx, CONTEXT_JWT, token),
-	}
-}
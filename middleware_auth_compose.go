@@ -0,0 +1,170 @@
+package rye
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AuthMethod is an AuthFunc to compose with `NewAnyOfAuthFunc` or
+// `NewFirstMatchAuthFunc`.
+type AuthMethod struct {
+	// Name is set as the AuthMethodName of the Principal when the method
+	// succeeds, ie. "legacy"; the Principal's AuthMethod is left as the
+	// AuthFunc set it.
+	Name string
+
+	// Scheme is the Authorization scheme the method handles, ie. "Bearer"
+	// or "Basic". An empty Scheme handles any.
+	Scheme string
+
+	AuthFunc AuthFunc
+}
+
+/*
+NewAnyOfAuthFunc creates an AuthFunc which dispatches on the Authorization
+scheme: the methods handling the request's scheme are tried in order, until
+one succeeds. The name of the method which succeeded becomes the
+AuthMethodName of the Principal, and can be read with
+`rye.AuthMethodFromContext(r)`.
+
+If they all fail, the most specific error is returned: a server error, ie. a
+user store being down, before an error telling what was wrong with the
+credentials, before a plain "invalid authentication provided".
+
+Example usage:
+
+	authFunc := rye.NewAnyOfAuthFunc(
+		rye.AuthMethod{Name: "jwt", Scheme: "Bearer", AuthFunc: jwtAuthFunc},
+		rye.AuthMethod{Name: "basic", Scheme: "Basic", AuthFunc: rye.NewBasicAuthFunc(legacyUsers)},
+	)
+
+	routes.Handle("/some/route", myMWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareAuth(authFunc),
+			yourHandler,
+		})).Methods("GET")
+*/
+func NewAnyOfAuthFunc(methods ...AuthMethod) AuthFunc {
+	return func(ctx context.Context, auth string) *Response {
+		scheme := auth
+		if i := strings.IndexByte(auth, ' '); i >= 0 {
+			scheme = auth[:i]
+		}
+
+		var candidates []AuthMethod
+		for _, m := range methods {
+			if m.Scheme == "" || strings.EqualFold(m.Scheme, scheme) {
+				candidates = append(candidates, m)
+			}
+		}
+
+		if len(candidates) == 0 {
+			return &Response{
+				Err:        fmt.Errorf("unauthorized: unsupported authentication scheme: %v", scheme),
+				StatusCode: http.StatusUnauthorized,
+			}
+		}
+
+		return firstMatch(ctx, auth, candidates)
+	}
+}
+
+// NewFirstMatchAuthFunc creates an AuthFunc which tries every method in
+// order, whatever their scheme, until one succeeds. Otherwise it works like
+// `NewAnyOfAuthFunc`.
+func NewFirstMatchAuthFunc(methods ...AuthMethod) AuthFunc {
+	return func(ctx context.Context, auth string) *Response {
+		return firstMatch(ctx, auth, methods)
+	}
+}
+
+/*
+AuthMethodFromContext returns the name of the method which authenticated the
+request with `NewAnyOfAuthFunc` or `NewFirstMatchAuthFunc`, or else the
+AuthMethod of the request's Principal.
+
+	func handler(rw http.ResponseWriter, r *http.Request) *rye.Response {
+		if method, _ := rye.AuthMethodFromContext(r); method == "basic" {
+			log.Warnf("legacy client using basic auth")
+		}
+		return nil
+	}
+*/
+func AuthMethodFromContext(r *http.Request) (string, bool) {
+	principal, ok := PrincipalFromContext(r)
+	if !ok {
+		return "", false
+	}
+
+	if principal.AuthMethodName != "" {
+		return principal.AuthMethodName, true
+	}
+
+	return principal.AuthMethod, principal.AuthMethod != ""
+}
+
+// firstMatch tries the methods in order, and returns the first success or
+// else the most specific error
+func firstMatch(ctx context.Context, auth string, methods []AuthMethod) *Response {
+	var failed *Response
+
+	for _, m := range methods {
+		resp := m.AuthFunc(ctx, auth)
+
+		if resp == nil || resp.Err == nil {
+			succeeded := ctx
+			if resp != nil && resp.Context != nil {
+				succeeded = resp.Context
+			}
+
+			return &Response{
+				Context: withAuthMethod(succeeded, m.Name),
+			}
+		}
+
+		if failed == nil || authErrorRank(resp) > authErrorRank(failed) {
+			failed = resp
+		}
+	}
+
+	if failed == nil {
+		return &Response{
+			Err:        errInvalidAuth,
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	return failed
+}
+
+// withAuthMethod names the composed method on the context's Principal,
+// adding one if the AuthFunc didn't
+func withAuthMethod(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+
+	principal := &Principal{AuthMethodName: name}
+	if p, ok := ctx.Value(principalKey{}).(*Principal); ok {
+		// Copy, as the AuthFunc may share its principals
+		named := *p
+		named.AuthMethodName = name
+		principal = &named
+	}
+
+	return ContextWithPrincipal(ctx, principal)
+}
+
+// authErrorRank ranks how specific an auth error is
+func authErrorRank(resp *Response) int {
+	switch {
+	case resp.StatusCode != http.StatusUnauthorized:
+		return 2
+	case resp.Err != errInvalidAuth:
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,136 @@
+package rye
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Composite Auth", func() {
+	var (
+		jwtMethod   AuthMethod
+		basicMethod AuthMethod
+		token       string
+	)
+
+	BeforeEach(func() {
+		jwtMethod = AuthMethod{Name: "jwt", Scheme: "Bearer", AuthFunc: NewJWTAuthFunc("secret")}
+		basicMethod = AuthMethod{Name: "basic", Scheme: "Basic", AuthFunc: NewBasicAuthFunc(map[string]string{"alice": "pass"})}
+		token = signJWT(jwt.SigningMethodHS256, "", []byte("secret"), jwt.MapClaims{"sub": "alice"})
+	})
+
+	methodOf := func(resp *Response) string {
+		method, _ := AuthMethodFromContext((&http.Request{}).WithContext(resp.Context))
+		return method
+	}
+
+	Context("any of", func() {
+		It("should dispatch on the scheme", func() {
+			authFunc := NewAnyOfAuthFunc(jwtMethod, basicMethod)
+
+			resp := authFunc(context.Background(), "Bearer "+token)
+			Expect(resp.Err).To(BeNil())
+			Expect(methodOf(resp)).To(Equal("jwt"))
+			Expect(resp.Context.Value(CONTEXT_JWT)).To(Equal(token))
+
+			resp = authFunc(context.Background(), "Basic "+base64Encode("alice:pass"))
+			Expect(resp.Err).To(BeNil())
+			Expect(methodOf(resp)).To(Equal("basic"))
+			Expect(resp.Context.Value(AUTH_USERNAME_KEY)).To(Equal("alice"))
+		})
+
+		It("should only try the methods handling the scheme", func() {
+			called := false
+			other := AuthMethod{Name: "other", Scheme: "Token", AuthFunc: func(ctx context.Context, auth string) *Response {
+				called = true
+				return nil
+			}}
+
+			resp := NewAnyOfAuthFunc(other, basicMethod)(context.Background(), "Basic "+base64Encode("alice:wrong"))
+			Expect(resp.Err).To(Equal(errInvalidAuth))
+			Expect(called).To(BeFalse())
+		})
+
+		It("should try methods with the same scheme in order", func() {
+			tokens := AuthMethod{Name: "token", Scheme: "Bearer", AuthFunc: func(ctx context.Context, auth string) *Response {
+				return &Response{Err: errInvalidAuth, StatusCode: http.StatusUnauthorized}
+			}}
+
+			resp := NewAnyOfAuthFunc(tokens, jwtMethod)(context.Background(), "Bearer "+token)
+			Expect(resp.Err).To(BeNil())
+			Expect(methodOf(resp)).To(Equal("jwt"))
+		})
+
+		It("should reject unsupported schemes", func() {
+			resp := NewAnyOfAuthFunc(jwtMethod, basicMethod)(context.Background(), "Digest foo")
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(resp.Err.Error()).To(ContainSubstring("unsupported authentication scheme: Digest"))
+		})
+
+		It("should record methods succeeding without a context", func() {
+			anything := AuthMethod{Name: "anything", AuthFunc: func(ctx context.Context, auth string) *Response {
+				return nil
+			}}
+
+			resp := NewAnyOfAuthFunc(anything)(context.Background(), "Whatever")
+			Expect(resp.Err).To(BeNil())
+			Expect(methodOf(resp)).To(Equal("anything"))
+		})
+
+		It("should name the method on the authenticator's principal", func() {
+			basicMethod.Name = "legacy"
+
+			resp := NewAnyOfAuthFunc(basicMethod)(context.Background(), "Basic "+base64Encode("alice:pass"))
+			principal, ok := PrincipalFromContext((&http.Request{}).WithContext(resp.Context))
+			Expect(ok).To(BeTrue())
+			Expect(principal.Subject).To(Equal("alice"))
+			Expect(principal.AuthMethod).To(Equal(AUTH_METHOD_BASIC))
+			Expect(principal.AuthMethodName).To(Equal("legacy"))
+			Expect(methodOf(resp)).To(Equal("legacy"))
+		})
+
+		It("should keep the canonical method for policies", func() {
+			basicMethod.Name = "legacy"
+
+			resp := NewAnyOfAuthFunc(basicMethod)(context.Background(), "Basic "+base64Encode("alice:pass"))
+			e, err := NewPolicyEngine(PolicyConfig{Source: PolicySourceFunc(func() ([]PolicyRule, error) {
+				return []PolicyRule{{Name: "basic", Effect: POLICY_ALLOW, AuthMethods: []string{AUTH_METHOD_BASIC}}}, nil
+			})})
+			Expect(err).ToNot(HaveOccurred())
+
+			r := httptest.NewRequest("GET", "/", nil).WithContext(resp.Context)
+			Expect(e.Handle(httptest.NewRecorder(), r)).To(BeNil())
+		})
+	})
+
+	Context("first match", func() {
+		It("should try every method in order", func() {
+			authFunc := NewFirstMatchAuthFunc(basicMethod, jwtMethod)
+
+			resp := authFunc(context.Background(), "Bearer "+token)
+			Expect(resp.Err).To(BeNil())
+			Expect(methodOf(resp)).To(Equal("jwt"))
+		})
+
+		It("should return the most specific error", func() {
+			authFunc := NewFirstMatchAuthFunc(basicMethod, jwtMethod)
+
+			resp := authFunc(context.Background(), "Bearer "+token+"x")
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(resp.Err).ToNot(Equal(errInvalidAuth))
+			Expect(resp.Err.Error()).To(ContainSubstring("signature is invalid"))
+
+			broken := AuthMethod{Name: "store", AuthFunc: func(ctx context.Context, auth string) *Response {
+				return &Response{Err: errors.New("unable to verify authentication"), StatusCode: http.StatusInternalServerError}
+			}}
+
+			resp = NewFirstMatchAuthFunc(jwtMethod, broken, basicMethod)(context.Background(), "Bearer "+token+"x")
+			Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+		})
+	})
+})
@@ -0,0 +1,304 @@
+package rye
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Password hash prefixes
+	HASH_ARGON2ID    = "$argon2id$"
+	HASH_SHA256CRYPT = "$5$"
+	HASH_SHA512CRYPT = "$6$"
+)
+
+const (
+	// maxHashedSecretLength caps the secrets checked against a hash, as the
+	// cost of SHA-crypt grows with the square of their length
+	maxHashedSecretLength = 4096
+
+	// argon2idMaxMemory (in KiB) and argon2idMaxKeyLength bound what a
+	// stored hash can make every verification allocate
+	argon2idMaxMemory    = 1 << 20
+	argon2idMaxKeyLength = 1024
+)
+
+// isPasswordHash checks if s is in one of the formats supported by
+// newHashVerifier
+func isPasswordHash(s string) bool {
+	return strings.HasPrefix(s, HASH_ARGON2ID) ||
+		strings.HasPrefix(s, HASH_SHA256CRYPT) || strings.HasPrefix(s, HASH_SHA512CRYPT) ||
+		strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// newHashVerifier parses a bcrypt, argon2id or SHA-crypt hash, and returns a
+// func checking a secret against it in constant time. Secrets longer than
+// maxHashedSecretLength never match.
+func newHashVerifier(hash string) (func(secret []byte) bool, error) {
+	verify, err := parseHashVerifier(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(secret []byte) bool {
+		if len(secret) > maxHashedSecretLength {
+			return false
+		}
+		return verify(secret)
+	}, nil
+}
+
+func parseHashVerifier(hash string) (func(secret []byte) bool, error) {
+	switch {
+	case strings.HasPrefix(hash, HASH_ARGON2ID):
+		return newArgon2idVerifier(hash)
+
+	case strings.HasPrefix(hash, HASH_SHA256CRYPT), strings.HasPrefix(hash, HASH_SHA512CRYPT):
+		return newSHACryptVerifier(hash)
+
+	case strings.HasPrefix(hash, "$2"):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash: %v", err)
+		}
+
+		h := []byte(hash)
+		return func(secret []byte) bool {
+			return bcrypt.CompareHashAndPassword(h, secret) == nil
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported hash: %v", hash)
+}
+
+// newArgon2idVerifier parses an argon2id hash in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=4$<base64 salt>$<base64 key>
+func newArgon2idVerifier(hash string) (func(secret []byte) bool, error) {
+	invalid := fmt.Errorf("invalid argon2id hash: %v", hash)
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, invalid
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, invalid
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return nil, invalid
+	}
+
+	// argon2 panics on parameters below its minimums
+	if time < 1 || threads < 1 || memory < 8*uint32(threads) || memory > argon2idMaxMemory {
+		return nil, invalid
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, invalid
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 || len(key) > argon2idMaxKeyLength {
+		return nil, invalid
+	}
+
+	return func(secret []byte) bool {
+		derived := argon2.IDKey(secret, salt, time, memory, threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(derived, key) == 1
+	}, nil
+}
+
+/*********
+ SHA-crypt
+*********/
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+	shaCryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// The order the digest bytes are encoded in, three at a time
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// newSHACryptVerifier parses a SHA-crypt hash, as used by crypt(3) and
+// htpasswd: $5$[rounds=N$]salt$digest for SHA-256, or $6$... for SHA-512
+func newSHACryptVerifier(hash string) (func(secret []byte) bool, error) {
+	invalid := fmt.Errorf("invalid SHA-crypt hash: %v", hash)
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 && len(parts) != 5 {
+		return nil, invalid
+	}
+
+	prefix := "$" + parts[1] + "$"
+	rounds := shaCryptDefaultRounds
+
+	if len(parts) == 5 {
+		if !strings.HasPrefix(parts[2], "rounds=") {
+			return nil, invalid
+		}
+
+		n, err := strconv.Atoi(parts[2][len("rounds="):])
+		if err != nil {
+			return nil, invalid
+		}
+
+		rounds = n
+		if rounds < shaCryptMinRounds {
+			rounds = shaCryptMinRounds
+		} else if rounds > shaCryptMaxRounds {
+			rounds = shaCryptMaxRounds
+		}
+
+		parts = append(parts[:2], parts[3:]...)
+	}
+
+	salt := []byte(parts[2])
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+
+	expected := []byte(parts[3])
+
+	return func(secret []byte) bool {
+		digest := shaCrypt(prefix, secret, salt, rounds)
+		return subtle.ConstantTimeCompare(digest, expected) == 1
+	}, nil
+}
+
+// shaCrypt computes the encoded digest part of a SHA-crypt hash, following
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+func shaCrypt(prefix string, password, salt []byte, rounds int) []byte {
+	newHash := sha256.New
+	order := sha256CryptOrder
+	if prefix == HASH_SHA512CRYPT {
+		newHash = sha512.New
+		order = sha512CryptOrder
+	}
+
+	sum := func(parts ...[]byte) []byte {
+		h := newHash()
+		for _, p := range parts {
+			h.Write(p)
+		}
+		return h.Sum(nil)
+	}
+
+	b := sum(password, salt, password)
+	size := len(b)
+
+	a := newHash()
+	a.Write(password)
+	a.Write(salt)
+
+	i := len(password)
+	for ; i > size; i -= size {
+		a.Write(b)
+	}
+	a.Write(b[:i])
+
+	for i = len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(b)
+		} else {
+			a.Write(password)
+		}
+	}
+	c := a.Sum(nil)
+
+	// Stream the password len(password) times rather than building the
+	// repeated buffer
+	hp := newHash()
+	for i := 0; i < len(password); i++ {
+		hp.Write(password)
+	}
+	p := repeatTo(hp.Sum(nil), len(password))
+
+	ds := sum(bytes.Repeat(salt, 16+int(c[0])))
+	s := repeatTo(ds, len(salt))
+
+	for r := 0; r < rounds; r++ {
+		h := newHash()
+
+		if r&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+
+		if r%3 != 0 {
+			h.Write(s)
+		}
+
+		if r%7 != 0 {
+			h.Write(p)
+		}
+
+		if r&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+
+		c = h.Sum(nil)
+	}
+
+	var out []byte
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			out = append(out, shaCryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+
+	for _, o := range order {
+		encode(c[o[0]], c[o[1]], c[o[2]], 4)
+	}
+
+	if size == sha256.Size {
+		encode(0, c[31], c[30], 3)
+	} else {
+		encode(0, 0, c[63], 2)
+	}
+
+	return out
+}
+
+// repeatTo repeats b to fill exactly n bytes
+func repeatTo(b []byte, n int) []byte {
+	out := make([]byte, 0, n+len(b))
+	for len(out) < n {
+		out = append(out, b...)
+	}
+
+	return out[:n]
+}
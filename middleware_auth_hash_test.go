@@ -0,0 +1,101 @@
+package rye
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Password Hashes", func() {
+
+	verify := func(hash, password string) bool {
+		v, err := newHashVerifier(hash)
+		Expect(err).ToNot(HaveOccurred())
+		return v([]byte(password))
+	}
+
+	Context("SHA-crypt", func() {
+		It("should verify SHA-256 hashes", func() {
+			hash := "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"
+			Expect(verify(hash, "Hello world!")).To(BeTrue())
+			Expect(verify(hash, "Hello world")).To(BeFalse())
+		})
+
+		It("should verify SHA-512 hashes", func() {
+			hash := "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+			Expect(verify(hash, "Hello world!")).To(BeTrue())
+			Expect(verify(hash, "hello world!")).To(BeFalse())
+		})
+
+		It("should honour the rounds and truncate long salts", func() {
+			hash := "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"
+			Expect(verify(hash, "Hello world!")).To(BeTrue())
+
+			hash = "$5$rounds=10000$saltstringsaltstring$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"
+			Expect(verify(hash, "Hello world!")).To(BeTrue())
+		})
+
+		It("should verify long passwords", func() {
+			hash := "$5$rounds=77777$short$JiO1O3ZpDAxGJeaDIuqCoEFysAe1mZNJRs3pw0KQRd/"
+			Expect(verify(hash, "we have a short salt string but not a short password")).To(BeTrue())
+		})
+
+		It("should refuse passwords over the length limit", func() {
+			hash := "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"
+			Expect(verify(hash, strings.Repeat("a", maxHashedSecretLength+1))).To(BeFalse())
+		})
+
+		It("should reject malformed hashes", func() {
+			for _, hash := range []string{"$5$salt", "$5$turns=10$salt$x", "$6$rounds=x$salt$x"} {
+				_, err := newHashVerifier(hash)
+				Expect(err).To(HaveOccurred(), hash)
+			}
+		})
+	})
+
+	Context("bcrypt", func() {
+		It("should verify hashes", func() {
+			hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+			Expect(verify(string(hash), "secret")).To(BeTrue())
+			Expect(verify(string(hash), "secreT")).To(BeFalse())
+		})
+	})
+
+	Context("argon2id", func() {
+		It("should verify hashes", func() {
+			salt := []byte("somesalt")
+			hash := fmt.Sprintf("$argon2id$v=19$m=1024,t=1,p=1$%s$%s",
+				base64.RawStdEncoding.EncodeToString(salt),
+				base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), salt, 1, 1024, 1, 32)))
+
+			Expect(verify(hash, "secret")).To(BeTrue())
+			Expect(verify(hash, "secreT")).To(BeFalse())
+		})
+
+		It("should reject other versions", func() {
+			_, err := newHashVerifier("$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject out of range parameters", func() {
+			for _, params := range []string{"m=1024,t=1,p=0", "m=1024,t=0,p=1", "m=7,t=1,p=1", "m=16,t=1,p=4", "m=4194304,t=1,p=1"} {
+				_, err := newHashVerifier("$argon2id$v=19$" + params + "$c2FsdA$a2V5")
+				Expect(err).To(HaveOccurred(), params)
+			}
+
+			_, err := newHashVerifier("$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$" + base64.RawStdEncoding.EncodeToString(make([]byte, 2048)))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("should reject unsupported hashes", func() {
+		_, err := newHashVerifier("$apr1$salt$hash")
+		Expect(err).To(MatchError("unsupported hash: $apr1$salt$hash"))
+	})
+})
@@ -0,0 +1,127 @@
+package rye
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HtpasswdConfig is used to configure an Htpasswd.
+type HtpasswdConfig struct {
+	Path string
+
+	// OnReloadError is called when a reload fails; the current users stay
+	// in place. Defaults to logging the error.
+	OnReloadError func(error)
+}
+
+/*
+Htpasswd provides Basic auth backed by an Apache htpasswd file, which is
+reloaded whenever it changes. Passwords must be hashed with bcrypt
+(`htpasswd -B`), SHA-crypt or argon2id; the legacy MD5, SHA-1 and DES crypt
+formats are rejected.
+
+A reload failing on a read error or a single unsupported hash keeps the
+current users, and is reported through `OnReloadError`.
+
+Use its `AuthFunc` with `NewMiddlewareAuth`.
+*/
+type Htpasswd struct {
+	hashedBasicAuth
+	reloader
+
+	config HtpasswdConfig
+}
+
+/*
+NewHtpasswd loads an htpasswd file and starts watching it. The initial load
+must succeed, otherwise an error is returned.
+
+Example usage:
+
+	htpasswd, err := rye.NewHtpasswd(rye.HtpasswdConfig{Path: "/etc/myapp/.htpasswd"})
+	if err != nil {
+		log.Fatalf("Unable to load htpasswd file: %v", err)
+	}
+	defer htpasswd.Close()
+
+	routes.Handle("/some/route", myMWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareAuth(htpasswd.AuthFunc()),
+			yourHandler,
+		})).Methods("POST")
+*/
+func NewHtpasswd(config HtpasswdConfig) (*Htpasswd, error) {
+	config.Path = filepath.Clean(config.Path)
+
+	if config.OnReloadError == nil {
+		config.OnReloadError = func(err error) {
+			log.Errorf("Unable to reload htpasswd file: %v", err)
+		}
+	}
+
+	h := &Htpasswd{config: config}
+
+	if err := h.start(h.load, config.OnReloadError, watchedFile(config.Path), 0); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// AuthFunc returns the AuthFunc checking credentials against the file.
+func (h *Htpasswd) AuthFunc() AuthFunc {
+	return h.authenticate
+}
+
+func (h *Htpasswd) load() error {
+	userHashes, err := readHtpasswd(h.config.Path)
+	if err != nil {
+		return err
+	}
+
+	table, err := newPasswordTable(userHashes)
+	if err != nil {
+		return fmt.Errorf("%v: %v", h.config.Path, err)
+	}
+
+	h.table.Store(table)
+	return nil
+}
+
+// readHtpasswd reads the user:hash lines of an htpasswd file
+func readHtpasswd(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	userHashes := make(map[string]string)
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%v:%d: expected user:hash", path, n)
+		}
+
+		user, hash := line[:i], line[i+1:]
+		if !isPasswordHash(hash) {
+			return nil, fmt.Errorf("%v:%d: unsupported hash for user %v; use bcrypt, SHA-crypt or argon2id", path, n, user)
+		}
+
+		userHashes[user] = hash
+	}
+
+	return userHashes, scanner.Err()
+}
@@ -0,0 +1,95 @@
+package rye
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Htpasswd", func() {
+
+	const (
+		// "Hello world!"
+		aliceHash = "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"
+		bobHash   = "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+	)
+
+	var (
+		dir       string
+		path      string
+		reloadErr error
+	)
+
+	basic := func(user, pass string) string {
+		return "Basic " + base64Encode(user+":"+pass)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "rye-htpasswd")
+		Expect(err).ToNot(HaveOccurred())
+
+		path = filepath.Join(dir, ".htpasswd")
+		Expect(ioutil.WriteFile(path, []byte("# users\nalice:"+aliceHash+"\n"), 0644)).To(Succeed())
+		reloadErr = nil
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	newHtpasswd := func() *Htpasswd {
+		h, err := NewHtpasswd(HtpasswdConfig{
+			Path:          path,
+			OnReloadError: func(err error) { reloadErr = err },
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return h
+	}
+
+	It("should authenticate users from the file", func() {
+		h := newHtpasswd()
+		defer h.Close()
+
+		resp := h.AuthFunc()(context.Background(), basic("alice", "Hello world!"))
+		Expect(resp.Err).To(BeNil())
+		Expect(resp.Context.Value(AUTH_USERNAME_KEY)).To(Equal("alice"))
+
+		Expect(h.AuthFunc()(context.Background(), basic("alice", "nope")).Err).To(HaveOccurred())
+		Expect(h.AuthFunc()(context.Background(), basic("mallory", "Hello world!")).Err).To(HaveOccurred())
+	})
+
+	It("should reject unsupported hashes", func() {
+		Expect(ioutil.WriteFile(path, []byte("alice:$apr1$salt$hash\n"), 0644)).To(Succeed())
+		_, err := NewHtpasswd(HtpasswdConfig{Path: path})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(".htpasswd:1: unsupported hash for user alice"))
+	})
+
+	It("should reload when the file changes", func() {
+		h := newHtpasswd()
+		defer h.Close()
+
+		Expect(ioutil.WriteFile(path, []byte("bob:"+bobHash+"\n"), 0644)).To(Succeed())
+
+		Eventually(func() error {
+			return h.AuthFunc()(context.Background(), basic("bob", "Hello world!")).Err
+		}).Should(BeNil())
+		Expect(h.AuthFunc()(context.Background(), basic("alice", "Hello world!")).Err).To(HaveOccurred())
+	})
+
+	It("should keep the current users when a reload fails", func() {
+		h := newHtpasswd()
+		defer h.Close()
+
+		Expect(ioutil.WriteFile(path, []byte("alice\n"), 0644)).To(Succeed())
+		Expect(h.Reload()).To(HaveOccurred())
+		Expect(reloadErr.Error()).To(ContainSubstring("expected user:hash"))
+
+		Expect(h.AuthFunc()(context.Background(), basic("alice", "Hello world!")).Err).To(BeNil())
+	})
+})
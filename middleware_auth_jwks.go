@@ -0,0 +1,414 @@
+package rye
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// JWKS specific constants
+	DEFAULT_JWKS_REFRESH_INTERVAL     = time.Hour
+	DEFAULT_JWKS_MIN_REFETCH_INTERVAL = time.Minute
+	DEFAULT_JWKS_TIMEOUT              = 10 * time.Second
+
+	jwksMaxSize = 1 << 20
+)
+
+// JWTKeySet provides the public keys verifying asymmetrically signed JWTs.
+type JWTKeySet interface {
+	// Key returns the key with the kid, or an error if there is none. Tokens
+	// without a kid are passed an empty one.
+	Key(kid string) (crypto.PublicKey, error)
+}
+
+// jwtKeys is a fixed set of public keys by kid
+type jwtKeys map[string]crypto.PublicKey
+
+// Key finds a key by kid; a token without a kid is verified with the only key
+// of the set, if there is just the one.
+func (k jwtKeys) Key(kid string) (crypto.PublicKey, error) {
+	if key, ok := k[kid]; ok {
+		return key, nil
+	}
+
+	if kid == "" && len(k) == 1 {
+		for _, key := range k {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown key: %q", kid)
+}
+
+// NewStaticKeySet creates a JWTKeySet from RSA, ECDSA and Ed25519 public keys
+// by kid.
+func NewStaticKeySet(keys map[string]crypto.PublicKey) JWTKeySet {
+	k := make(jwtKeys, len(keys))
+	for kid, key := range keys {
+		k[kid] = key
+	}
+
+	return k
+}
+
+/*
+NewPEMKeySet creates a JWTKeySet from PEM files by kid. Each file holds a
+public key ("PUBLIC KEY" or "RSA PUBLIC KEY") or a certificate.
+
+Example usage:
+
+	keys, err := rye.NewPEMKeySet(map[string]string{
+		"2024-01": "/etc/myapp/jwt-2024-01.pem",
+		"2024-07": "/etc/myapp/jwt-2024-07.pem",
+	})
+*/
+func NewPEMKeySet(files map[string]string) (JWTKeySet, error) {
+	keys := make(jwtKeys, len(files))
+
+	for kid, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ParsePublicKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+
+		keys[kid] = key
+	}
+
+	return keys, nil
+}
+
+// ParsePublicKeyPEM parses the first public key or certificate of PEM data,
+// which must hold an RSA, ECDSA or Ed25519 key.
+func ParsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no public key found")
+		}
+
+		var key interface{}
+		var err error
+
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+			return key, nil
+		}
+
+		return nil, fmt.Errorf("unsupported key type: %T", key)
+	}
+}
+
+/*****
+ JWKS
+*****/
+
+// JWKSConfig is used to configure a JWKS.
+type JWKSConfig struct {
+	URL string
+
+	// HTTPClient fetches the key set; defaults to a client with a
+	// DEFAULT_JWKS_TIMEOUT timeout.
+	HTTPClient *http.Client
+
+	// RefreshInterval is how often the key set is refetched in the
+	// background; defaults to DEFAULT_JWKS_REFRESH_INTERVAL.
+	RefreshInterval time.Duration
+
+	// MinRefetchInterval limits how often a token with an unknown kid can
+	// trigger a refetch; defaults to DEFAULT_JWKS_MIN_REFETCH_INTERVAL.
+	MinRefetchInterval time.Duration
+
+	// OnRefreshError is called when a refresh fails; the cached keys stay in
+	// place. Defaults to logging the error.
+	OnRefreshError func(error)
+}
+
+/*
+JWKS is a JWTKeySet fetched from a JSON Web Key Set URL, as published by most
+identity providers. The keys are cached, and refreshed in the background;
+a token signed with a key that isn't known yet triggers a refetch, so keys
+can be rotated without waiting for the next refresh.
+
+Every refresh is all or nothing: a fetch error or a single malformed key
+leaves the cached keys in place and is reported through `OnRefreshError`.
+Keys of other types, or not meant for signatures, are ignored.
+*/
+type JWKS struct {
+	reloader
+
+	config JWKSConfig
+
+	// keys holds the current jwtKeys
+	keys atomic.Value
+
+	// lastFetch is guarded by the reloader's mutex
+	lastFetch time.Time
+
+	// now is swapped in tests
+	now func() time.Time
+}
+
+/*
+NewJWKS fetches a JWKS and starts refreshing it. The initial fetch must
+succeed, otherwise an error is returned.
+
+Example usage:
+
+	jwks, err := rye.NewJWKS(rye.JWKSConfig{URL: "https://idp.example.com/.well-known/jwks.json"})
+	if err != nil {
+		log.Fatalf("Unable to fetch JWKS: %v", err)
+	}
+	defer jwks.Close()
+
+	authFunc, err := rye.NewJWTAuthFuncWithConfig(rye.JWTConfig{Keys: jwks})
+*/
+func NewJWKS(config JWKSConfig) (*JWKS, error) {
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: DEFAULT_JWKS_TIMEOUT}
+	}
+
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DEFAULT_JWKS_REFRESH_INTERVAL
+	}
+
+	if config.MinRefetchInterval <= 0 {
+		config.MinRefetchInterval = DEFAULT_JWKS_MIN_REFETCH_INTERVAL
+	}
+
+	if config.OnRefreshError == nil {
+		config.OnRefreshError = func(err error) {
+			log.Errorf("Unable to refresh JWKS: %v", err)
+		}
+	}
+
+	j := &JWKS{
+		config: config,
+		now:    time.Now,
+	}
+
+	if err := j.start(j.fetch, config.OnRefreshError, nil, config.RefreshInterval); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Key returns the key with the kid, refetching the key set first if the kid
+// is unknown and the key set wasn't fetched too recently.
+func (j *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	if key, err := j.keys.Load().(jwtKeys).Key(kid); err == nil {
+		return key, nil
+	}
+
+	j.refetch()
+
+	return j.keys.Load().(jwtKeys).Key(kid)
+}
+
+// refetch fetches the key set, unless it was fetched within the last
+// MinRefetchInterval; concurrent callers wait for a single fetch
+func (j *JWKS) refetch() {
+	j.mu.Lock()
+	if j.now().Sub(j.lastFetch) < j.config.MinRefetchInterval {
+		j.mu.Unlock()
+		return
+	}
+
+	err := j.fetch()
+	j.mu.Unlock()
+
+	if err != nil {
+		j.config.OnRefreshError(err)
+	}
+}
+
+// Refresh fetches the key set and swaps it in atomically. On error the cached
+// keys are kept and the error is also reported.
+func (j *JWKS) Refresh() error {
+	return j.Reload()
+}
+
+// fetch is run by the reloader, which serialises fetches
+func (j *JWKS) fetch() error {
+	// Count failed fetches too, so an unreachable URL isn't hammered
+	j.lastFetch = j.now()
+
+	req, err := http.NewRequest("GET", j.config.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := j.config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: unexpected status %d", j.config.URL, resp.StatusCode)
+	}
+
+	keys, err := parseJWKS(io.LimitReader(resp.Body, jwksMaxSize))
+	if err != nil {
+		return fmt.Errorf("%v: %v", j.config.URL, err)
+	}
+
+	j.keys.Store(keys)
+	return nil
+}
+
+// jwk is a JSON Web Key (RFC 7517), with the members of the key types we
+// support
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses the signing keys of a JSON Web Key Set
+func parseJWKS(r io.Reader) (jwtKeys, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(jwtKeys, len(set.Keys))
+
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (%q): %v", i, k.Kid, err)
+		}
+
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+
+	return keys, nil
+}
+
+// publicKey decodes the key; it returns nil for unsupported key types
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeJWKInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC point")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, nil
+}
+
+// decodeJWKInt decodes a base64url encoded big-endian integer
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
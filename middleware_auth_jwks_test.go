@@ -0,0 +1,255 @@
+package rye
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JWKS", func() {
+	var (
+		rsaKey *rsa.PrivateKey
+		ecKey  *ecdsa.PrivateKey
+		edKey  ed25519.PrivateKey
+
+		server *httptest.Server
+		mu     sync.Mutex
+		keys   []map[string]string
+		status int
+		hits   int
+
+		refreshErr error
+	)
+
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	rsaJWK := func(kid string, key *rsa.PublicKey) map[string]string {
+		return map[string]string{
+			"kty": "RSA", "kid": kid, "use": "sig",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}
+	}
+
+	setKeys := func(k ...map[string]string) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = k
+	}
+
+	BeforeEach(func() {
+		var err error
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		ecKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		_, edKey, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+
+		setKeys(
+			rsaJWK("rsa", &rsaKey.PublicKey),
+			map[string]string{
+				"kty": "EC", "kid": "ec", "crv": "P-384",
+				"x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes()),
+			},
+			map[string]string{
+				"kty": "OKP", "kid": "ed", "crv": "Ed25519",
+				"x": b64(edKey.Public().(ed25519.PublicKey)),
+			},
+			// Ignored: not a signing key, and an unsupported key type
+			map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": "!", "e": "!"},
+			map[string]string{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+		)
+
+		status = http.StatusOK
+		hits = 0
+		refreshErr = nil
+
+		server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			hits++
+			if status != http.StatusOK {
+				rw.WriteHeader(status)
+				return
+			}
+
+			json.NewEncoder(rw).Encode(map[string]interface{}{"keys": keys})
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newJWKS := func() *JWKS {
+		jwks, err := NewJWKS(JWKSConfig{
+			URL:            server.URL,
+			OnRefreshError: func(err error) { refreshErr = err },
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return jwks
+	}
+
+	getHits := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits
+	}
+
+	It("should verify tokens with the fetched keys", func() {
+		jwks := newJWKS()
+		defer jwks.Close()
+
+		authFunc, err := NewJWTAuthFuncWithConfig(JWTConfig{Keys: jwks})
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, token := range []string{
+			signJWT(jwt.SigningMethodRS256, "rsa", rsaKey, jwt.MapClaims{}),
+			signJWT(jwt.SigningMethodES384, "ec", ecKey, jwt.MapClaims{}),
+			signJWT(SigningMethodEdDSA, "ed", edKey, jwt.MapClaims{}),
+		} {
+			Expect(authFunc(context.Background(), "Bearer "+token).Err).To(BeNil())
+		}
+
+		_, err = jwks.Key("enc")
+		Expect(err).To(HaveOccurred())
+		_, err = jwks.Key("hmac")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should refetch on an unknown kid", func() {
+		jwks := newJWKS()
+		defer jwks.Close()
+
+		rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		setKeys(rsaJWK("rotated", &rotated.PublicKey))
+
+		// The key set was just fetched, so unknown kids don't refetch yet
+		_, err = jwks.Key("rotated")
+		Expect(err).To(HaveOccurred())
+
+		later := time.Now().Add(DEFAULT_JWKS_MIN_REFETCH_INTERVAL)
+		jwks.now = func() time.Time { return later }
+
+		key, err := jwks.Key("rotated")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(key).To(Equal(&rotated.PublicKey))
+		Expect(getHits()).To(Equal(2))
+	})
+
+	It("should limit how often unknown kids refetch", func() {
+		jwks := newJWKS()
+		defer jwks.Close()
+
+		now := time.Now().Add(DEFAULT_JWKS_MIN_REFETCH_INTERVAL)
+		jwks.now = func() time.Time { return now }
+
+		_, err := jwks.Key("unknown")
+		Expect(err).To(HaveOccurred())
+		_, err = jwks.Key("unknown")
+		Expect(err).To(HaveOccurred())
+		Expect(getHits()).To(Equal(2))
+
+		now = now.Add(DEFAULT_JWKS_MIN_REFETCH_INTERVAL)
+		jwks.Key("unknown")
+		Expect(getHits()).To(Equal(3))
+	})
+
+	It("should keep the cached keys when a refresh fails", func() {
+		jwks := newJWKS()
+		defer jwks.Close()
+
+		mu.Lock()
+		status = http.StatusServiceUnavailable
+		mu.Unlock()
+
+		Expect(jwks.Refresh()).To(HaveOccurred())
+		Expect(refreshErr.Error()).To(ContainSubstring("unexpected status 503"))
+
+		_, err := jwks.Key("rsa")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should reject malformed keys", func() {
+		setKeys(map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64([]byte{1}), "y": b64([]byte{2})})
+
+		_, err := NewJWKS(JWKSConfig{URL: server.URL})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("invalid EC point"))
+	})
+
+	It("should error if the initial fetch fails", func() {
+		status = http.StatusNotFound
+
+		_, err := NewJWKS(JWKSConfig{URL: server.URL})
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("PEM key sets", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "rye-jwks")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		writePEM := func(name, blockType string, der []byte) string {
+			path := filepath.Join(dir, name)
+			Expect(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0644)).To(Succeed())
+			return path
+		}
+
+		It("should load keys by kid", func() {
+			ecDER, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+			Expect(err).ToNot(HaveOccurred())
+
+			keySet, err := NewPEMKeySet(map[string]string{
+				"rsa": writePEM("rsa.pem", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)),
+				"ec":  writePEM("ec.pem", "PUBLIC KEY", ecDER),
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			key, err := keySet.Key("rsa")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(key).To(Equal(&rsaKey.PublicKey))
+
+			key, err = keySet.Key("ec")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(key.(*ecdsa.PublicKey).X).To(Equal(ecKey.X))
+		})
+
+		It("should error on files without a public key", func() {
+			_, err := NewPEMKeySet(map[string]string{
+				"rsa": writePEM("key.pem", "PRIVATE KEY", []byte("nope")),
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no public key found"))
+		})
+	})
+})
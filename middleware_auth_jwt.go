@@ -0,0 +1,319 @@
+package rye
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cactus/go-statsd-client/statsd"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+/****
+ JWT
+****/
+
+// JWTConfig is used to configure JWT auth with `NewJWTAuthFuncWithConfig`.
+type JWTConfig struct {
+	// Secret verifies HMAC signed tokens (HS256, HS384 and HS512).
+	Secret string
+
+	// Keys verifies RSA, ECDSA and EdDSA signed tokens, by the `kid` in
+	// their header. See `NewPEMKeySet` and `NewJWKS`.
+	Keys JWTKeySet
+
+	// Algorithms restricts the accepted signing algorithms. Defaults to the
+	// HMAC algorithms if a Secret is set, and to the RSA, ECDSA and EdDSA
+	// ones if Keys are set.
+	Algorithms []string
+
+	// Issuer, if set, must match the token's iss claim.
+	Issuer string
+
+	// Audience, if set, requires the token's aud claim to contain one of
+	// these audiences.
+	Audience []string
+
+	// RequiredClaims lists claims which must be present in the token, ie.
+	// "exp" to reject tokens which never expire.
+	RequiredClaims []string
+
+	// MaxAge, if set, rejects tokens issued longer ago than this; the iat
+	// claim is then required.
+	MaxAge time.Duration
+
+	// Leeway allows for clock skew between the issuer and us when checking
+	// the exp, nbf and iat claims.
+	Leeway time.Duration
+
+	// NewClaims, if set, returns a pointer to a custom claims struct, which
+	// every verified token's claims are unmarshalled into. It is put into the
+	// context, see `JWTCustomClaimsFromContext`.
+	NewClaims func() interface{}
+
+	// RolesClaim names the claim holding the roles of the token's Principal;
+	// defaults to "roles".
+	RolesClaim string
+
+	// Revocation, if set, is consulted for every token once its signature
+	// and claims are verified. See `NewJWTRevocationChecker`.
+	Revocation JWTRevocationChecker
+
+	// Statter, if set, receives a counter for every request rejected because
+	// its token was revoked (jwt.revoked).
+	Statter  statsd.Statter
+	StatRate float32
+}
+
+var (
+	jwtHMACAlgorithms       = []string{"HS256", "HS384", "HS512"}
+	jwtAsymmetricAlgorithms = []string{
+		"RS256", "RS384", "RS512",
+		"PS256", "PS384", "PS512",
+		"ES256", "ES384", "ES512",
+		"EdDSA",
+	}
+)
+
+type jwtAuth struct {
+	config     JWTConfig
+	algorithms map[string]bool
+	parser     *jwt.Parser
+
+	// now is swapped in tests
+	now func() time.Time
+}
+
+func NewJWTAuthFunc(secret string) AuthFunc {
+	j := newJWTAuth(JWTConfig{Secret: secret})
+	return j.authenticate
+}
+
+/*
+NewJWTAuthFuncWithConfig creates an AuthFunc for JWTs signed with a shared
+secret, or with asymmetric keys which are picked by the token's `kid`. The
+key type has to match the token's algorithm, so a token can't ie. be made to
+verify against an RSA public key used as an HMAC secret.
+
+Example usage:
+
+	jwks, err := rye.NewJWKS(rye.JWKSConfig{URL: "https://idp.example.com/.well-known/jwks.json"})
+	if err != nil {
+		log.Fatalf("Unable to fetch JWKS: %v", err)
+	}
+	defer jwks.Close()
+
+	authFunc, err := rye.NewJWTAuthFuncWithConfig(rye.JWTConfig{Keys: jwks})
+	if err != nil {
+		log.Fatalf("Invalid JWT config: %v", err)
+	}
+
+	routes.Handle("/some/route", myMWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareAuth(authFunc),
+			yourHandler,
+		})).Methods("GET")
+*/
+func NewJWTAuthFuncWithConfig(config JWTConfig) (AuthFunc, error) {
+	if config.Secret == "" && config.Keys == nil {
+		return nil, errors.New("no JWT secret or keys configured")
+	}
+
+	for _, alg := range config.Algorithms {
+		if jwt.GetSigningMethod(alg) == nil || alg == "none" {
+			return nil, fmt.Errorf("unsupported JWT algorithm: %v", alg)
+		}
+	}
+
+	return newJWTAuth(config).authenticate, nil
+}
+
+func newJWTAuth(config JWTConfig) *jwtAuth {
+	if config.RolesClaim == "" {
+		config.RolesClaim = "roles"
+	}
+
+	algorithms := config.Algorithms
+	if len(algorithms) == 0 {
+		if config.Secret != "" {
+			algorithms = append(algorithms, jwtHMACAlgorithms...)
+		}
+		if config.Keys != nil {
+			algorithms = append(algorithms, jwtAsymmetricAlgorithms...)
+		}
+	}
+
+	j := &jwtAuth{
+		config:     config,
+		algorithms: make(map[string]bool, len(algorithms)),
+		// The claims are validated by us, with leeway
+		parser: &jwt.Parser{UseJSONNumber: true, SkipClaimsValidation: true},
+		now:    time.Now,
+	}
+
+	for _, alg := range algorithms {
+		j.algorithms[alg] = true
+	}
+
+	return j
+}
+
+const bearerPrefix = "Bearer "
+
+func (j *jwtAuth) authenticate(ctx context.Context, auth string) *Response {
+	// Remove 'Bearer' prefix
+	if !strings.HasPrefix(auth, bearerPrefix) && !strings.HasPrefix(auth, strings.ToLower(bearerPrefix)) {
+		return &Response{
+			Err:        errInvalidAuth,
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	token := auth[len(bearerPrefix):]
+
+	parsed, err := j.parser.Parse(token, j.key)
+	if err != nil {
+		return &Response{
+			Err:        err,
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	claims, err := newJWTClaims(parsed.Claims.(jwt.MapClaims))
+	if err == nil {
+		err = j.validate(claims)
+	}
+	if err != nil {
+		return &Response{
+			Err:        err,
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	if j.config.Revocation != nil {
+		if resp := j.checkRevoked(ctx, claims); resp != nil {
+			return resp
+		}
+	}
+
+	ctx = context.WithValue(ctx, CONTEXT_JWT, token)
+	ctx = context.WithValue(ctx, CONTEXT_JWT_CLAIMS, claims)
+	ctx = ContextWithPrincipal(ctx, newJWTPrincipal(claims, j.config.RolesClaim))
+
+	if j.config.NewClaims != nil {
+		custom, err := decodeCustomClaims(token, j.config.NewClaims())
+		if err != nil {
+			return &Response{
+				Err:        err,
+				StatusCode: http.StatusUnauthorized,
+			}
+		}
+
+		ctx = context.WithValue(ctx, CONTEXT_JWT_CUSTOM_CLAIMS, custom)
+	}
+
+	return &Response{
+		Context: ctx,
+	}
+}
+
+// key is the jwt.Keyfunc: it finds the key for the token, and checks that it
+// is of the right type for the token's algorithm
+func (j *jwtAuth) key(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if !j.algorithms[alg] {
+		return nil, fmt.Errorf("Unexpected signing method: %v", alg)
+	}
+
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if j.config.Secret == "" {
+			return nil, fmt.Errorf("Unexpected signing method: %v", alg)
+		}
+		return []byte(j.config.Secret), nil
+	}
+
+	if j.config.Keys == nil {
+		return nil, fmt.Errorf("Unexpected signing method: %v", alg)
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	key, err := j.config.Keys.Key(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	ok := false
+	switch m := token.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok = key.(*rsa.PublicKey)
+	case *jwt.SigningMethodECDSA:
+		var k *ecdsa.PublicKey
+		k, ok = key.(*ecdsa.PublicKey)
+		ok = ok && k.Curve.Params().BitSize == m.CurveBits
+	case *signingMethodEdDSA:
+		_, ok = key.(ed25519.PublicKey)
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("key %q can't verify %v signatures", kid, alg)
+	}
+
+	return key, nil
+}
+
+/******
+ EdDSA
+******/
+
+// signingMethodEdDSA implements the Ed25519 EdDSA signing method (RFC 8037),
+// which jwt-go lacks
+type signingMethodEdDSA struct{}
+
+// SigningMethodEdDSA signs and verifies tokens with Ed25519 keys. It is
+// registered with jwt-go as "EdDSA", and can be used to sign tokens with an
+// ed25519.PrivateKey.
+var SigningMethodEdDSA jwt.SigningMethod = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok || len(publicKey) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok || len(privateKey) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
@@ -0,0 +1,224 @@
+package rye
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	CONTEXT_JWT_CLAIMS        = "rye-middlewarejwt-claims"
+	CONTEXT_JWT_CUSTOM_CLAIMS = "rye-middlewarejwt-custom-claims"
+)
+
+// JWTClaims are the claims of a verified JWT. The registered claims are
+// parsed into their fields; zero values mean the claim is absent.
+type JWTClaims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+	ID        string
+
+	// Claims holds every claim of the token, registered ones included.
+	// Numbers are json.Number.
+	Claims map[string]interface{}
+}
+
+/*
+JWTClaimsFromContext returns the claims of the JWT verified by the auth
+middleware.
+
+	func handler(rw http.ResponseWriter, r *http.Request) *rye.Response {
+		if claims, ok := rye.JWTClaimsFromContext(r); ok {
+			log.Infof("request from %v", claims.Subject)
+		}
+		return nil
+	}
+*/
+func JWTClaimsFromContext(r *http.Request) (*JWTClaims, bool) {
+	claims, ok := r.Context().Value(CONTEXT_JWT_CLAIMS).(*JWTClaims)
+	return claims, ok
+}
+
+/*
+JWTCustomClaimsFromContext returns the custom claims struct of the JWT verified
+by the auth middleware, see `JWTConfig.NewClaims`.
+
+	authFunc, err := rye.NewJWTAuthFuncWithConfig(rye.JWTConfig{
+		Keys:      jwks,
+		NewClaims: func() interface{} { return &MyClaims{} },
+	})
+
+	func handler(rw http.ResponseWriter, r *http.Request) *rye.Response {
+		if claims, ok := rye.JWTCustomClaimsFromContext(r); ok {
+			log.Infof("request from tenant %v", claims.(*MyClaims).Tenant)
+		}
+		return nil
+	}
+*/
+func JWTCustomClaimsFromContext(r *http.Request) (interface{}, bool) {
+	claims := r.Context().Value(CONTEXT_JWT_CUSTOM_CLAIMS)
+	return claims, claims != nil
+}
+
+// Has checks if the token has a claim
+func (c *JWTClaims) Has(name string) bool {
+	_, ok := c.Claims[name]
+	return ok
+}
+
+// newJWTClaims parses the registered claims of a token
+func newJWTClaims(m jwt.MapClaims) (*JWTClaims, error) {
+	c := &JWTClaims{Claims: m}
+
+	var err error
+	for _, s := range []struct {
+		name  string
+		value *string
+	}{
+		{"iss", &c.Issuer},
+		{"sub", &c.Subject},
+		{"jti", &c.ID},
+	} {
+		if v, ok := m[s.name]; ok {
+			if *s.value, ok = v.(string); !ok {
+				return nil, fmt.Errorf("invalid %v claim", s.name)
+			}
+		}
+	}
+
+	for _, t := range []struct {
+		name  string
+		value *time.Time
+	}{
+		{"exp", &c.ExpiresAt},
+		{"nbf", &c.NotBefore},
+		{"iat", &c.IssuedAt},
+	} {
+		if v, ok := m[t.name]; ok {
+			if *t.value, err = numericDate(v); err != nil {
+				return nil, fmt.Errorf("invalid %v claim", t.name)
+			}
+		}
+	}
+
+	switch aud := m["aud"].(type) {
+	case nil:
+	case string:
+		c.Audience = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			s, ok := a.(string)
+			if !ok {
+				return nil, errors.New("invalid aud claim")
+			}
+			c.Audience = append(c.Audience, s)
+		}
+	default:
+		return nil, errors.New("invalid aud claim")
+	}
+
+	return c, nil
+}
+
+// numericDate parses a JWT NumericDate, seconds since the epoch
+func numericDate(v interface{}) (time.Time, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, errors.New("not a number")
+	}
+
+	f, err := n.Float64()
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, errors.New("not a number")
+	}
+
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// validate checks the claims against the config, allowing for leeway
+func (j *jwtAuth) validate(c *JWTClaims) error {
+	now := j.now()
+	leeway := j.config.Leeway
+
+	for _, name := range j.config.RequiredClaims {
+		if !c.Has(name) {
+			return fmt.Errorf("token is missing required claim: %v", name)
+		}
+	}
+
+	if !c.ExpiresAt.IsZero() && now.After(c.ExpiresAt.Add(leeway)) {
+		return errors.New("token is expired")
+	}
+
+	if !c.NotBefore.IsZero() && now.Add(leeway).Before(c.NotBefore) {
+		return errors.New("token is not valid yet")
+	}
+
+	if !c.IssuedAt.IsZero() && now.Add(leeway).Before(c.IssuedAt) {
+		return errors.New("token used before issued")
+	}
+
+	if j.config.MaxAge > 0 {
+		if c.IssuedAt.IsZero() {
+			return errors.New("token is missing required claim: iat")
+		}
+
+		if now.After(c.IssuedAt.Add(j.config.MaxAge + leeway)) {
+			return errors.New("token is too old")
+		}
+	}
+
+	if j.config.Issuer != "" && c.Issuer != j.config.Issuer {
+		return fmt.Errorf("invalid token issuer: %v", c.Issuer)
+	}
+
+	if len(j.config.Audience) > 0 && !containsAny(c.Audience, j.config.Audience) {
+		return fmt.Errorf("invalid token audience: %v", strings.Join(c.Audience, ", "))
+	}
+
+	return nil
+}
+
+// decodeCustomClaims unmarshals the claims of an already verified token into
+// a custom claims struct
+func decodeCustomClaims(token string, claims interface{}) (interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token contains an invalid number of segments")
+	}
+
+	payload, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %v", err)
+	}
+
+	return claims, nil
+}
+
+// containsAny checks if any of want is in have
+func containsAny(have, want []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if h == w {
+				return true
+			}
+		}
+	}
+
+	return false
+}
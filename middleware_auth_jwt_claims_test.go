@@ -0,0 +1,120 @@
+package rye
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JWT Claims", func() {
+	var (
+		config JWTConfig
+		now    time.Time
+	)
+
+	BeforeEach(func() {
+		config = JWTConfig{Secret: "secret"}
+		now = time.Unix(1700000000, 0)
+	})
+
+	authenticate := func(claims jwt.MapClaims) *Response {
+		j := newJWTAuth(config)
+		j.now = func() time.Time { return now }
+
+		token := signJWT(jwt.SigningMethodHS256, "", []byte("secret"), claims)
+		return j.authenticate(context.Background(), "Bearer "+token)
+	}
+
+	It("should put the parsed claims into the context", func() {
+		resp := authenticate(jwt.MapClaims{
+			"iss":   "https://idp.example.com",
+			"sub":   "alice",
+			"aud":   []string{"api", "web"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+			"jti":   "abc",
+			"scope": "read",
+		})
+		Expect(resp.Err).To(BeNil())
+
+		r := (&http.Request{}).WithContext(resp.Context)
+		claims, ok := JWTClaimsFromContext(r)
+		Expect(ok).To(BeTrue())
+		Expect(claims.Issuer).To(Equal("https://idp.example.com"))
+		Expect(claims.Subject).To(Equal("alice"))
+		Expect(claims.Audience).To(Equal([]string{"api", "web"}))
+		Expect(claims.ExpiresAt).To(Equal(now.Add(time.Hour)))
+		Expect(claims.IssuedAt).To(Equal(now))
+		Expect(claims.ID).To(Equal("abc"))
+		Expect(claims.Claims["scope"]).To(Equal("read"))
+
+		_, ok = JWTCustomClaimsFromContext(r)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should put custom claims into the context", func() {
+		type myClaims struct {
+			Subject string `json:"sub"`
+			Tenant  string `json:"tenant"`
+		}
+		config.NewClaims = func() interface{} { return &myClaims{} }
+
+		resp := authenticate(jwt.MapClaims{"sub": "alice", "tenant": "acme"})
+		Expect(resp.Err).To(BeNil())
+
+		custom, ok := JWTCustomClaimsFromContext((&http.Request{}).WithContext(resp.Context))
+		Expect(ok).To(BeTrue())
+		Expect(custom).To(Equal(&myClaims{Subject: "alice", Tenant: "acme"}))
+	})
+
+	It("should check exp, nbf and iat with leeway", func() {
+		expired := jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}
+		notYet := jwt.MapClaims{"nbf": now.Add(time.Minute).Unix()}
+		future := jwt.MapClaims{"iat": now.Add(time.Minute).Unix()}
+
+		Expect(authenticate(expired).Err.Error()).To(ContainSubstring("token is expired"))
+		Expect(authenticate(notYet).Err.Error()).To(ContainSubstring("token is not valid yet"))
+		Expect(authenticate(future).Err.Error()).To(ContainSubstring("token used before issued"))
+
+		config.Leeway = 2 * time.Minute
+		Expect(authenticate(expired).Err).To(BeNil())
+		Expect(authenticate(notYet).Err).To(BeNil())
+		Expect(authenticate(future).Err).To(BeNil())
+	})
+
+	It("should reject tokens older than the max age", func() {
+		config.MaxAge = time.Hour
+
+		Expect(authenticate(jwt.MapClaims{"iat": now.Add(-time.Minute).Unix()}).Err).To(BeNil())
+		Expect(authenticate(jwt.MapClaims{"iat": now.Add(-2 * time.Hour).Unix()}).Err.Error()).To(ContainSubstring("too old"))
+		Expect(authenticate(jwt.MapClaims{}).Err.Error()).To(ContainSubstring("missing required claim: iat"))
+	})
+
+	It("should check the issuer and audience", func() {
+		config.Issuer = "https://idp.example.com"
+		config.Audience = []string{"api"}
+
+		Expect(authenticate(jwt.MapClaims{"iss": "https://idp.example.com", "aud": "api"}).Err).To(BeNil())
+		Expect(authenticate(jwt.MapClaims{"iss": "https://idp.example.com", "aud": []string{"web", "api"}}).Err).To(BeNil())
+		Expect(authenticate(jwt.MapClaims{"iss": "https://evil.example.com", "aud": "api"}).Err.Error()).To(ContainSubstring("invalid token issuer"))
+		Expect(authenticate(jwt.MapClaims{"iss": "https://idp.example.com", "aud": "web"}).Err.Error()).To(ContainSubstring("invalid token audience"))
+		Expect(authenticate(jwt.MapClaims{"iss": "https://idp.example.com"}).Err).To(HaveOccurred())
+	})
+
+	It("should require the configured claims", func() {
+		config.RequiredClaims = []string{"exp", "tenant"}
+
+		Expect(authenticate(jwt.MapClaims{"exp": now.Add(time.Hour).Unix(), "tenant": "acme"}).Err).To(BeNil())
+		Expect(authenticate(jwt.MapClaims{"exp": now.Add(time.Hour).Unix()}).Err.Error()).To(ContainSubstring("missing required claim: tenant"))
+	})
+
+	It("should reject malformed registered claims", func() {
+		Expect(authenticate(jwt.MapClaims{"exp": "tomorrow"}).Err.Error()).To(ContainSubstring("invalid exp claim"))
+		Expect(authenticate(jwt.MapClaims{"sub": 42}).Err.Error()).To(ContainSubstring("invalid sub claim"))
+		Expect(authenticate(jwt.MapClaims{"aud": []interface{}{1}}).Err.Error()).To(ContainSubstring("invalid aud claim"))
+	})
+})
@@ -0,0 +1,183 @@
+package rye
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// JWTRevocationChecker decides whether a verified token has been revoked, ie.
+// after a logout or a leaked key.
+type JWTRevocationChecker interface {
+	IsRevoked(ctx context.Context, claims *JWTClaims) (bool, error)
+}
+
+// JWTRevocationCheckerFunc adapts a func to a JWTRevocationChecker.
+type JWTRevocationCheckerFunc func(ctx context.Context, claims *JWTClaims) (bool, error)
+
+// IsRevoked calls f
+func (f JWTRevocationCheckerFunc) IsRevoked(ctx context.Context, claims *JWTClaims) (bool, error) {
+	return f(ctx, claims)
+}
+
+// JWTRevocationStore holds revocations, ie. in a database shared by all
+// instances of a service.
+type JWTRevocationStore interface {
+	// IsTokenRevoked checks if the token with the ID (jti) was revoked.
+	IsTokenRevoked(ctx context.Context, id string) (bool, error)
+
+	// RevokedBefore returns the time before which all the subject's tokens
+	// were revoked, or the zero time if they weren't.
+	RevokedBefore(ctx context.Context, subject string) (time.Time, error)
+}
+
+/*
+NewJWTRevocationChecker creates a JWTRevocationChecker backed by a store. A
+token is revoked if its ID (jti) was revoked, or if it was issued (iat) before
+its subject's tokens were revoked; tokens without an iat are then revoked too.
+
+Example usage:
+
+	revocations := rye.NewMemoryRevocationStore()
+
+	authFunc, err := rye.NewJWTAuthFuncWithConfig(rye.JWTConfig{
+		Keys:       jwks,
+		Revocation: rye.NewJWTRevocationChecker(revocations),
+	})
+
+	// On logout
+	revocations.RevokeToken(claims.ID, claims.ExpiresAt)
+
+	// On a password change
+	revocations.RevokeSubject(claims.Subject, time.Now())
+*/
+func NewJWTRevocationChecker(store JWTRevocationStore) JWTRevocationChecker {
+	return JWTRevocationCheckerFunc(func(ctx context.Context, claims *JWTClaims) (bool, error) {
+		if claims.ID != "" {
+			revoked, err := store.IsTokenRevoked(ctx, claims.ID)
+			if err != nil || revoked {
+				return revoked, err
+			}
+		}
+
+		if claims.Subject != "" {
+			before, err := store.RevokedBefore(ctx, claims.Subject)
+			if err != nil || before.IsZero() {
+				return false, err
+			}
+
+			return claims.IssuedAt.IsZero() || claims.IssuedAt.Before(before), nil
+		}
+
+		return false, nil
+	})
+}
+
+// checkRevoked returns an error response if the token was revoked, or if
+// that can't be checked
+func (j *jwtAuth) checkRevoked(ctx context.Context, claims *JWTClaims) *Response {
+	revoked, err := j.config.Revocation.IsRevoked(ctx, claims)
+	if err != nil {
+		log.Errorf("Unable to check JWT revocation: %v", err)
+
+		return &Response{
+			Err:        errors.New("unable to verify authentication"),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	if revoked {
+		if j.config.Statter != nil {
+			go j.config.Statter.Inc("jwt.revoked", 1, j.config.StatRate)
+		}
+
+		return &Response{
+			Err:        errors.New("token has been revoked"),
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	return nil
+}
+
+/*
+MemoryRevocationStore is an in-memory JWTRevocationStore, for services running
+a single instance. Revoked token IDs are forgotten once the tokens have
+expired anyway.
+*/
+type MemoryRevocationStore struct {
+	mu       sync.Mutex
+	tokens   map[string]time.Time
+	subjects map[string]time.Time
+	swept    time.Time
+
+	// now is swapped in tests
+	now func() time.Time
+}
+
+// NewMemoryRevocationStore creates an empty MemoryRevocationStore.
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		tokens:   make(map[string]time.Time),
+		subjects: make(map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+// RevokeToken revokes the token with the ID (jti). The revocation is kept
+// until expires, which should be the token's expiry plus any Leeway; a zero
+// time keeps it forever.
+func (m *MemoryRevocationStore) RevokeToken(id string, expires time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep()
+	m.tokens[id] = expires
+}
+
+// RevokeSubject revokes all the tokens of the subject issued before the time.
+func (m *MemoryRevocationStore) RevokeSubject(subject string, before time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if before.After(m.subjects[subject]) {
+		m.subjects[subject] = before
+	}
+}
+
+// IsTokenRevoked checks if the token with the ID was revoked.
+func (m *MemoryRevocationStore) IsTokenRevoked(ctx context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expires, ok := m.tokens[id]
+	return ok && (expires.IsZero() || m.now().Before(expires)), nil
+}
+
+// RevokedBefore returns the time before which the subject's tokens were
+// revoked.
+func (m *MemoryRevocationStore) RevokedBefore(ctx context.Context, subject string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.subjects[subject], nil
+}
+
+// sweep forgets the revocations of expired tokens, at most once a minute
+func (m *MemoryRevocationStore) sweep() {
+	now := m.now()
+	if now.Sub(m.swept) < time.Minute {
+		return
+	}
+	m.swept = now
+
+	for id, expires := range m.tokens {
+		if !expires.IsZero() && !now.Before(expires) {
+			delete(m.tokens, id)
+		}
+	}
+}
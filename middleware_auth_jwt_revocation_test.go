@@ -0,0 +1,99 @@
+package rye
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/InVisionApp/rye/fakes/statsdfakes"
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JWT Revocation", func() {
+	var (
+		store  *MemoryRevocationStore
+		config JWTConfig
+		now    time.Time
+	)
+
+	BeforeEach(func() {
+		now = time.Unix(1700000000, 0)
+		store = NewMemoryRevocationStore()
+		store.now = func() time.Time { return now }
+
+		config = JWTConfig{
+			Secret:     "secret",
+			Revocation: NewJWTRevocationChecker(store),
+		}
+	})
+
+	authenticate := func(claims jwt.MapClaims) *Response {
+		j := newJWTAuth(config)
+		j.now = func() time.Time { return now }
+
+		token := signJWT(jwt.SigningMethodHS256, "", []byte("secret"), claims)
+		return j.authenticate(context.Background(), "Bearer "+token)
+	}
+
+	It("should reject revoked token IDs", func() {
+		store.RevokeToken("abc", now.Add(time.Hour))
+
+		resp := authenticate(jwt.MapClaims{"jti": "abc"})
+		Expect(resp.Err).To(HaveOccurred())
+		Expect(resp.Err.Error()).To(ContainSubstring("token has been revoked"))
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		Expect(authenticate(jwt.MapClaims{"jti": "def"}).Err).To(BeNil())
+	})
+
+	It("should forget token IDs once expired", func() {
+		store.RevokeToken("abc", now.Add(time.Hour))
+
+		now = now.Add(2 * time.Hour)
+		Expect(authenticate(jwt.MapClaims{"jti": "abc"}).Err).To(BeNil())
+
+		store.RevokeToken("def", time.Time{})
+		Expect(store.tokens).ToNot(HaveKey("abc"))
+		Expect(store.tokens).To(HaveKey("def"))
+	})
+
+	It("should reject the subject's tokens issued before the revocation", func() {
+		store.RevokeSubject("alice", now)
+
+		Expect(authenticate(jwt.MapClaims{"sub": "alice", "iat": now.Add(-time.Minute).Unix()}).Err).To(HaveOccurred())
+		Expect(authenticate(jwt.MapClaims{"sub": "alice"}).Err).To(HaveOccurred())
+		Expect(authenticate(jwt.MapClaims{"sub": "alice", "iat": now.Unix()}).Err).To(BeNil())
+		Expect(authenticate(jwt.MapClaims{"sub": "bob", "iat": now.Add(-time.Minute).Unix()}).Err).To(BeNil())
+
+		// An earlier revocation doesn't undo a later one
+		store.RevokeSubject("alice", now.Add(-time.Hour))
+		Expect(authenticate(jwt.MapClaims{"sub": "alice", "iat": now.Add(-time.Minute).Unix()}).Err).To(HaveOccurred())
+	})
+
+	It("should fail closed when the checker errors", func() {
+		config.Revocation = JWTRevocationCheckerFunc(func(ctx context.Context, claims *JWTClaims) (bool, error) {
+			return false, errors.New("store unavailable")
+		})
+
+		resp := authenticate(jwt.MapClaims{"jti": "abc"})
+		Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+		Expect(resp.Err.Error()).To(ContainSubstring("unable to verify authentication"))
+	})
+
+	It("should report revoked tokens", func() {
+		inc := make(chan string, 1)
+		fakeStatter := &statsdfakes.FakeStatter{}
+		fakeStatter.IncStub = func(name string, value int64, rate float32) error {
+			inc <- name
+			return nil
+		}
+		config.Statter = fakeStatter
+
+		store.RevokeToken("abc", time.Time{})
+		authenticate(jwt.MapClaims{"jti": "abc"})
+		Eventually(inc).Should(Receive(Equal("jwt.revoked")))
+	})
+})
@@ -0,0 +1,140 @@
+package rye
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JWT Auth", func() {
+	var (
+		rsaKey   *rsa.PrivateKey
+		ecKey    *ecdsa.PrivateKey
+		edPublic ed25519.PublicKey
+		edKey    ed25519.PrivateKey
+		keys     JWTKeySet
+	)
+
+	BeforeEach(func() {
+		var err error
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		edPublic, edKey, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+
+		keys = NewStaticKeySet(map[string]crypto.PublicKey{
+			"rsa": &rsaKey.PublicKey,
+			"ec":  &ecKey.PublicKey,
+			"ed":  edPublic,
+		})
+	})
+
+	newAuthFunc := func(config JWTConfig) AuthFunc {
+		authFunc, err := NewJWTAuthFuncWithConfig(config)
+		Expect(err).ToNot(HaveOccurred())
+		return authFunc
+	}
+
+	It("should verify RSA, ECDSA and EdDSA signed tokens by kid", func() {
+		authFunc := newAuthFunc(JWTConfig{Keys: keys})
+
+		for _, t := range []struct {
+			method jwt.SigningMethod
+			kid    string
+			key    interface{}
+		}{
+			{jwt.SigningMethodRS256, "rsa", rsaKey},
+			{jwt.SigningMethodPS384, "rsa", rsaKey},
+			{jwt.SigningMethodES256, "ec", ecKey},
+			{SigningMethodEdDSA, "ed", edKey},
+		} {
+			token := signJWT(t.method, t.kid, t.key, jwt.MapClaims{"sub": "alice"})
+
+			resp := authFunc(context.Background(), "Bearer "+token)
+			Expect(resp.Err).To(BeNil(), t.method.Alg())
+			Expect(resp.Context.Value(CONTEXT_JWT)).To(Equal(token))
+		}
+	})
+
+	It("should reject tokens with an unknown kid", func() {
+		token := signJWT(jwt.SigningMethodRS256, "other", rsaKey, jwt.MapClaims{})
+
+		resp := newAuthFunc(JWTConfig{Keys: keys})(context.Background(), "Bearer "+token)
+		Expect(resp.Err).To(HaveOccurred())
+		Expect(resp.Err.Error()).To(ContainSubstring("unknown key"))
+	})
+
+	It("should use the only key for tokens without a kid", func() {
+		single := NewStaticKeySet(map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey})
+		token := signJWT(jwt.SigningMethodRS256, "", rsaKey, jwt.MapClaims{})
+
+		Expect(newAuthFunc(JWTConfig{Keys: single})(context.Background(), "Bearer "+token).Err).To(BeNil())
+		Expect(newAuthFunc(JWTConfig{Keys: keys})(context.Background(), "Bearer "+token).Err).To(HaveOccurred())
+	})
+
+	It("should reject keys of the wrong type for the algorithm", func() {
+		token := signJWT(jwt.SigningMethodES256, "rsa", ecKey, jwt.MapClaims{})
+
+		resp := newAuthFunc(JWTConfig{Keys: keys})(context.Background(), "Bearer "+token)
+		Expect(resp.Err).To(HaveOccurred())
+		Expect(resp.Err.Error()).To(ContainSubstring("can't verify ES256"))
+	})
+
+	It("should not accept a public key as an HMAC secret", func() {
+		der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+		Expect(err).ToNot(HaveOccurred())
+		token := signJWT(jwt.SigningMethodHS256, "rsa", der, jwt.MapClaims{})
+
+		resp := newAuthFunc(JWTConfig{Keys: keys})(context.Background(), "Bearer "+token)
+		Expect(resp.Err).To(HaveOccurred())
+		Expect(resp.Err.Error()).To(ContainSubstring("signing method"))
+	})
+
+	It("should accept both secrets and keys", func() {
+		authFunc := newAuthFunc(JWTConfig{Secret: "secret", Keys: keys})
+
+		Expect(authFunc(context.Background(), "Bearer "+signJWT(jwt.SigningMethodHS256, "", []byte("secret"), jwt.MapClaims{})).Err).To(BeNil())
+		Expect(authFunc(context.Background(), "Bearer "+signJWT(jwt.SigningMethodES256, "ec", ecKey, jwt.MapClaims{})).Err).To(BeNil())
+	})
+
+	It("should only accept the configured algorithms", func() {
+		authFunc := newAuthFunc(JWTConfig{Keys: keys, Algorithms: []string{"ES256"}})
+
+		Expect(authFunc(context.Background(), "Bearer "+signJWT(jwt.SigningMethodES256, "ec", ecKey, jwt.MapClaims{})).Err).To(BeNil())
+		Expect(authFunc(context.Background(), "Bearer "+signJWT(jwt.SigningMethodRS256, "rsa", rsaKey, jwt.MapClaims{})).Err).To(HaveOccurred())
+	})
+
+	It("should error on invalid configs", func() {
+		_, err := NewJWTAuthFuncWithConfig(JWTConfig{})
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewJWTAuthFuncWithConfig(JWTConfig{Keys: keys, Algorithms: []string{"none"}})
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewJWTAuthFuncWithConfig(JWTConfig{Keys: keys, Algorithms: []string{"XX256"}})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+// signJWT signs a token, setting its kid if there is one
+func signJWT(method jwt.SigningMethod, kid string, key interface{}, claims jwt.Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	Expect(err).ToNot(HaveOccurred())
+	return signed
+}
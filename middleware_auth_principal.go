@@ -0,0 +1,123 @@
+package rye
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Auth methods of a Principal
+	AUTH_METHOD_BASIC        = "basic"
+	AUTH_METHOD_JWT          = "jwt"
+	AUTH_METHOD_ACCESS_TOKEN = "access_token"
+)
+
+// principalKey is the context key of the Principal; being a type of its own,
+// it can't collide with the keys of other packages
+type principalKey struct{}
+
+/*
+Principal is who a request was authenticated as. Every authenticator here
+puts one into the context, whatever the credentials, so that the handlers
+that follow (ie. `RequireScopes`) need not care how the request was
+authenticated.
+*/
+type Principal struct {
+	// Subject identifies the user or client: the basic auth username, the
+	// JWT sub claim or the access token client ID. It is empty for access
+	// tokens given as a plain list, which don't identify a client.
+	Subject string
+
+	// AuthMethod is how the request was authenticated, ie. AUTH_METHOD_JWT.
+	AuthMethod string
+
+	// AuthMethodName is the Name of the composed AuthMethod which
+	// authenticated the request, see `NewAnyOfAuthFunc`.
+	AuthMethodName string
+
+	Scopes []string
+	Roles  []string
+
+	// Claims holds the JWT claims, for JWT auth.
+	Claims map[string]interface{}
+
+	// Expires is when the credentials expire, if they do.
+	Expires time.Time
+
+	// Details is the authenticator specific value: the BasicAuthUser
+	// principal for a user store, the *JWTClaims for JWT auth and the
+	// *AccessTokenClient for access tokens.
+	Details interface{}
+}
+
+/*
+PrincipalFromContext returns the Principal the request was authenticated as.
+
+	func handler(rw http.ResponseWriter, r *http.Request) *rye.Response {
+		if principal, ok := rye.PrincipalFromContext(r); ok {
+			log.Infof("request from %v, using %v", principal.Subject, principal.AuthMethod)
+		}
+		return nil
+	}
+*/
+func PrincipalFromContext(r *http.Request) (*Principal, bool) {
+	principal, ok := r.Context().Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+// ContextWithPrincipal returns a copy of ctx holding the principal, for
+// custom authenticators to put theirs into the context.
+func ContextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// HasScope checks if the principal was granted the scope
+func (p *Principal) HasScope(scope string) bool {
+	return containsAny(p.Scopes, []string{scope})
+}
+
+// HasRole checks if the principal has the role
+func (p *Principal) HasRole(role string) bool {
+	return containsAny(p.Roles, []string{role})
+}
+
+// newJWTPrincipal creates the principal of a verified JWT. Scopes are read
+// from the space separated scope claim, or from scp, and roles from the
+// rolesClaim.
+func newJWTPrincipal(claims *JWTClaims, rolesClaim string) *Principal {
+	scopes := claimStrings(claims.Claims["scope"])
+	if len(scopes) == 0 {
+		scopes = claimStrings(claims.Claims["scp"])
+	}
+
+	return &Principal{
+		Subject:    claims.Subject,
+		AuthMethod: AUTH_METHOD_JWT,
+		Scopes:     scopes,
+		Roles:      claimStrings(claims.Claims[rolesClaim]),
+		Claims:     claims.Claims,
+		Expires:    claims.ExpiresAt,
+		Details:    claims,
+	}
+}
+
+// claimStrings reads a claim holding either a list of strings, or a space
+// separated string
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var s []string
+		for _, e := range v {
+			if e, ok := e.(string); ok {
+				s = append(s, e)
+			}
+		}
+		return s
+	}
+
+	return nil
+}
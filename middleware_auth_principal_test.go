@@ -0,0 +1,126 @@
+package rye
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Principal", func() {
+	principalOf := func(resp *Response) *Principal {
+		Expect(resp).ToNot(BeNil())
+		Expect(resp.Err).To(BeNil())
+
+		principal, ok := PrincipalFromContext((&http.Request{}).WithContext(resp.Context))
+		Expect(ok).To(BeTrue())
+		return principal
+	}
+
+	It("should be set by basic auth", func() {
+		resp := NewBasicAuthFunc(map[string]string{"alice": "pass"})(context.Background(), "Basic "+base64Encode("alice:pass"))
+
+		Expect(principalOf(resp)).To(Equal(&Principal{Subject: "alice", AuthMethod: AUTH_METHOD_BASIC}))
+	})
+
+	It("should be set by hashed basic auth", func() {
+		authFunc, err := NewBasicAuthHashFunc(map[string]string{
+			// "Hello world!"
+			"alice": "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		resp := authFunc(context.Background(), "Basic "+base64Encode("alice:Hello world!"))
+		Expect(principalOf(resp)).To(Equal(&Principal{Subject: "alice", AuthMethod: AUTH_METHOD_BASIC}))
+	})
+
+	It("should be set by user stores", func() {
+		user := &BasicAuthUser{
+			PasswordHash: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+			Principal:    "user #1",
+			Scopes:       []string{"read"},
+			Roles:        []string{"admin"},
+		}
+		authFunc := NewBasicAuthStoreFunc(BasicAuthStoreConfig{
+			Store: BasicAuthUserStoreFunc(func(ctx context.Context, username string) (*BasicAuthUser, error) {
+				return user, nil
+			}),
+		})
+
+		resp := authFunc(context.Background(), "Basic "+base64Encode("alice:Hello world!"))
+		Expect(principalOf(resp)).To(Equal(&Principal{
+			Subject:    "alice",
+			AuthMethod: AUTH_METHOD_BASIC,
+			Scopes:     []string{"read"},
+			Roles:      []string{"admin"},
+			Details:    "user #1",
+		}))
+	})
+
+	It("should be set by JWT auth", func() {
+		exp := time.Now().Add(time.Hour).Truncate(time.Second)
+		token := signJWT(jwt.SigningMethodHS256, "", []byte("secret"), jwt.MapClaims{
+			"sub":   "alice",
+			"exp":   exp.Unix(),
+			"scope": "read write",
+			"roles": []string{"admin"},
+		})
+
+		principal := principalOf(NewJWTAuthFunc("secret")(context.Background(), "Bearer "+token))
+		Expect(principal.Subject).To(Equal("alice"))
+		Expect(principal.AuthMethod).To(Equal(AUTH_METHOD_JWT))
+		Expect(principal.Scopes).To(Equal([]string{"read", "write"}))
+		Expect(principal.Roles).To(Equal([]string{"admin"}))
+		Expect(principal.Expires).To(Equal(exp))
+		Expect(principal.Claims).To(HaveKeyWithValue("sub", "alice"))
+		Expect(principal.Details).To(BeAssignableToTypeOf(&JWTClaims{}))
+	})
+
+	It("should read JWT scopes from scp and roles from the configured claim", func() {
+		token := signJWT(jwt.SigningMethodHS256, "", []byte("secret"), jwt.MapClaims{
+			"scp":    []string{"read"},
+			"groups": "admin ops",
+		})
+
+		authFunc, err := NewJWTAuthFuncWithConfig(JWTConfig{Secret: "secret", RolesClaim: "groups"})
+		Expect(err).ToNot(HaveOccurred())
+
+		principal := principalOf(authFunc(context.Background(), "Bearer "+token))
+		Expect(principal.Scopes).To(Equal([]string{"read"}))
+		Expect(principal.Roles).To(Equal([]string{"admin", "ops"}))
+		Expect(principal.HasScope("read")).To(BeTrue())
+		Expect(principal.HasRole("ops")).To(BeTrue())
+		Expect(principal.HasRole("read")).To(BeFalse())
+	})
+
+	It("should be set by access token auth", func() {
+		client := AccessTokenClient{ID: "billing", Scopes: []string{"invoices:read"}}
+		mw, err := NewMiddlewareAccessTokenRegistry(AccessTokenConfig{
+			HeaderName: "X-Access-Token",
+			Tokens:     map[string]AccessTokenClient{"s3cr3t": client},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		request := &http.Request{Header: http.Header{"X-Access-Token": []string{"s3cr3t"}}}
+		principal := principalOf(mw(nil, request))
+		Expect(principal.Subject).To(Equal("billing"))
+		Expect(principal.AuthMethod).To(Equal(AUTH_METHOD_ACCESS_TOKEN))
+		Expect(principal.Scopes).To(Equal([]string{"invoices:read"}))
+		Expect(principal.Details).To(Equal(&client))
+	})
+
+	It("should be set, anonymous, by plain list access tokens", func() {
+		request := &http.Request{Header: http.Header{"X-Access-Token": []string{"s3cr3t"}}}
+		resp := NewMiddlewareAccessToken("X-Access-Token", []string{"s3cr3t"})(nil, request)
+
+		principal := principalOf(resp)
+		Expect(principal.Subject).To(BeEmpty())
+		Expect(principal.AuthMethod).To(Equal(AUTH_METHOD_ACCESS_TOKEN))
+
+		authorized := request.WithContext(resp.Context)
+		Expect(NewMiddlewareAuthz()(nil, authorized)).To(BeNil())
+	})
+})
@@ -1,11 +1,13 @@
 package rye
 
 import (
+	"encoding/base64"
 	"net/http"
 	"net/http/httptest"
 
 	"context"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -58,6 +60,69 @@ var _ = Describe("Auth Middleware", func() {
 		})
 	})
 
+	Context("auth with extractors", func() {
+		var (
+			fakeAuth *recorder
+		)
+
+		BeforeEach(func() {
+			fakeAuth = &recorder{}
+
+			testHandler = NewMiddlewareAuthWithExtractors(fakeAuth.authFunc,
+				CredentialExtractor{Location: TokenAuthScheme("Bearer")},
+				CredentialExtractor{Location: TokenCookie("session")},
+				CredentialExtractor{Location: TokenQuery("access_token"), Scheme: "Token"},
+			)
+			request = httptest.NewRequest("GET", "/ws?access_token=qtoken&room=1", nil)
+		})
+
+		It("passes the first credentials found to the auth func", func() {
+			request.Header.Add(AUTH_HEADER_NAME, "bearer htoken")
+			request.AddCookie(&http.Cookie{Name: "session", Value: "ctoken"})
+
+			Expect(testHandler(response, request)).To(BeNil())
+			Expect(fakeAuth.header).To(Equal("Bearer htoken"))
+		})
+
+		It("reads credentials from cookies", func() {
+			request.AddCookie(&http.Cookie{Name: "session", Value: "ctoken"})
+
+			Expect(testHandler(response, request)).To(BeNil())
+			Expect(fakeAuth.header).To(Equal("Bearer ctoken"))
+		})
+
+		It("reads credentials from the query, without modifying the request", func() {
+			uri := request.RequestURI
+
+			Expect(testHandler(response, request)).To(BeNil())
+			Expect(fakeAuth.header).To(Equal("Token qtoken"))
+			Expect(request.RequestURI).To(Equal(uri))
+			Expect(request.URL.Query().Get("access_token")).To(Equal("qtoken"))
+		})
+
+		It("ignores other auth schemes", func() {
+			request = httptest.NewRequest("GET", "/ws", nil)
+			request.Header.Add(AUTH_HEADER_NAME, "Basic Zm9vOmJhcg==")
+			resp := testHandler(response, request)
+
+			Expect(resp).ToNot(BeNil())
+			Expect(resp.Err.Error()).To(ContainSubstring("no authentication"))
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("works with JWT auth", func() {
+			token := signJWT(jwt.SigningMethodHS256, "", []byte("secret"), jwt.MapClaims{"sub": "alice"})
+			request = httptest.NewRequest("GET", "/ws", nil)
+			request.AddCookie(&http.Cookie{Name: "session", Value: token})
+
+			resp := NewMiddlewareAuthWithExtractors(NewJWTAuthFunc("secret"),
+				CredentialExtractor{Location: TokenCookie("session")},
+			)(response, request)
+			Expect(resp.Err).To(BeNil())
+			Expect(resp.Context.Value(CONTEXT_JWT)).To(Equal(token))
+		})
+	})
+
 	Context("Basic Auth", func() {
 		var (
 			username = "user1"
@@ -139,8 +204,56 @@ var _ = Describe("Auth Middleware", func() {
 			})
 		})
 	})
+
+	Context("Hashed Basic Auth", func() {
+		BeforeEach(func() {
+			authFunc, err := NewBasicAuthHashFunc(map[string]string{
+				// "Hello world!"
+				"alice": "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			testHandler = NewMiddlewareAuth(authFunc)
+			request = &http.Request{
+				Header: map[string][]string{},
+			}
+		})
+
+		It("validates the password", func() {
+			request.SetBasicAuth("alice", "Hello world!")
+			resp := testHandler(response, request)
+
+			Expect(resp.Err).To(BeNil())
+			Expect(resp.Context.Value(AUTH_USERNAME_KEY)).To(Equal("alice"))
+		})
+
+		It("errors if password wrong", func() {
+			request.SetBasicAuth("alice", "wrong")
+			resp := testHandler(response, request)
+
+			Expect(resp.Err).ToNot(BeNil())
+			Expect(resp.Err.Error()).To(ContainSubstring("invalid auth"))
+		})
+
+		It("errors if username unknown, even with a known password", func() {
+			request.SetBasicAuth("noname", "Hello world!")
+			resp := testHandler(response, request)
+
+			Expect(resp.Err).ToNot(BeNil())
+			Expect(resp.Err.Error()).To(ContainSubstring("invalid auth"))
+		})
+
+		It("errors on unsupported hashes", func() {
+			_, err := NewBasicAuthHashFunc(map[string]string{"alice": "plaintext"})
+			Expect(err).To(MatchError("user alice: unsupported hash: plaintext"))
+		})
+	})
 })
 
+func base64Encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
 type recorder struct {
 	header string
 }
@@ -0,0 +1,261 @@
+package rye
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Basic auth user store specific constants
+	DEFAULT_BASIC_AUTH_CACHE_SIZE = 1000
+)
+
+// BasicAuthUser is a user as found by a BasicAuthUserStore.
+type BasicAuthUser struct {
+	// PasswordHash is checked against the password; see
+	// `NewBasicAuthHashFunc` for the supported formats.
+	PasswordHash string
+
+	// Principal is whatever represents the user to the application, and is
+	// put into the context once authenticated.
+	Principal interface{}
+
+	// Scopes and Roles are those of the user's `rye.Principal`.
+	Scopes []string
+	Roles  []string
+}
+
+// BasicAuthUserStore looks up users for Basic auth, ie. from a database. It
+// returns a nil user, and no error, if the user does not exist.
+type BasicAuthUserStore interface {
+	LookupUser(ctx context.Context, username string) (*BasicAuthUser, error)
+}
+
+// BasicAuthUserStoreFunc adapts a func to a BasicAuthUserStore.
+type BasicAuthUserStoreFunc func(ctx context.Context, username string) (*BasicAuthUser, error)
+
+// LookupUser calls f
+func (f BasicAuthUserStoreFunc) LookupUser(ctx context.Context, username string) (*BasicAuthUser, error) {
+	return f(ctx, username)
+}
+
+// BasicAuthStoreConfig is used to configure a user store backed Basic auth.
+type BasicAuthStoreConfig struct {
+	Store BasicAuthUserStore
+
+	// CacheTTL, if set, caches the users looked up (and those not found)
+	// for that long, so that the store isn't hit on every request.
+	CacheTTL time.Duration
+
+	// CacheSize is the maximum number of users cached; defaults to
+	// DEFAULT_BASIC_AUTH_CACHE_SIZE.
+	CacheSize int
+}
+
+type basicAuthStore struct {
+	config BasicAuthStoreConfig
+
+	mu    sync.Mutex
+	cache map[string]*cachedUser
+
+	// now is swapped in tests
+	now func() time.Time
+}
+
+// cachedUser is a looked up user with its parsed hash; verify is nil if the
+// user does not exist
+type cachedUser struct {
+	user    *BasicAuthUser
+	verify  func(password []byte) bool
+	expires time.Time
+}
+
+var (
+	dummyVerifier     func(password []byte) bool
+	dummyVerifierOnce sync.Once
+)
+
+/*
+NewBasicAuthStoreFunc creates an AuthFunc for Basic auth which looks users up
+in a store. Once authenticated, the user's principal is put into the context,
+and can be read with `rye.BasicAuthPrincipal(r)`; the username is still put
+under AUTH_USERNAME_KEY too.
+
+Unknown users are checked against a dummy bcrypt hash, so they take about as
+long to fail as a wrong password does.
+
+Example usage:
+
+	authFunc := rye.NewBasicAuthStoreFunc(rye.BasicAuthStoreConfig{
+		Store: rye.BasicAuthUserStoreFunc(func(ctx context.Context, username string) (*rye.BasicAuthUser, error) {
+			u, err := db.FindUser(ctx, username)
+			if err != nil || u == nil {
+				return nil, err
+			}
+			return &rye.BasicAuthUser{PasswordHash: u.PasswordHash, Principal: u}, nil
+		}),
+		CacheTTL: time.Minute,
+	})
+
+	routes.Handle("/some/route", myMWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareAuthWithChallenge(authFunc, rye.BasicChallenge("admin", "UTF-8")),
+			yourHandler,
+		})).Methods("GET")
+*/
+func NewBasicAuthStoreFunc(config BasicAuthStoreConfig) AuthFunc {
+	return newBasicAuthStore(config).authenticate
+}
+
+func newBasicAuthStore(config BasicAuthStoreConfig) *basicAuthStore {
+	if config.CacheSize <= 0 {
+		config.CacheSize = DEFAULT_BASIC_AUTH_CACHE_SIZE
+	}
+
+	return &basicAuthStore{
+		config: config,
+		cache:  make(map[string]*cachedUser),
+		now:    time.Now,
+	}
+}
+
+/*
+BasicAuthPrincipal returns the principal of the user authenticated by
+`NewBasicAuthStoreFunc`, which is the `Details` of the request's Principal.
+It returns false for requests authenticated any other way, so that with
+composed auth the `Details` of ie. a JWT are never taken for a user.
+
+	func handler(rw http.ResponseWriter, r *http.Request) *rye.Response {
+		if user, ok := rye.BasicAuthPrincipal(r); ok {
+			log.Infof("request from %v", user.(*User).Email)
+		}
+		return nil
+	}
+*/
+func BasicAuthPrincipal(r *http.Request) (interface{}, bool) {
+	principal, ok := PrincipalFromContext(r)
+	if !ok || principal.AuthMethod != AUTH_METHOD_BASIC || principal.Details == nil {
+		return nil, false
+	}
+
+	return principal.Details, true
+}
+
+// basicAuthStore.authenticate meets the AuthFunc type
+func (s *basicAuthStore) authenticate(ctx context.Context, auth string) *Response {
+	errResp := &Response{
+		Err:        errInvalidAuth,
+		StatusCode: http.StatusUnauthorized,
+	}
+
+	u, p, ok := parseBasicAuth(auth)
+	if !ok {
+		return errResp
+	}
+
+	cached, err := s.lookup(ctx, u)
+	if err != nil {
+		log.Errorf("Unable to look up user %v: %v", u, err)
+
+		return &Response{
+			Err:        errors.New("unable to verify authentication"),
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	verify := cached.verify
+	if verify == nil {
+		verify = getDummyVerifier()
+	}
+
+	if !verify([]byte(p)) || cached.verify == nil {
+		return errResp
+	}
+
+	return &Response{
+		Context: basicAuthContext(ctx, u, &Principal{
+			Subject:    u,
+			AuthMethod: AUTH_METHOD_BASIC,
+			Scopes:     cached.user.Scopes,
+			Roles:      cached.user.Roles,
+			Details:    cached.user.Principal,
+		}),
+	}
+}
+
+// lookup finds a user in the cache, or else in the store
+func (s *basicAuthStore) lookup(ctx context.Context, username string) (*cachedUser, error) {
+	now := s.now()
+
+	if s.config.CacheTTL > 0 {
+		s.mu.Lock()
+		cached, ok := s.cache[username]
+		s.mu.Unlock()
+
+		if ok && now.Before(cached.expires) {
+			return cached, nil
+		}
+	}
+
+	user, err := s.config.Store.LookupUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := &cachedUser{user: user, expires: now.Add(s.config.CacheTTL)}
+
+	if user != nil {
+		if cached.verify, err = newHashVerifier(user.PasswordHash); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.config.CacheTTL > 0 {
+		s.store(username, cached, now)
+	}
+
+	return cached, nil
+}
+
+// store caches a user, making room by dropping expired users first
+func (s *basicAuthStore) store(username string, cached *cachedUser, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.cache) >= s.config.CacheSize {
+		for name, c := range s.cache {
+			if !now.Before(c.expires) {
+				delete(s.cache, name)
+			}
+		}
+	}
+
+	// Still full; the user is simply looked up again next time
+	if len(s.cache) >= s.config.CacheSize {
+		return
+	}
+
+	s.cache[username] = cached
+}
+
+// getDummyVerifier returns a verifier of a bcrypt hash at the default cost,
+// generated on first use
+func getDummyVerifier() func(password []byte) bool {
+	dummyVerifierOnce.Do(func() {
+		secret, err := randomToken()
+		if err != nil {
+			secret = "rye-dummy-password"
+		}
+
+		hash, _ := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		dummyVerifier, _ = newHashVerifier(string(hash))
+	})
+
+	return dummyVerifier
+}
@@ -0,0 +1,168 @@
+package rye
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type testUser struct {
+	Name string
+}
+
+var _ = Describe("Basic Auth User Store", func() {
+
+	var (
+		config   BasicAuthStoreConfig
+		lookups  int
+		storeErr error
+	)
+
+	basic := func(user, pass string) string {
+		return "Basic " + base64Encode(user+":"+pass)
+	}
+
+	BeforeEach(func() {
+		lookups = 0
+		storeErr = nil
+
+		config = BasicAuthStoreConfig{
+			Store: BasicAuthUserStoreFunc(func(ctx context.Context, username string) (*BasicAuthUser, error) {
+				lookups++
+
+				if storeErr != nil {
+					return nil, storeErr
+				}
+
+				if username != "alice" {
+					return nil, nil
+				}
+
+				return &BasicAuthUser{
+					// "Hello world!"
+					PasswordHash: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+					Principal:    &testUser{Name: "Alice"},
+				}, nil
+			}),
+		}
+	})
+
+	It("should put the principal into the context", func() {
+		resp := NewBasicAuthStoreFunc(config)(context.Background(), basic("alice", "Hello world!"))
+		Expect(resp.Err).To(BeNil())
+		Expect(resp.Context.Value(AUTH_USERNAME_KEY)).To(Equal("alice"))
+
+		request := (&http.Request{}).WithContext(resp.Context)
+		principal, ok := BasicAuthPrincipal(request)
+		Expect(ok).To(BeTrue())
+		Expect(principal).To(Equal(&testUser{Name: "Alice"}))
+	})
+
+	It("should only return the principal of user store users", func() {
+		token := signJWT(jwt.SigningMethodHS256, "", []byte("secret"), jwt.MapClaims{"sub": "bob"})
+		authFunc := NewAnyOfAuthFunc(
+			AuthMethod{Name: "jwt", Scheme: "Bearer", AuthFunc: NewJWTAuthFunc("secret")},
+			AuthMethod{Name: "users", Scheme: "Basic", AuthFunc: NewBasicAuthStoreFunc(config)},
+		)
+
+		resp := authFunc(context.Background(), "Bearer "+token)
+		Expect(resp.Err).To(BeNil())
+		_, ok := BasicAuthPrincipal((&http.Request{}).WithContext(resp.Context))
+		Expect(ok).To(BeFalse())
+
+		resp = authFunc(context.Background(), basic("alice", "Hello world!"))
+		Expect(resp.Err).To(BeNil())
+		principal, ok := BasicAuthPrincipal((&http.Request{}).WithContext(resp.Context))
+		Expect(ok).To(BeTrue())
+		Expect(principal.(*testUser).Name).To(Equal("Alice"))
+	})
+
+	It("should reject wrong passwords and unknown users", func() {
+		authFunc := NewBasicAuthStoreFunc(config)
+
+		resp := authFunc(context.Background(), basic("alice", "nope"))
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		resp = authFunc(context.Background(), basic("bob", "Hello world!"))
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(resp.Error()).To(ContainSubstring("invalid authentication"))
+	})
+
+	It("should fail when the store fails", func() {
+		storeErr = errors.New("db down")
+		resp := NewBasicAuthStoreFunc(config)(context.Background(), basic("alice", "Hello world!"))
+		Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+		Expect(resp.Error()).ToNot(ContainSubstring("db down"))
+	})
+
+	It("should not cache without a TTL", func() {
+		authFunc := NewBasicAuthStoreFunc(config)
+		authFunc(context.Background(), basic("alice", "Hello world!"))
+		authFunc(context.Background(), basic("alice", "Hello world!"))
+		Expect(lookups).To(Equal(2))
+	})
+
+	Context("when caching", func() {
+		var (
+			store *basicAuthStore
+			now   time.Time
+		)
+
+		BeforeEach(func() {
+			config.CacheTTL = time.Minute
+			config.CacheSize = 2
+
+			now = time.Now()
+			store = newBasicAuthStore(config)
+			store.now = func() time.Time { return now }
+		})
+
+		It("should cache found and missing users until the TTL", func() {
+			store.authenticate(context.Background(), basic("alice", "Hello world!"))
+			store.authenticate(context.Background(), basic("alice", "nope"))
+			store.authenticate(context.Background(), basic("bob", "x"))
+			store.authenticate(context.Background(), basic("bob", "x"))
+			Expect(lookups).To(Equal(2))
+
+			now = now.Add(time.Minute)
+			store.authenticate(context.Background(), basic("alice", "Hello world!"))
+			Expect(lookups).To(Equal(3))
+		})
+
+		It("should not grow past the cache size", func() {
+			for _, u := range []string{"a", "b", "c", "c"} {
+				store.authenticate(context.Background(), basic(u, "x"))
+			}
+			Expect(store.cache).To(HaveLen(2))
+			Expect(lookups).To(Equal(4))
+		})
+	})
+
+	Describe("NewMiddlewareAuthWithChallenge", func() {
+		It("should challenge unauthorized requests", func() {
+			handler := NewMiddlewareAuthWithChallenge(NewBasicAuthStoreFunc(config), BasicChallenge(`My "App"`, "UTF-8"))
+
+			response := httptest.NewRecorder()
+			request := httptest.NewRequest("GET", "/", nil)
+			resp := handler(response, request)
+
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			Expect(response.Header().Get("WWW-Authenticate")).To(Equal(`Basic realm="My \"App\"", charset="UTF-8"`))
+
+			response = httptest.NewRecorder()
+			request.SetBasicAuth("alice", "Hello world!")
+			Expect(handler(response, request).Err).To(BeNil())
+			Expect(response.Header().Get("WWW-Authenticate")).To(BeEmpty())
+		})
+
+		It("should leave out an empty charset", func() {
+			Expect(BasicChallenge("admin", "")).To(Equal(`Basic realm="admin"`))
+		})
+	})
+})
@@ -0,0 +1,125 @@
+package rye
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AuthzPolicy decides whether the principal may make the request, returning
+// the reason if it may not.
+type AuthzPolicy func(r *http.Request, principal *Principal) error
+
+/*
+NewMiddlewareAuthz creates a new middleware authorizing requests against the
+Principal put into the context by the auth middlewares, so it goes after
+them. Every policy must allow the request, otherwise a 403 is returned with
+the reason; a request without a principal gets a 401.
+
+Policies for scopes and roles are provided, and custom ones, ie. for resource
+ownership, are plain funcs.
+
+Example usage:
+
+	ownsAccount := func(r *http.Request, principal *rye.Principal) error {
+		if mux.Vars(r)["account"] != principal.Subject {
+			return errors.New("forbidden: not your account")
+		}
+		return nil
+	}
+
+	routes.Handle("/accounts/{account}", myMWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareAuth(authFunc),
+			rye.NewMiddlewareAuthz(rye.RequireScopes("accounts:read"), ownsAccount),
+			yourHandler,
+		})).Methods("GET")
+*/
+func NewMiddlewareAuthz(policies ...AuthzPolicy) func(rw http.ResponseWriter, req *http.Request) *Response {
+	return func(rw http.ResponseWriter, r *http.Request) *Response {
+		principal, ok := PrincipalFromContext(r)
+		if !ok {
+			return &Response{
+				Err:        errors.New("unauthorized: no authenticated principal"),
+				StatusCode: http.StatusUnauthorized,
+			}
+		}
+
+		for _, policy := range policies {
+			if err := policy(r, principal); err != nil {
+				return &Response{
+					Err:        err,
+					StatusCode: http.StatusForbidden,
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// NewMiddlewareRequireScopes creates a new middleware which requires all of
+// the scopes, see `NewMiddlewareAuthz`.
+func NewMiddlewareRequireScopes(scopes ...string) func(rw http.ResponseWriter, req *http.Request) *Response {
+	return NewMiddlewareAuthz(RequireScopes(scopes...))
+}
+
+// NewMiddlewareRequireRoles creates a new middleware which requires all of
+// the roles, see `NewMiddlewareAuthz`.
+func NewMiddlewareRequireRoles(roles ...string) func(rw http.ResponseWriter, req *http.Request) *Response {
+	return NewMiddlewareAuthz(RequireRoles(roles...))
+}
+
+// RequireScopes is a policy requiring all of the scopes.
+func RequireScopes(scopes ...string) AuthzPolicy {
+	return func(r *http.Request, principal *Principal) error {
+		return requireAll("scopes", principal.Scopes, scopes)
+	}
+}
+
+// RequireAnyScope is a policy requiring one of the scopes.
+func RequireAnyScope(scopes ...string) AuthzPolicy {
+	return func(r *http.Request, principal *Principal) error {
+		return requireAny("scopes", principal.Scopes, scopes)
+	}
+}
+
+// RequireRoles is a policy requiring all of the roles.
+func RequireRoles(roles ...string) AuthzPolicy {
+	return func(r *http.Request, principal *Principal) error {
+		return requireAll("roles", principal.Roles, roles)
+	}
+}
+
+// RequireAnyRole is a policy requiring one of the roles.
+func RequireAnyRole(roles ...string) AuthzPolicy {
+	return func(r *http.Request, principal *Principal) error {
+		return requireAny("roles", principal.Roles, roles)
+	}
+}
+
+// requireAll lists what is missing of want
+func requireAll(kind string, have, want []string) error {
+	var missing []string
+	for _, w := range want {
+		if !containsAny(have, []string{w}) {
+			missing = append(missing, w)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("forbidden: missing %v: %v", kind, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// requireAny checks that one of want is there
+func requireAny(kind string, have, want []string) error {
+	if len(want) == 0 || containsAny(have, want) {
+		return nil
+	}
+
+	return fmt.Errorf("forbidden: requires one of the %v: %v", kind, strings.Join(want, ", "))
+}
@@ -0,0 +1,77 @@
+package rye
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Authz Middleware", func() {
+	var (
+		request  *http.Request
+		response *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		response = httptest.NewRecorder()
+		request = httptest.NewRequest("GET", "/accounts/alice", nil)
+		request = request.WithContext(ContextWithPrincipal(context.Background(), &Principal{
+			Subject: "alice",
+			Scopes:  []string{"read", "write"},
+			Roles:   []string{"ops"},
+		}))
+	})
+
+	It("should allow principals with all the scopes", func() {
+		Expect(NewMiddlewareRequireScopes("read", "write")(response, request)).To(BeNil())
+	})
+
+	It("should forbid principals missing scopes", func() {
+		resp := NewMiddlewareRequireScopes("read", "admin", "delete")(response, request)
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		Expect(resp.Err.Error()).To(Equal("forbidden: missing scopes: admin, delete"))
+	})
+
+	It("should check roles", func() {
+		Expect(NewMiddlewareRequireRoles("ops")(response, request)).To(BeNil())
+
+		resp := NewMiddlewareRequireRoles("ops", "admin")(response, request)
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		Expect(resp.Err.Error()).To(Equal("forbidden: missing roles: admin"))
+	})
+
+	It("should check for any of the scopes or roles", func() {
+		Expect(NewMiddlewareAuthz(RequireAnyScope("admin", "write"))(response, request)).To(BeNil())
+		Expect(NewMiddlewareAuthz(RequireAnyRole("admin", "ops"))(response, request)).To(BeNil())
+
+		resp := NewMiddlewareAuthz(RequireAnyRole("admin", "billing"))(response, request)
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		Expect(resp.Err.Error()).To(Equal("forbidden: requires one of the roles: admin, billing"))
+	})
+
+	It("should apply every policy", func() {
+		owner := func(r *http.Request, principal *Principal) error {
+			if r.URL.Path != "/accounts/"+principal.Subject {
+				return errors.New("forbidden: not your account")
+			}
+			return nil
+		}
+
+		mw := NewMiddlewareAuthz(RequireScopes("read"), owner)
+		Expect(mw(response, request)).To(BeNil())
+
+		other := httptest.NewRequest("GET", "/accounts/bob", nil).WithContext(request.Context())
+		resp := mw(response, other)
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		Expect(resp.Err.Error()).To(Equal("forbidden: not your account"))
+	})
+
+	It("should reject unauthenticated requests", func() {
+		resp := NewMiddlewareRequireScopes("read")(response, httptest.NewRequest("GET", "/", nil))
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+})
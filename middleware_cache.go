@@ -0,0 +1,521 @@
+package rye
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Cache specific constants
+	DEFAULT_CACHE_MAX_ENTRIES   = 1000
+	DEFAULT_CACHE_MAX_BODY_SIZE = 1 << 20
+)
+
+// CachedResponse is a complete response as kept by a CacheStore.
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// Stored is when the response was stored, Expires is when it becomes
+	// stale and StaleUntil is when it can no longer be served at all.
+	Stored     time.Time
+	Expires    time.Time
+	StaleUntil time.Time
+
+	// Vary is only set on the entry kept under the key without any header
+	// values, and lists the request headers the responses for it vary on.
+	Vary []string
+}
+
+// CacheStore is the storage used by the cache middleware. Implementations
+// must be safe for concurrent use.
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, resp *CachedResponse)
+	Delete(key string)
+}
+
+// CacheConfig is used to configure the cache middleware.
+type CacheConfig struct {
+	// Store holds the cached responses; defaults to an in-memory LRU store
+	// of DEFAULT_CACHE_MAX_ENTRIES entries.
+	Store CacheStore
+
+	// TTL is used for responses that carry no max-age or s-maxage directive.
+	// If zero, such responses are not cached.
+	TTL time.Duration
+
+	// StaleWhileRevalidate is used for responses that carry no
+	// stale-while-revalidate directive.
+	StaleWhileRevalidate time.Duration
+
+	// QueryParams selects the query parameters that are part of the cache
+	// key. If nil, the whole query string is used.
+	QueryParams []string
+
+	// VaryHeaders are request headers that are always part of the cache key,
+	// in addition to any listed in the response's Vary header.
+	VaryHeaders []string
+
+	// MaxBodySize is the largest body, in bytes, that will be cached;
+	// defaults to DEFAULT_CACHE_MAX_BODY_SIZE.
+	MaxBodySize int
+}
+
+type cache struct {
+	config CacheConfig
+
+	// revalidating tracks the keys currently being refreshed
+	revalidating sync.Map
+}
+
+/*
+NewMiddlewareCache creates a new handler which caches full responses of the
+rest of the chain. A cache hit is written straight from the store and stops
+execution, so the expensive handlers further down the chain are not run.
+
+Responses are keyed by method, path, the selected query parameters and the
+request headers named in the response's `Vary` header (plus any configured
+`VaryHeaders`). Only `200 OK` responses to GET and HEAD requests are cached.
+
+The TTL is taken from the response's `s-maxage` or `max-age` directive,
+falling back to the configured `TTL`. Responses marked `no-store`, `no-cache`
+or `private`, responses setting cookies and requests carrying an
+`Authorization` header are never cached.
+
+Once an entry has expired it may still be served for the
+`stale-while-revalidate` period. In that case the stale response is sent in
+full, with its `Content-Length`, and flushed so that the client is done with
+it straight away; the rest of the chain is then run into a discarded writer to
+refresh the entry, while concurrent requests keep getting the stale copy. A
+middleware re-encoding the body ahead of the cache, ie. compression, holds the
+response until the chain has finished, so it should come after the cache.
+
+Example use case:
+
+	routes.Handle("/some/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareCache(rye.CacheConfig{
+				Store:                rye.NewMemoryCacheStore(500),
+				TTL:                  time.Minute,
+				StaleWhileRevalidate: 10 * time.Second,
+				QueryParams:          []string{"page", "sort"},
+			}),
+			yourExpensiveHandler,
+		})).Methods("GET")
+*/
+func NewMiddlewareCache(config CacheConfig) func(rw http.ResponseWriter, req *http.Request) *Response {
+	if config.Store == nil {
+		config.Store = NewMemoryCacheStore(DEFAULT_CACHE_MAX_ENTRIES)
+	}
+
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = DEFAULT_CACHE_MAX_BODY_SIZE
+	}
+
+	c := &cache{config: config}
+	return c.handle
+}
+
+func (c *cache) handle(rw http.ResponseWriter, req *http.Request) *Response {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil
+	}
+
+	if req.Header.Get("Authorization") != "" {
+		return nil
+	}
+
+	reqCC := parseCacheControl(req.Header.Get("Cache-Control"))
+	if _, ok := reqCC["no-store"]; ok {
+		return nil
+	}
+
+	base := c.baseKey(req)
+	key := c.key(base, req)
+
+	if _, noCache := reqCC["no-cache"]; !noCache {
+		if cached, ok := c.config.Store.Get(key); ok && len(cached.Vary) == 0 {
+			now := time.Now()
+
+			if now.Before(cached.Expires) {
+				writeCachedResponse(rw, req, cached, now)
+				return &Response{StopExecution: true}
+			}
+
+			if now.Before(cached.StaleUntil) {
+				writeCachedResponse(rw, req, cached, now)
+
+				// Let a single request refresh the entry, everyone
+				// else just gets the stale copy
+				if _, busy := c.revalidating.LoadOrStore(key, true); busy {
+					return &Response{StopExecution: true}
+				}
+
+				if f, ok := rw.(http.Flusher); ok {
+					f.Flush()
+				}
+
+				return &Response{
+					ResponseWriter: &cacheWriter{
+						ResponseWriter: &discardWriter{header: make(http.Header)},
+						cache:          c,
+						base:           base,
+						req:            req,
+						statusCode:     http.StatusOK,
+						revalidateKey:  key,
+					},
+				}
+			}
+
+			c.config.Store.Delete(key)
+		}
+	}
+
+	return &Response{
+		ResponseWriter: &cacheWriter{
+			ResponseWriter: rw,
+			cache:          c,
+			base:           base,
+			req:            req,
+			statusCode:     http.StatusOK,
+		},
+	}
+}
+
+// baseKey is built from the method, path and selected query parameters
+func (c *cache) baseKey(req *http.Request) string {
+	query := req.URL.Query()
+
+	if c.config.QueryParams != nil {
+		selected := make(url.Values)
+		for _, name := range c.config.QueryParams {
+			if v, ok := query[name]; ok {
+				selected[name] = v
+			}
+		}
+		query = selected
+	}
+
+	// Encode sorts by key
+	return req.Method + " " + req.URL.Path + "?" + query.Encode()
+}
+
+// key adds the values of the varying request headers to the base key. The
+// header names a response varies on are kept in the store under the base key,
+// so that they are evicted along with the responses.
+func (c *cache) key(base string, req *http.Request) string {
+	names := append([]string{}, c.config.VaryHeaders...)
+	if marker, ok := c.config.Store.Get(base); ok && len(marker.Vary) > 0 {
+		names = append(names, marker.Vary...)
+	}
+
+	if len(names) == 0 {
+		return base
+	}
+
+	for i := range names {
+		names[i] = http.CanonicalHeaderKey(names[i])
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(base)
+
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+
+		b.WriteString("\n" + name + ": " + strings.Join(req.Header[name], ", "))
+	}
+
+	return b.String()
+}
+
+// store saves a finished response if it is cacheable
+func (c *cache) store(base string, req *http.Request, statusCode int, header http.Header, body []byte) {
+	if statusCode != http.StatusOK || header.Get("Set-Cookie") != "" {
+		return
+	}
+
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[directive]; ok {
+			return
+		}
+	}
+
+	ttl := c.config.TTL
+	if v, ok := cc["s-maxage"]; ok {
+		ttl = parseSeconds(v)
+	} else if v, ok := cc["max-age"]; ok {
+		ttl = parseSeconds(v)
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	swr := c.config.StaleWhileRevalidate
+	if v, ok := cc["stale-while-revalidate"]; ok {
+		swr = parseSeconds(v)
+	}
+
+	var vary []string
+	for _, v := range header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				vary = append(vary, name)
+			}
+		}
+	}
+
+	now := time.Now()
+
+	// Without any varying headers the response itself goes under the base
+	// key, replacing any stale marker
+	if len(vary) > 0 {
+		c.config.Store.Set(base, &CachedResponse{
+			Stored:     now,
+			Expires:    now.Add(ttl),
+			StaleUntil: now.Add(ttl + swr),
+			Vary:       vary,
+		})
+	} else if len(c.config.VaryHeaders) > 0 {
+		c.config.Store.Delete(base)
+	}
+
+	c.config.Store.Set(c.key(base, req), &CachedResponse{
+		StatusCode: statusCode,
+		Header:     header,
+		Body:       append([]byte{}, body...),
+		Stored:     now,
+		Expires:    now.Add(ttl),
+		StaleUntil: now.Add(ttl + swr),
+	})
+}
+
+func writeCachedResponse(rw http.ResponseWriter, req *http.Request, cached *CachedResponse, now time.Time) {
+	h := rw.Header()
+	for k, v := range cached.Header {
+		h[k] = append([]string{}, v...)
+	}
+
+	h.Set("Age", strconv.Itoa(int(now.Sub(cached.Stored).Seconds())))
+
+	// A HEAD response stored without its body can't tell its length
+	if _, ok := h["Content-Length"]; !ok && (len(cached.Body) > 0 || req.Method != http.MethodHead) {
+		h.Set("Content-Length", strconv.Itoa(len(cached.Body)))
+	}
+
+	rw.WriteHeader(cached.StatusCode)
+	rw.Write(cached.Body)
+}
+
+// cacheWriter records the response as it is written. For a revalidation the
+// client has already been answered, so it writes into a discardWriter.
+type cacheWriter struct {
+	http.ResponseWriter
+
+	cache         *cache
+	base          string
+	req           *http.Request
+	statusCode    int
+	revalidateKey string
+
+	headerCalled bool
+	uncacheable  bool
+	snapshot     http.Header
+	buf          bytes.Buffer
+}
+
+func (cw *cacheWriter) WriteHeader(statusCode int) {
+	if cw.headerCalled {
+		return
+	}
+
+	cw.headerCalled = true
+	cw.statusCode = statusCode
+
+	// Take the headers as the handler wrote them, before any encoding
+	// further up the chain gets a chance to alter them
+	cw.snapshot = cw.Header().Clone()
+
+	cw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if !cw.headerCalled {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.uncacheable {
+		if cw.buf.Len()+len(p) > cw.cache.config.MaxBodySize {
+			cw.uncacheable = true
+			cw.buf.Reset()
+		} else {
+			cw.buf.Write(p)
+		}
+	}
+
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush marks the response as streamed, which is never cached
+func (cw *cacheWriter) Flush() {
+	cw.uncacheable = true
+	cw.buf.Reset()
+
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Close is called by rye once the chain has finished
+func (cw *cacheWriter) Close() error {
+	if cw.revalidateKey != "" {
+		defer cw.cache.revalidating.Delete(cw.revalidateKey)
+	}
+
+	if cw.uncacheable || !cw.headerCalled {
+		return nil
+	}
+
+	cw.cache.store(cw.base, cw.req, cw.statusCode, cw.snapshot, cw.buf.Bytes())
+	return nil
+}
+
+// discardWriter takes the response of a revalidation
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) WriteHeader(statusCode int) {}
+
+func (d *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// parseCacheControl splits a Cache-Control header into its directives
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, value := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, value = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+
+		directives[strings.ToLower(name)] = value
+	}
+
+	return directives
+}
+
+func parseSeconds(v string) time.Duration {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0
+	}
+
+	return time.Duration(n) * time.Second
+}
+
+/*******************
+ In-memory LRU store
+*******************/
+
+type memoryCacheStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	entries    map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key  string
+	resp *CachedResponse
+}
+
+// NewMemoryCacheStore creates an in-memory CacheStore which evicts the least
+// recently used entry once it holds maxEntries responses.
+func NewMemoryCacheStore(maxEntries int) CacheStore {
+	if maxEntries <= 0 {
+		maxEntries = DEFAULT_CACHE_MAX_ENTRIES
+	}
+
+	return &memoryCacheStore{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryCacheStore) Get(key string) (*CachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	m.ll.MoveToFront(el)
+	return el.Value.(*memoryCacheEntry).resp, true
+}
+
+func (m *memoryCacheStore) Set(key string, resp *CachedResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.ll.MoveToFront(el)
+		el.Value.(*memoryCacheEntry).resp = resp
+		return
+	}
+
+	m.entries[key] = m.ll.PushFront(&memoryCacheEntry{key: key, resp: resp})
+
+	if m.ll.Len() > m.maxEntries {
+		oldest := m.ll.Back()
+		m.ll.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+}
+
+func (m *memoryCacheStore) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.ll.Remove(el)
+		delete(m.entries, key)
+	}
+}
@@ -0,0 +1,259 @@
+package rye
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache Middleware", func() {
+
+	var (
+		request  *http.Request
+		response *httptest.ResponseRecorder
+		calls    int
+		cacheMW  Handler
+	)
+
+	countingHandler := func(cacheControl string) Handler {
+		return func(rw http.ResponseWriter, r *http.Request) *Response {
+			calls++
+			if cacheControl != "" {
+				rw.Header().Set("Cache-Control", cacheControl)
+			}
+			WriteJSONResponse(rw, http.StatusOK, []byte(`{"call":`+strconv.Itoa(calls)+`}`))
+			return nil
+		}
+	}
+
+	BeforeEach(func() {
+		calls = 0
+		request = &http.Request{
+			Method: "GET",
+			Header: make(map[string][]string, 0),
+		}
+		request.URL, _ = url.Parse("/thing?page=1&utm=abc")
+		cacheMW = NewMiddlewareCache(CacheConfig{TTL: time.Minute})
+	})
+
+	Describe("handle", func() {
+		Context("when a response is cacheable", func() {
+			It("should serve the second request from the cache", func() {
+				response = serveChain(request, cacheMW, countingHandler(""))
+				Expect(response.Body.String()).To(Equal(`{"call":1}`))
+
+				response = serveChain(request, cacheMW, countingHandler(""))
+				Expect(calls).To(Equal(1))
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(response.Body.String()).To(Equal(`{"call":1}`))
+				Expect(response.Header().Get("Content-Type")).To(Equal("application/json"))
+				Expect(response.Header().Get("Age")).To(Equal("0"))
+			})
+
+			It("should key on the selected query params only", func() {
+				cacheMW = NewMiddlewareCache(CacheConfig{TTL: time.Minute, QueryParams: []string{"page"}})
+				response = serveChain(request, cacheMW, countingHandler(""))
+
+				request.URL, _ = url.Parse("/thing?utm=other&page=1")
+				response = serveChain(request, cacheMW, countingHandler(""))
+				Expect(calls).To(Equal(1))
+
+				request.URL, _ = url.Parse("/thing?page=2")
+				response = serveChain(request, cacheMW, countingHandler(""))
+				Expect(calls).To(Equal(2))
+			})
+
+			It("should key on the whole query by default", func() {
+				response = serveChain(request, cacheMW, countingHandler(""))
+
+				request.URL, _ = url.Parse("/thing?page=1&utm=other")
+				response = serveChain(request, cacheMW, countingHandler(""))
+				Expect(calls).To(Equal(2))
+			})
+
+			It("should key on the headers named in Vary", func() {
+				varyHandler := func(rw http.ResponseWriter, r *http.Request) *Response {
+					rw.Header().Set("Vary", "Accept-Language")
+					return countingHandler("")(rw, r)
+				}
+
+				request.Header.Set("Accept-Language", "en")
+				response = serveChain(request, cacheMW, varyHandler)
+				response = serveChain(request, cacheMW, varyHandler)
+				Expect(calls).To(Equal(1))
+
+				request.Header.Set("Accept-Language", "fr")
+				response = serveChain(request, cacheMW, varyHandler)
+				Expect(calls).To(Equal(2))
+			})
+
+			It("should keep the Vary header names within the store", func() {
+				store := NewMemoryCacheStore(4)
+				cacheMW = NewMiddlewareCache(CacheConfig{Store: store, TTL: time.Minute})
+
+				for i := 0; i < 10; i++ {
+					request.URL, _ = url.Parse("/thing?page=" + strconv.Itoa(i))
+					response = serveChain(request, cacheMW, func(rw http.ResponseWriter, r *http.Request) *Response {
+						rw.Header().Set("Vary", "Accept-Language")
+						return countingHandler("")(rw, r)
+					})
+				}
+
+				Expect(store.(*memoryCacheStore).ll.Len()).To(Equal(4))
+
+				marker, ok := store.Get("GET /thing?page=9")
+				Expect(ok).To(BeTrue())
+				Expect(marker.Vary).To(Equal([]string{"Accept-Language"}))
+			})
+
+			It("should use max-age over the configured TTL", func() {
+				cacheMW = NewMiddlewareCache(CacheConfig{})
+				response = serveChain(request, cacheMW, countingHandler("public, max-age=60"))
+				response = serveChain(request, cacheMW, countingHandler("public, max-age=60"))
+				Expect(calls).To(Equal(1))
+			})
+		})
+
+		Context("when a response is not cacheable", func() {
+			It("should not cache no-store responses", func() {
+				response = serveChain(request, cacheMW, countingHandler("no-store"))
+				response = serveChain(request, cacheMW, countingHandler("no-store"))
+				Expect(calls).To(Equal(2))
+			})
+
+			It("should not cache without a TTL", func() {
+				cacheMW = NewMiddlewareCache(CacheConfig{})
+				response = serveChain(request, cacheMW, countingHandler(""))
+				response = serveChain(request, cacheMW, countingHandler(""))
+				Expect(calls).To(Equal(2))
+			})
+
+			It("should not cache errors", func() {
+				response = serveChain(request, cacheMW, failureHandler)
+				Expect(response.Code).To(Equal(505))
+
+				response = serveChain(request, cacheMW, countingHandler(""))
+				Expect(calls).To(Equal(1))
+			})
+
+			It("should not cache requests with an Authorization header", func() {
+				request.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+				response = serveChain(request, cacheMW, countingHandler(""))
+				response = serveChain(request, cacheMW, countingHandler(""))
+				Expect(calls).To(Equal(2))
+			})
+
+			It("should not cache other methods", func() {
+				request.Method = "POST"
+				Expect(cacheMW(httptest.NewRecorder(), request)).To(BeNil())
+			})
+		})
+
+		Context("when an entry is stale", func() {
+			var store CacheStore
+
+			BeforeEach(func() {
+				store = NewMemoryCacheStore(10)
+				cacheMW = NewMiddlewareCache(CacheConfig{
+					Store:                store,
+					TTL:                  time.Minute,
+					StaleWhileRevalidate: time.Minute,
+				})
+				response = serveChain(request, cacheMW, countingHandler(""))
+
+				// age the entry
+				key := "GET /thing?page=1&utm=abc"
+				cached, ok := store.Get(key)
+				Expect(ok).To(BeTrue())
+				cached.Expires = time.Now().Add(-time.Second)
+			})
+
+			It("should serve the stale copy and refresh the entry", func() {
+				response = serveChain(request, cacheMW, countingHandler(""))
+				Expect(calls).To(Equal(2))
+				Expect(response.Body.String()).To(Equal(`{"call":1}`))
+				Expect(response.Header().Get("Content-Length")).To(Equal("10"))
+				Expect(response.Flushed).To(BeTrue())
+
+				response = serveChain(request, cacheMW, countingHandler(""))
+				Expect(calls).To(Equal(2))
+				Expect(response.Body.String()).To(Equal(`{"call":2}`))
+			})
+
+			It("should not keep the client waiting for the refresh", func() {
+				release := make(chan struct{})
+				slowHandler := func(rw http.ResponseWriter, r *http.Request) *Response {
+					select {
+					case <-release:
+					case <-time.After(5 * time.Second):
+					}
+					return countingHandler("")(rw, r)
+				}
+
+				server := httptest.NewServer(NewMWHandler(Config{}).Handle([]Handler{cacheMW, slowHandler}))
+				defer server.Close()
+
+				client := &http.Client{Timeout: 2 * time.Second}
+				resp, err := client.Get(server.URL + "/thing?page=1&utm=abc")
+				Expect(err).ToNot(HaveOccurred())
+
+				body, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				close(release)
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal(`{"call":1}`))
+				Expect(resp.ContentLength).To(Equal(int64(10)))
+
+				Eventually(func() string {
+					cached, _ := store.Get("GET /thing?page=1&utm=abc")
+					return string(cached.Body)
+				}).Should(Equal(`{"call":2}`))
+			})
+
+			It("should not serve it once past stale-while-revalidate", func() {
+				cached, _ := store.Get("GET /thing?page=1&utm=abc")
+				cached.StaleUntil = time.Now().Add(-time.Second)
+
+				response = serveChain(request, cacheMW, countingHandler(""))
+				Expect(calls).To(Equal(2))
+				Expect(response.Body.String()).To(Equal(`{"call":2}`))
+			})
+		})
+	})
+
+	Describe("NewMemoryCacheStore", func() {
+		It("should evict the least recently used entry", func() {
+			store := NewMemoryCacheStore(2)
+			store.Set("a", &CachedResponse{})
+			store.Set("b", &CachedResponse{})
+
+			_, ok := store.Get("a")
+			Expect(ok).To(BeTrue())
+
+			store.Set("c", &CachedResponse{})
+
+			_, ok = store.Get("b")
+			Expect(ok).To(BeFalse())
+			_, ok = store.Get("a")
+			Expect(ok).To(BeTrue())
+			_, ok = store.Get("c")
+			Expect(ok).To(BeTrue())
+		})
+
+		It("should delete entries", func() {
+			store := NewMemoryCacheStore(2)
+			store.Set("a", &CachedResponse{})
+			store.Delete("a")
+
+			_, ok := store.Get("a")
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
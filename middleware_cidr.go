@@ -2,43 +2,160 @@ package rye
 
 import (
 	"fmt"
-	"net"
 	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
 )
 
+const (
+	// IP rule actions
+	IP_RULE_ALLOW = "allow"
+	IP_RULE_DENY  = "deny"
+)
+
+// IPRule allows or denies the IPs in a CIDR (or a single plain IP).
+type IPRule struct {
+	Action string
+	CIDR   string
+}
+
 type cidr struct {
-	cidrs []string
+	// table holds the current *ipRuleTable and is swapped atomically on reload
+	table atomic.Value
+}
+
+// ipRuleTable is a parsed, immutable rule set
+type ipRuleTable struct {
+	rules         []IPRule
+	trie          *prefixTrie
+	defaultAction string
 }
 
 /*
 NewMiddlewareCIDR creates a new handler to verify incoming IPs against a set of CIDR Notation strings in a rye chain.
 For reference on CIDR notation see https://en.wikipedia.org/wiki/Classless_Inter-Domain_Routing
 
+All ranges are parsed up front; an error is returned if any of them is invalid.
+Plain IP addresses are accepted as single address ranges. IPv4 and IPv4-mapped
+IPv6 addresses are treated as the same address, and zone IDs are ignored.
+
+If the client IP middleware ran earlier in the chain, the client IP it resolved
+is checked instead of the immediate peer.
+
+See `NewMiddlewareCIDRDeny` for a deny-list, `NewMiddlewareIPRules` for mixed
+rules and `NewIPRuleSet` for rules which can be reloaded at runtime.
+
 Example usage:
 
+	cidrMiddleware, err := rye.NewMiddlewareCIDR(CIDRs) // []string of allowed CIDRs
+	if err != nil {
+		log.Fatalf("Invalid CIDR configuration: %v", err)
+	}
+
 	routes.Handle("/some/route", a.Dependencies.MWHandler.Handle(
 		[]rye.Handler{
-			rye.NewMiddlewareCIDR(CIDRs), // []string of allowed CIDRs
+			cidrMiddleware,
 			yourHandler,
 		})).Methods("POST")
 */
-func NewMiddlewareCIDR(CIDRs []string) func(rw http.ResponseWriter, req *http.Request) *Response {
-	c := &cidr{cidrs: CIDRs}
-	return c.handle
+func NewMiddlewareCIDR(CIDRs []string) (func(rw http.ResponseWriter, req *http.Request) *Response, error) {
+	return NewMiddlewareIPRules(cidrRules(IP_RULE_ALLOW, CIDRs), IP_RULE_DENY)
+}
+
+/*
+NewMiddlewareCIDRDeny creates a new handler which rejects incoming IPs in any of
+the given CIDRs and lets every other IP through.
+
+Example usage:
+
+	denyMiddleware, err := rye.NewMiddlewareCIDRDeny([]string{"203.0.113.0/24"})
+*/
+func NewMiddlewareCIDRDeny(CIDRs []string) (func(rw http.ResponseWriter, req *http.Request) *Response, error) {
+	return NewMiddlewareIPRules(cidrRules(IP_RULE_DENY, CIDRs), IP_RULE_ALLOW)
+}
+
+/*
+NewMiddlewareIPRules creates a new handler which checks incoming IPs against a
+mixed list of allow and deny rules. The first rule matching the IP decides;
+if no rule matches, defaultAction does.
+
+Example usage:
+
+	ipMiddleware, err := rye.NewMiddlewareIPRules([]rye.IPRule{
+		{Action: rye.IP_RULE_DENY, CIDR: "10.0.13.0/24"},  // a bad subnet...
+		{Action: rye.IP_RULE_ALLOW, CIDR: "10.0.0.0/8"},   // ...in a good network
+	}, rye.IP_RULE_DENY)
+*/
+func NewMiddlewareIPRules(rules []IPRule, defaultAction string) (func(rw http.ResponseWriter, req *http.Request) *Response, error) {
+	table, err := newIPRuleTable(rules, defaultAction)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cidr{}
+	c.table.Store(table)
+
+	return c.handle, nil
+}
+
+func cidrRules(action string, CIDRs []string) []IPRule {
+	rules := make([]IPRule, len(CIDRs))
+	for i, c := range CIDRs {
+		rules[i] = IPRule{Action: action, CIDR: c}
+	}
+
+	return rules
+}
+
+func newIPRuleTable(rules []IPRule, defaultAction string) (*ipRuleTable, error) {
+	if defaultAction != IP_RULE_ALLOW && defaultAction != IP_RULE_DENY {
+		return nil, fmt.Errorf("invalid IP rule action: %v", defaultAction)
+	}
+
+	t := &ipRuleTable{
+		rules:         rules,
+		trie:          &prefixTrie{v4: &trieNode{}, v6: &trieNode{}},
+		defaultAction: defaultAction,
+	}
+
+	for i, rule := range rules {
+		if rule.Action != IP_RULE_ALLOW && rule.Action != IP_RULE_DENY {
+			return nil, fmt.Errorf("invalid IP rule action: %v", rule.Action)
+		}
+
+		p, err := parsePrefix(rule.CIDR)
+		if err != nil {
+			return nil, err
+		}
+
+		t.trie.insert(p, i)
+	}
+
+	return t, nil
+}
+
+// allowed applies the first matching rule, or the default action
+func (t *ipRuleTable) allowed(ip netip.Addr) bool {
+	if i, ok := t.trie.lookup(ip); ok {
+		return t.rules[i].Action == IP_RULE_ALLOW
+	}
+
+	return t.defaultAction == IP_RULE_ALLOW
 }
 
 // Verify if incoming request comes from a valid CIDR
 func (c *cidr) handle(rw http.ResponseWriter, r *http.Request) *Response {
-	// Validate the incoming IP
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
+	// Validate the incoming IP, as resolved by the client IP middleware if
+	// it ran earlier in the chain
+	ip, host, err := remoteIP(r)
+	if err != nil && host == "" {
 		return &Response{
 			Err:        fmt.Errorf("Remote address error: %v", err.Error()),
 			StatusCode: http.StatusUnauthorized,
 		}
 	}
 
-	included, err := inCIDRs(host, c.cidrs)
 	if err != nil {
 		return &Response{
 			Err:        fmt.Errorf("Error validating IP address: %v", err.Error()),
@@ -46,7 +163,7 @@ func (c *cidr) handle(rw http.ResponseWriter, r *http.Request) *Response {
 		}
 	}
 
-	if !included {
+	if !c.table.Load().(*ipRuleTable).allowed(ip) {
 		return &Response{
 			Err:        fmt.Errorf("%v is not authorized", host),
 			StatusCode: http.StatusUnauthorized,
@@ -56,34 +173,124 @@ func (c *cidr) handle(rw http.ResponseWriter, r *http.Request) *Response {
 	return nil
 }
 
-// Verify that a given IP is a part of at least one CIDR in given CIDR list
-func inCIDRs(ipAddr string, cidrList []string) (bool, error) {
-	for _, v := range cidrList {
-		state, err := inCIDR(ipAddr, v)
+// parseIP parses an IP address, dropping any zone ID and unmapping
+// IPv4-mapped IPv6 addresses so they match IPv4 ranges
+func parseIP(s string) (netip.Addr, error) {
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("Unable to parse IP %v", s)
+	}
+
+	return ip.WithZone("").Unmap(), nil
+}
+
+// parsePrefix parses a CIDR (or a plain IP as a single address range) into
+// its canonical, masked form
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+
+	if !strings.Contains(s, "/") {
+		ip, err := parseIP(s)
 		if err != nil {
-			return false, err
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR address: %v", s)
 		}
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR address: %v", s)
+	}
+
+	// ::ffff:10.0.0.0/104 is the same range as 10.0.0.0/8
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
 
-		if state {
-			return true, nil
+	return p.Masked(), nil
+}
+
+// prefixTrie is a binary trie of IP prefixes, with separate roots for IPv4
+// and IPv6, which finds the prefixes covering an address in at most
+// prefix-length steps. Each prefix carries the index it was inserted with.
+type prefixTrie struct {
+	v4, v6 *trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool
+	index    int
+}
+
+func newPrefixTrie(CIDRs []string) (*prefixTrie, error) {
+	t := &prefixTrie{v4: &trieNode{}, v6: &trieNode{}}
+
+	for i, s := range CIDRs {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
 		}
+
+		t.insert(p, i)
 	}
 
-	return false, nil
+	return t, nil
 }
 
-// Verify whether a given IP is in a CIDR
-func inCIDR(ipAddr, cidrAddr string) (bool, error) {
-	_, cidrnet, err := net.ParseCIDR(cidrAddr)
-	if err != nil {
-		return false, err
+func (t *prefixTrie) root(ip netip.Addr) *trieNode {
+	if ip.Is4() {
+		return t.v4
+	}
+
+	return t.v6
+}
+
+// insert adds a prefix; a duplicate prefix keeps its lowest index
+func (t *prefixTrie) insert(p netip.Prefix, index int) {
+	node := t.root(p.Addr())
+	b := p.Addr().AsSlice()
+
+	for i := 0; i < p.Bits(); i++ {
+		bit := bitAt(b, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
 	}
 
-	ip := net.ParseIP(ipAddr)
+	if !node.terminal || index < node.index {
+		node.terminal = true
+		node.index = index
+	}
+}
+
+// lookup returns the lowest index of all the prefixes covering ip
+func (t *prefixTrie) lookup(ip netip.Addr) (int, bool) {
+	node := t.root(ip)
+	b := ip.AsSlice()
 
-	if ip == nil {
-		return false, fmt.Errorf("Unable to parse IP %v", ip)
+	index, found := 0, false
+	for i := 0; node != nil; i++ {
+		if node.terminal && (!found || node.index < index) {
+			index, found = node.index, true
+		}
+
+		if i == len(b)*8 {
+			break
+		}
+
+		node = node.children[bitAt(b, i)]
 	}
 
-	return cidrnet.Contains(ip), nil
+	return index, found
+}
+
+func (t *prefixTrie) contains(ip netip.Addr) bool {
+	_, ok := t.lookup(ip)
+	return ok
+}
+
+func bitAt(b []byte, i int) int {
+	return int(b[i/8]>>(7-uint(i%8))) & 1
 }
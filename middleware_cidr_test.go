@@ -17,6 +17,12 @@ var _ = Describe("CIDR Middleware", func() {
 		cidr1, cidr2, ip1, ip2, ip3 string
 	)
 
+	newCIDR := func(CIDRs []string) func(rw http.ResponseWriter, req *http.Request) *Response {
+		mw, err := NewMiddlewareCIDR(CIDRs)
+		Expect(err).ToNot(HaveOccurred())
+		return mw
+	}
+
 	BeforeEach(func() {
 		response = httptest.NewRecorder()
 		request = &http.Request{}
@@ -27,17 +33,28 @@ var _ = Describe("CIDR Middleware", func() {
 		ip3 = "192.0.0.1:22"
 	})
 
+	Describe("NewMiddlewareCIDR", func() {
+		Context("when an unrecognizable CIDR is used", func() {
+			It("should return an error", func() {
+				mw, err := NewMiddlewareCIDR([]string{cidr1, "blah"})
+				Expect(mw).To(BeNil())
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("invalid CIDR address: blah"))
+			})
+		})
+	})
+
 	Describe("handle", func() {
 		Context("when a valid IP is used", func() {
 			It("should return nil", func() {
 				request.RemoteAddr = ip1
-				resp := NewMiddlewareCIDR([]string{cidr1, cidr2})(response, request)
+				resp := newCIDR([]string{cidr1, cidr2})(response, request)
 				Expect(resp).To(BeNil())
 			})
 
 			It("should return nil", func() {
 				request.RemoteAddr = ip2
-				resp := NewMiddlewareCIDR([]string{cidr1, cidr2})(response, request)
+				resp := newCIDR([]string{cidr1, cidr2})(response, request)
 				Expect(resp).To(BeNil())
 			})
 		})
@@ -45,7 +62,7 @@ var _ = Describe("CIDR Middleware", func() {
 		Context("when an invalid IP is used", func() {
 			It("should return an error", func() {
 				request.RemoteAddr = ip3
-				resp := NewMiddlewareCIDR([]string{cidr1, cidr2})(response, request)
+				resp := newCIDR([]string{cidr1, cidr2})(response, request)
 				Expect(resp).ToNot(BeNil())
 				Expect(resp.Err).To(HaveOccurred())
 				Expect(resp.Error()).To(ContainSubstring("not authorized"))
@@ -55,7 +72,7 @@ var _ = Describe("CIDR Middleware", func() {
 
 		Context("when no IP exists", func() {
 			It("should return an error", func() {
-				resp := NewMiddlewareCIDR([]string{cidr1, cidr2})(response, request)
+				resp := newCIDR([]string{cidr1, cidr2})(response, request)
 				Expect(resp).ToNot(BeNil())
 				Expect(resp.Err).To(HaveOccurred())
 				Expect(resp.Error()).To(ContainSubstring("Remote address error"))
@@ -66,24 +83,81 @@ var _ = Describe("CIDR Middleware", func() {
 		Context("when an unrecognizable IP is used", func() {
 			It("should return an error", func() {
 				request.RemoteAddr = "blah:80"
-				resp := NewMiddlewareCIDR([]string{cidr1, cidr2})(response, request)
+				resp := newCIDR([]string{cidr1, cidr2})(response, request)
 				Expect(resp).ToNot(BeNil())
 				Expect(resp.Err).To(HaveOccurred())
-				Expect(resp.Error()).To(ContainSubstring("Error validating IP address: Unable to parse IP"))
+				Expect(resp.Error()).To(ContainSubstring("Error validating IP address: Unable to parse IP blah"))
 				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
 			})
 		})
 
-		Context("when an unrecognizable CIDR is used", func() {
-			It("should return an error", func() {
-				request.RemoteAddr = ip1
-				resp := NewMiddlewareCIDR([]string{"blah"})(response, request)
+		Context("when IPv6 is used", func() {
+			It("should match IPv6 ranges", func() {
+				request.RemoteAddr = "[2001:db8::1]:443"
+				resp := newCIDR([]string{"2001:db8::/32"})(response, request)
+				Expect(resp).To(BeNil())
+			})
+
+			It("should reject addresses outside IPv6 ranges", func() {
+				request.RemoteAddr = "[2001:db9::1]:443"
+				resp := newCIDR([]string{"2001:db8::/32"})(response, request)
 				Expect(resp).ToNot(BeNil())
-				Expect(resp.Err).To(HaveOccurred())
-				Expect(resp.Error()).To(ContainSubstring("Error validating IP address: invalid CIDR address"))
 				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
 			})
+
+			It("should match IPv4-mapped addresses against IPv4 ranges", func() {
+				request.RemoteAddr = "[::ffff:10.0.0.1]:22"
+				resp := newCIDR([]string{cidr1})(response, request)
+				Expect(resp).To(BeNil())
+			})
+
+			It("should match IPv4 addresses against IPv4-mapped ranges", func() {
+				request.RemoteAddr = ip1
+				resp := newCIDR([]string{"::ffff:10.0.0.0/120"})(response, request)
+				Expect(resp).To(BeNil())
+			})
+
+			It("should ignore zone IDs", func() {
+				request.RemoteAddr = "[fe80::1%eth0]:22"
+				resp := newCIDR([]string{"fe80::/10"})(response, request)
+				Expect(resp).To(BeNil())
+			})
+		})
+
+		Context("when plain IPs are used as ranges", func() {
+			It("should match the single address", func() {
+				request.RemoteAddr = ip1
+				Expect(newCIDR([]string{"10.0.0.1"})(response, request)).To(BeNil())
+
+				request.RemoteAddr = "10.0.0.2:22"
+				Expect(newCIDR([]string{"10.0.0.1"})(response, request)).ToNot(BeNil())
+			})
 		})
+	})
+
+	Describe("prefixTrie", func() {
+		It("should match nested and overlapping prefixes", func() {
+			trie, err := newPrefixTrie([]string{"10.1.2.0/24", "10.0.0.0/8", "0.0.0.0/32"})
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, s := range []string{"10.1.2.3", "10.200.0.1", "0.0.0.0"} {
+				ip, _ := parseIP(s)
+				Expect(trie.contains(ip)).To(BeTrue(), s)
+			}
 
+			for _, s := range []string{"11.0.0.1", "0.0.0.1", "::a00:1"} {
+				ip, _ := parseIP(s)
+				Expect(trie.contains(ip)).To(BeFalse(), s)
+			}
+		})
+
+		It("should match everything with a zero length prefix", func() {
+			trie, _ := newPrefixTrie([]string{"::/0"})
+			ip, _ := parseIP("2001:db8::1")
+			Expect(trie.contains(ip)).To(BeTrue())
+
+			ip, _ = parseIP("10.0.0.1")
+			Expect(trie.contains(ip)).To(BeFalse())
+		})
 	})
 })
@@ -0,0 +1,245 @@
+package rye
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	CONTEXT_CLIENT_IP = "rye-middlewareclientip-ip"
+)
+
+var defaultClientIPHeaders = []string{"X-Forwarded-For"}
+
+// ClientIPConfig is used to configure the client IP middleware.
+type ClientIPConfig struct {
+	// TrustedProxies lists the CIDRs (or plain IPs) of the proxies allowed
+	// to report the client address.
+	TrustedProxies []string
+
+	// Headers lists the headers to read the forwarded addresses from, in
+	// priority order; the first one present is used. Supported headers are
+	// "Forwarded" (RFC 7239), "X-Forwarded-For" and "X-Real-IP", or any
+	// custom header holding a comma separated list of addresses.
+	//
+	// Only list the headers your proxies set or overwrite: a client can send
+	// any header, and one the proxies pass through untouched is taken as is.
+	Headers []string
+
+	// MaxHops is the maximum number of forwarded addresses walked back
+	// through; zero means no limit.
+	MaxHops int
+}
+
+type clientIP struct {
+	trusted *prefixTrie
+	headers []string
+	maxHops int
+}
+
+/*
+NewMiddlewareClientIP creates a new handler which resolves the real client IP
+of a request sent through one or more proxies, and stores it in the context.
+
+The forwarding headers are only honoured when the immediate peer
+(`r.RemoteAddr`) is a trusted proxy, otherwise the peer itself is the client.
+The forwarded addresses are then walked back from the right, skipping trusted
+proxies, and the first untrusted address is the client. `MaxHops` caps how far
+back that walk goes.
+
+The resolved IP is used by the CIDR middleware and the route logger, and can
+be read by any later handler with `rye.ClientIP(r)`. The middleware should
+therefore come first in the chain.
+
+Default client IP values:
+
+	Headers: "X-Forwarded-For"
+	MaxHops: no limit
+
+Example use case:
+
+	clientIPMiddleware, err := rye.NewMiddlewareClientIP(rye.ClientIPConfig{
+		TrustedProxies: []string{"10.0.0.0/8"},
+		MaxHops:        2,
+	})
+	if err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
+
+	middlewareHandler.Use(clientIPMiddleware)
+*/
+func NewMiddlewareClientIP(config ClientIPConfig) (func(rw http.ResponseWriter, req *http.Request) *Response, error) {
+	trusted, err := newPrefixTrie(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &clientIP{
+		trusted: trusted,
+		headers: config.Headers,
+		maxHops: config.MaxHops,
+	}
+
+	if len(c.headers) == 0 {
+		c.headers = defaultClientIPHeaders
+	}
+
+	return c.handle, nil
+}
+
+/*
+ClientIP returns the client IP resolved by the client IP middleware, falling
+back to the host of `r.RemoteAddr` when the middleware is not in the chain.
+
+	func logHandler(rw http.ResponseWriter, r *http.Request) *rye.Response {
+		log.Infof("request from %s", rye.ClientIP(r))
+		return nil
+	}
+*/
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(CONTEXT_CLIENT_IP).(netip.Addr); ok {
+		return ip.String()
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// remoteIP returns the resolved client IP from the context, or the parsed
+// peer address
+func remoteIP(r *http.Request) (netip.Addr, string, error) {
+	if ip, ok := r.Context().Value(CONTEXT_CLIENT_IP).(netip.Addr); ok {
+		return ip, ip.String(), nil
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, "", err
+	}
+
+	ip, err := parseIP(host)
+	return ip, host, err
+}
+
+func (c *clientIP) handle(rw http.ResponseWriter, r *http.Request) *Response {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	peer, err := parseIP(host)
+	if err != nil {
+		return nil
+	}
+
+	return &Response{
+		Context: context.WithValue(r.Context(), CONTEXT_CLIENT_IP, c.resolve(peer, r.Header)),
+	}
+}
+
+// resolve walks the forwarded addresses back from the peer
+func (c *clientIP) resolve(peer netip.Addr, header http.Header) netip.Addr {
+	if !c.trusted.contains(peer) {
+		return peer
+	}
+
+	hops := c.forwarded(header)
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		if c.maxHops > 0 && len(hops)-i > c.maxHops {
+			break
+		}
+
+		ip, err := parseHop(hops[i])
+		if err != nil {
+			// Anything further left can't be trusted
+			break
+		}
+
+		client = ip
+		if !c.trusted.contains(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// parseHop parses a forwarded address, which some proxies send with a port
+func parseHop(hop string) (netip.Addr, error) {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+
+	return parseIP(hop)
+}
+
+// forwarded returns the addresses from the first configured header present,
+// in the order they were added (client first)
+func (c *clientIP) forwarded(header http.Header) []string {
+	for _, name := range c.headers {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+
+		if http.CanonicalHeaderKey(name) == "Forwarded" {
+			return parseForwardedFor(strings.Join(values, ","))
+		}
+
+		return splitHeaderList(strings.Join(values, ","))
+	}
+
+	return nil
+}
+
+// parseForwardedFor extracts the for= node of every element of an RFC 7239
+// Forwarded header, stripping quotes, brackets and ports. Obfuscated and
+// unknown nodes are kept as is so they stop the walk.
+func parseForwardedFor(header string) []string {
+	var nodes []string
+
+	for _, element := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			pair = strings.TrimSpace(pair)
+			if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+				continue
+			}
+
+			node, err := forwardedNode(strings.Trim(pair[4:], `"`))
+			if err != nil {
+				node = pair[4:]
+			}
+
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+// forwardedNode strips the port and IPv6 brackets from a Forwarded node
+func forwardedNode(node string) (string, error) {
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end < 0 {
+			return "", errors.New("invalid IPv6 node")
+		}
+		return node[1:end], nil
+	}
+
+	if i := strings.Index(node, ":"); i >= 0 {
+		return node[:i], nil
+	}
+
+	return node, nil
+}
@@ -0,0 +1,163 @@
+package rye
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client IP Middleware", func() {
+
+	var (
+		request  *http.Request
+		response *httptest.ResponseRecorder
+		config   ClientIPConfig
+	)
+
+	// resolve runs the middleware and returns the client IP it resolved
+	resolve := func() string {
+		mw, err := NewMiddlewareClientIP(config)
+		Expect(err).ToNot(HaveOccurred())
+
+		resp := mw(response, request)
+		Expect(resp).ToNot(BeNil())
+		Expect(resp.Context).ToNot(BeNil())
+
+		return ClientIP(request.WithContext(resp.Context))
+	}
+
+	BeforeEach(func() {
+		response = httptest.NewRecorder()
+		request = &http.Request{
+			Header:     make(map[string][]string, 0),
+			RemoteAddr: "10.0.0.1:1234",
+		}
+		config = ClientIPConfig{TrustedProxies: []string{"10.0.0.0/8"}}
+	})
+
+	Describe("NewMiddlewareClientIP", func() {
+		Context("when an invalid trusted proxy is used", func() {
+			It("should return an error", func() {
+				_, err := NewMiddlewareClientIP(ClientIPConfig{TrustedProxies: []string{"nope"}})
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("invalid CIDR address"))
+			})
+		})
+	})
+
+	Describe("handle", func() {
+		Context("when the peer is not a trusted proxy", func() {
+			It("should ignore the forwarding headers", func() {
+				request.RemoteAddr = "203.0.113.9:1234"
+				request.Header.Set("X-Forwarded-For", "1.2.3.4")
+				Expect(resolve()).To(Equal("203.0.113.9"))
+			})
+		})
+
+		Context("when the peer is a trusted proxy", func() {
+			It("should use X-Forwarded-For", func() {
+				request.Header.Set("X-Forwarded-For", "1.2.3.4")
+				Expect(resolve()).To(Equal("1.2.3.4"))
+			})
+
+			It("should skip trusted hops and stop at the first untrusted one", func() {
+				request.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.1.1.1, 10.2.2.2")
+				Expect(resolve()).To(Equal("1.2.3.4"))
+			})
+
+			It("should combine multiple header lines", func() {
+				request.Header.Add("X-Forwarded-For", "6.6.6.6, 1.2.3.4")
+				request.Header.Add("X-Forwarded-For", "10.1.1.1")
+				Expect(resolve()).To(Equal("1.2.3.4"))
+			})
+
+			It("should limit the walk to MaxHops", func() {
+				config.MaxHops = 1
+				request.Header.Set("X-Forwarded-For", "1.2.3.4, 10.1.1.1")
+				Expect(resolve()).To(Equal("10.1.1.1"))
+			})
+
+			It("should stop at an invalid hop", func() {
+				request.Header.Set("X-Forwarded-For", "1.2.3.4, garbage, 10.1.1.1")
+				Expect(resolve()).To(Equal("10.1.1.1"))
+			})
+
+			It("should accept hops with ports", func() {
+				request.Header.Set("X-Forwarded-For", "1.2.3.4:5678")
+				Expect(resolve()).To(Equal("1.2.3.4"))
+			})
+
+			It("should use X-Real-IP", func() {
+				config.Headers = []string{"X-Real-IP"}
+				request.Header.Set("X-Real-IP", "1.2.3.4")
+				Expect(resolve()).To(Equal("1.2.3.4"))
+			})
+
+			It("should use the headers in order", func() {
+				config.Headers = []string{"Forwarded", "X-Forwarded-For"}
+				request.Header.Set("Forwarded", `for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"`)
+				request.Header.Set("X-Forwarded-For", "1.2.3.4")
+				Expect(resolve()).To(Equal("2001:db8:cafe::17"))
+			})
+
+			It("should stop at obfuscated Forwarded nodes", func() {
+				config.Headers = []string{"Forwarded"}
+				config.TrustedProxies = []string{"10.0.0.0/8", "2001:db8:cafe::/48"}
+				request.Header.Set("Forwarded", `for=_hidden, for="[2001:db8:cafe::17]:4711"`)
+				Expect(resolve()).To(Equal("2001:db8:cafe::17"))
+			})
+
+			It("should respect the configured headers", func() {
+				config.Headers = []string{"CF-Connecting-IP"}
+				request.Header.Set("X-Forwarded-For", "1.2.3.4")
+				request.Header.Set("CF-Connecting-IP", "5.6.7.8")
+				Expect(resolve()).To(Equal("5.6.7.8"))
+			})
+
+			It("should only trust X-Forwarded-For by default", func() {
+				request.Header.Set("Forwarded", "for=6.6.6.6")
+				request.Header.Set("X-Real-IP", "6.6.6.6")
+				request.Header.Set("X-Forwarded-For", "1.2.3.4")
+				Expect(resolve()).To(Equal("1.2.3.4"))
+			})
+
+			It("should fall back to the peer without forwarding headers", func() {
+				Expect(resolve()).To(Equal("10.0.0.1"))
+			})
+		})
+
+		Context("when the remote address can't be parsed", func() {
+			It("should return nil", func() {
+				request.RemoteAddr = "garbage"
+				mw, _ := NewMiddlewareClientIP(config)
+				Expect(mw(response, request)).To(BeNil())
+			})
+		})
+
+		Context("when combined with the CIDR middleware", func() {
+			It("should check the resolved client IP", func() {
+				request.Header.Set("X-Forwarded-For", "192.168.1.10")
+
+				cidrMW, err := NewMiddlewareCIDR([]string{"192.168.1.0/24"})
+				Expect(err).ToNot(HaveOccurred())
+				clientIPMW, err := NewMiddlewareClientIP(config)
+				Expect(err).ToNot(HaveOccurred())
+
+				NewMWHandler(Config{}).Handle([]Handler{clientIPMW, cidrMW, successHandler}).ServeHTTP(response, request)
+				Expect(response.Code).To(Equal(http.StatusOK))
+
+				response = httptest.NewRecorder()
+				NewMWHandler(Config{}).Handle([]Handler{cidrMW, successHandler}).ServeHTTP(response, request)
+				Expect(response.Code).To(Equal(http.StatusUnauthorized))
+			})
+		})
+	})
+
+	Describe("ClientIP", func() {
+		It("should fall back to the remote address host", func() {
+			Expect(ClientIP(request)).To(Equal("10.0.0.1"))
+		})
+	})
+})
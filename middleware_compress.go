@@ -0,0 +1,452 @@
+package rye
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Compression specific constants
+	ENCODING_GZIP   = "gzip"
+	ENCODING_BROTLI = "br"
+	ENCODING_ZSTD   = "zstd"
+
+	DEFAULT_COMPRESS_MIN_SIZE = 1024
+)
+
+var defaultCompressEncodings = []string{ENCODING_ZSTD, ENCODING_BROTLI, ENCODING_GZIP}
+
+var defaultCompressContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// CompressConfig is used to configure the compression middleware. Any zero
+// value field falls back to its default.
+type CompressConfig struct {
+	// Encodings lists the supported encodings in order of server preference;
+	// the preference is used to break ties between equal client q-values.
+	Encodings []string
+
+	// Level is passed to the encoder as is, so its meaning depends on the
+	// negotiated encoding (1-9 for gzip, 0-11 for br, 1-22 for zstd).
+	Level int
+
+	// MinSize is the smallest body, in bytes, that will be compressed.
+	MinSize int
+
+	// ContentTypes lists the compressible media types. An entry ending in
+	// "/*" matches the whole type, ie. "text/*".
+	ContentTypes []string
+}
+
+type compress struct {
+	encodings    []string
+	level        int
+	minSize      int
+	contentTypes []string
+
+	// encoders pools the encoders of each encoding, as they are expensive
+	// to create; they are Reset onto every response
+	encoders map[string]*sync.Pool
+}
+
+// encoder is implemented by the gzip, brotli and zstd writers
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// MiddlewareCompress creates a compression handler using the default config.
+func MiddlewareCompress() func(rw http.ResponseWriter, req *http.Request) *Response {
+	return NewMiddlewareCompress(CompressConfig{})
+}
+
+/*
+NewMiddlewareCompress creates a new handler which compresses the output of the
+rest of the chain using gzip, brotli or zstd, as negotiated with the client's
+`Accept-Encoding` header. It should be placed before the handlers whose output
+you want compressed; ie. before `NewStaticFile`, `NewStaticFilesystem` or any
+handler using `WriteJSONResponse`.
+
+A response is only compressed if it has a compressible `Content-Type`, is at
+least `MinSize` bytes long and was not already encoded by the handler. Partial
+content and bodiless responses are never compressed. `Vary: Accept-Encoding`
+is always set so that caches keep the variants apart.
+
+Streaming handlers can call Flush() on the writer as usual; flushing starts
+compression straight away without waiting for `MinSize` bytes.
+
+Default compression values:
+
+	Encodings:    "zstd", "br", "gzip"
+	Level:        the encoder's own default
+	MinSize:      1024 bytes
+	ContentTypes: "text/*", "application/json", "application/javascript", "application/xml",
+	              "application/xhtml+xml", "application/wasm", "image/svg+xml"
+
+Example use case:
+
+	routes.PathPrefix("/dist/").Handler(middlewareHandler.Handle([]rye.Handler{
+		rye.MiddlewareCompress(), // use defaults
+		rye.NewStaticFilesystem(pwd+"/dist/", "/dist/"),
+	}))
+
+OR:
+
+	routes.Handle("/some/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareCompress(rye.CompressConfig{
+				Encodings: []string{rye.ENCODING_GZIP},
+				MinSize:   512,
+			}),
+			yourHandler,
+		})).Methods("GET")
+*/
+func NewMiddlewareCompress(config CompressConfig) func(rw http.ResponseWriter, req *http.Request) *Response {
+	c := &compress{
+		encodings:    config.Encodings,
+		level:        config.Level,
+		minSize:      config.MinSize,
+		contentTypes: config.ContentTypes,
+	}
+
+	if len(c.encodings) == 0 {
+		c.encodings = defaultCompressEncodings
+	}
+
+	if c.minSize <= 0 {
+		c.minSize = DEFAULT_COMPRESS_MIN_SIZE
+	}
+
+	if len(c.contentTypes) == 0 {
+		c.contentTypes = defaultCompressContentTypes
+	}
+
+	c.encoders = make(map[string]*sync.Pool, len(c.encodings))
+	for _, enc := range c.encodings {
+		c.encoders[enc] = &sync.Pool{}
+	}
+
+	return c.handle
+}
+
+func (c *compress) handle(rw http.ResponseWriter, req *http.Request) *Response {
+	// The response varies on Accept-Encoding whether or not we compress it
+	rw.Header().Add("Vary", "Accept-Encoding")
+
+	if req.Method == http.MethodHead {
+		return nil
+	}
+
+	encoding := c.negotiate(req.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return nil
+	}
+
+	return &Response{
+		ResponseWriter: &compressWriter{
+			ResponseWriter: rw,
+			compress:       c,
+			encoding:       encoding,
+			statusCode:     http.StatusOK,
+		},
+	}
+}
+
+// negotiate picks the encoding with the highest client q-value, breaking ties
+// by server preference. It returns "" if no supported encoding is acceptable.
+func (c *compress) negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := parseAcceptEncoding(acceptEncoding)
+
+	best, bestQ := "", 0.0
+	for _, enc := range c.encodings {
+		q, ok := accepted[enc]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+
+		if ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+
+	return best
+}
+
+// parseAcceptEncoding maps each coding in an Accept-Encoding header to its q-value
+func parseAcceptEncoding(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+
+	for _, part := range strings.Split(header, ",") {
+		coding, params := part, ""
+		if i := strings.Index(part, ";"); i >= 0 {
+			coding, params = part[:i], part[i+1:]
+		}
+
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		accepted[coding] = q
+	}
+
+	return accepted
+}
+
+func (c *compress) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range c.contentTypes {
+		if strings.HasSuffix(t, "/*") {
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+				return true
+			}
+			continue
+		}
+
+		if mediaType == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newEncoder takes an encoder from the pool, or creates one, and resets it
+// onto w. It goes back to the pool with `releaseEncoder` once closed.
+func (c *compress) newEncoder(w io.Writer, encoding string) (encoder, error) {
+	if e, ok := c.encoders[encoding].Get().(encoder); ok {
+		e.Reset(w)
+		return e, nil
+	}
+
+	switch encoding {
+	case ENCODING_BROTLI:
+		if c.level == 0 {
+			return brotli.NewWriter(w), nil
+		}
+		return brotli.NewWriterLevel(w, c.level), nil
+
+	case ENCODING_ZSTD:
+		// A response is encoded by one goroutine, so don't let every
+		// encoder start more
+		options := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if c.level != 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+		}
+		return zstd.NewWriter(w, options...)
+
+	default:
+		if c.level == 0 {
+			return gzip.NewWriter(w), nil
+		}
+		return gzip.NewWriterLevel(w, c.level)
+	}
+}
+
+func (c *compress) releaseEncoder(encoding string, e encoder) {
+	// Don't hold on to the response writer
+	e.Reset(nil)
+	c.encoders[encoding].Put(e)
+}
+
+// compressWriter buffers the start of the body until it can decide whether
+// the response is worth compressing, then either compresses or passes through.
+type compressWriter struct {
+	http.ResponseWriter
+
+	compress   *compress
+	encoding   string
+	statusCode int
+
+	headerCalled bool
+	decided      bool
+	buf          []byte
+	encoder      encoder
+	closed       bool
+}
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if cw.headerCalled {
+		return
+	}
+
+	cw.headerCalled = true
+	cw.statusCode = statusCode
+
+	// Bodiless responses have nothing to compress
+	if statusCode < http.StatusOK || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		cw.start(false)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.headerCalled {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+
+	if !cw.eligible() {
+		return len(p), cw.start(false)
+	}
+
+	if len(cw.buf) >= cw.compress.minSize {
+		return len(p), cw.start(true)
+	}
+
+	return len(p), nil
+}
+
+// Flush starts compressing regardless of size, as a streaming handler wants
+// its data sent now, then flushes all the way down to the client.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if !cw.headerCalled {
+			cw.WriteHeader(http.StatusOK)
+		}
+		cw.start(cw.eligible())
+	}
+
+	if f, ok := cw.encoder.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close is called by rye once the chain has finished; responses that never
+// reached MinSize are written out uncompressed.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if !cw.headerCalled && len(cw.buf) == 0 {
+			return nil
+		}
+
+		if err := cw.start(false); err != nil {
+			return err
+		}
+	}
+
+	cw.closed = true
+
+	if cw.encoder != nil {
+		err := cw.encoder.Close()
+		cw.compress.releaseEncoder(cw.encoding, cw.encoder)
+		cw.encoder = nil
+		return err
+	}
+
+	return nil
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// eligible checks the response headers for anything that rules out compression
+func (cw *compressWriter) eligible() bool {
+	h := cw.Header()
+
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+
+	if cw.statusCode == http.StatusPartialContent {
+		return false
+	}
+
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		// net/http would sniff it on the first write anyway
+		contentType = http.DetectContentType(cw.buf)
+		h.Set("Content-Type", contentType)
+	}
+
+	return cw.compress.compressible(contentType)
+}
+
+// start writes the header and buffered data, compressing if asked to
+func (cw *compressWriter) start(compressed bool) error {
+	cw.decided = true
+
+	if compressed {
+		encoder, err := cw.compress.newEncoder(cw.ResponseWriter, cw.encoding)
+		if err != nil {
+			return err
+		}
+		cw.encoder = encoder
+
+		h := cw.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+
+		// The compressed body no longer matches a strong validator
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.statusCode)
+
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	buf := cw.buf
+	cw.buf = nil
+
+	if cw.encoder != nil {
+		_, err := cw.encoder.Write(buf)
+		return err
+	}
+
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
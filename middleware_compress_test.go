@@ -0,0 +1,246 @@
+package rye
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compress Middleware", func() {
+
+	var (
+		request  *http.Request
+		response *httptest.ResponseRecorder
+		body     string
+	)
+
+	BeforeEach(func() {
+		response = httptest.NewRecorder()
+		request = &http.Request{
+			Method: "GET",
+			Header: make(map[string][]string, 0),
+		}
+		body = strings.Repeat(`{"message":"compress me"}`, 100)
+	})
+
+	jsonHandler := func(content string) Handler {
+		return func(rw http.ResponseWriter, r *http.Request) *Response {
+			WriteJSONResponse(rw, http.StatusOK, []byte(content))
+			return nil
+		}
+	}
+
+	Describe("negotiate", func() {
+		It("should prefer the highest q-value", func() {
+			c := NewMiddlewareCompress(CompressConfig{})
+			request.Header.Set("Accept-Encoding", "gzip;q=1.0, br;q=0.5")
+			resp := c(response, request)
+			Expect(resp).ToNot(BeNil())
+			Expect(resp.ResponseWriter.(*compressWriter).encoding).To(Equal(ENCODING_GZIP))
+		})
+
+		It("should break ties with the server preference", func() {
+			c := NewMiddlewareCompress(CompressConfig{})
+			request.Header.Set("Accept-Encoding", "gzip, br, zstd")
+			resp := c(response, request)
+			Expect(resp.ResponseWriter.(*compressWriter).encoding).To(Equal(ENCODING_ZSTD))
+		})
+
+		It("should honour wildcards and q=0 exclusions", func() {
+			c := NewMiddlewareCompress(CompressConfig{})
+			request.Header.Set("Accept-Encoding", "*, zstd;q=0, br;q=0")
+			resp := c(response, request)
+			Expect(resp.ResponseWriter.(*compressWriter).encoding).To(Equal(ENCODING_GZIP))
+		})
+
+		It("should do nothing when no encoding is acceptable", func() {
+			c := NewMiddlewareCompress(CompressConfig{Encodings: []string{ENCODING_BROTLI}})
+			request.Header.Set("Accept-Encoding", "gzip")
+			resp := c(response, request)
+			Expect(resp).To(BeNil())
+			Expect(response.Header().Get("Vary")).To(Equal("Accept-Encoding"))
+		})
+	})
+
+	Describe("handle", func() {
+		Context("when the client accepts gzip", func() {
+			It("should compress a large JSON response", func() {
+				request.Header.Set("Accept-Encoding", "gzip")
+				response = serveChain(request, MiddlewareCompress(), jsonHandler(body))
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(response.Header().Get("Content-Encoding")).To(Equal("gzip"))
+				Expect(response.Header().Get("Vary")).To(Equal("Accept-Encoding"))
+
+				gz, err := gzip.NewReader(response.Body)
+				Expect(err).ToNot(HaveOccurred())
+				decoded, err := ioutil.ReadAll(gz)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(decoded)).To(Equal(body))
+			})
+
+			It("should not compress a response below the minimum size", func() {
+				request.Header.Set("Accept-Encoding", "gzip")
+				response = serveChain(request, MiddlewareCompress(), jsonHandler(`{"small":true}`))
+
+				Expect(response.Header().Get("Content-Encoding")).To(BeEmpty())
+				Expect(response.Body.String()).To(Equal(`{"small":true}`))
+			})
+
+			It("should not compress an incompressible content type", func() {
+				request.Header.Set("Accept-Encoding", "gzip")
+				response = serveChain(request, MiddlewareCompress(), func(rw http.ResponseWriter, r *http.Request) *Response {
+					rw.Header().Set("Content-Type", "image/png")
+					rw.Write([]byte(body))
+					return nil
+				})
+
+				Expect(response.Header().Get("Content-Encoding")).To(BeEmpty())
+				Expect(response.Body.String()).To(Equal(body))
+			})
+
+			It("should not re-encode an already encoded response", func() {
+				request.Header.Set("Accept-Encoding", "gzip")
+				response = serveChain(request, MiddlewareCompress(), func(rw http.ResponseWriter, r *http.Request) *Response {
+					rw.Header().Set("Content-Type", "application/json")
+					rw.Header().Set("Content-Encoding", "identity-ish")
+					rw.Write([]byte(body))
+					return nil
+				})
+
+				Expect(response.Header().Get("Content-Encoding")).To(Equal("identity-ish"))
+				Expect(response.Body.String()).To(Equal(body))
+			})
+
+			It("should compress rye error responses too", func() {
+				request.Header.Set("Accept-Encoding", "gzip")
+				response = serveChain(request, NewMiddlewareCompress(CompressConfig{MinSize: 1}), failureHandler)
+
+				Expect(response.Code).To(Equal(505))
+				Expect(response.Header().Get("Content-Encoding")).To(Equal("gzip"))
+			})
+
+			It("should start compressing on Flush", func() {
+				request.Header.Set("Accept-Encoding", "gzip")
+				response = serveChain(request, MiddlewareCompress(), func(rw http.ResponseWriter, r *http.Request) *Response {
+					rw.Header().Set("Content-Type", "text/event-stream")
+					rw.Write([]byte("data: 1\n\n"))
+					rw.(http.Flusher).Flush()
+
+					recorder := rw.(*compressWriter).ResponseWriter.(*httptest.ResponseRecorder)
+					Expect(recorder.Flushed).To(BeTrue())
+					Expect(recorder.Header().Get("Content-Encoding")).To(Equal("gzip"))
+
+					rw.Write([]byte("data: 2\n\n"))
+					return nil
+				})
+
+				gz, err := gzip.NewReader(response.Body)
+				Expect(err).ToNot(HaveOccurred())
+				decoded, _ := ioutil.ReadAll(gz)
+				Expect(string(decoded)).To(Equal("data: 1\n\ndata: 2\n\n"))
+			})
+		})
+
+		Context("when the client accepts brotli", func() {
+			It("should compress with brotli", func() {
+				request.Header.Set("Accept-Encoding", "br")
+				response = serveChain(request, MiddlewareCompress(), jsonHandler(body))
+
+				Expect(response.Header().Get("Content-Encoding")).To(Equal("br"))
+				decoded, err := ioutil.ReadAll(brotli.NewReader(response.Body))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(decoded)).To(Equal(body))
+			})
+		})
+
+		Context("when the client accepts zstd", func() {
+			It("should compress with zstd", func() {
+				request.Header.Set("Accept-Encoding", "zstd")
+				response = serveChain(request, MiddlewareCompress(), jsonHandler(body))
+
+				Expect(response.Header().Get("Content-Encoding")).To(Equal("zstd"))
+				dec, err := zstd.NewReader(bytes.NewReader(response.Body.Bytes()))
+				Expect(err).ToNot(HaveOccurred())
+				defer dec.Close()
+				decoded, err := ioutil.ReadAll(dec)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(decoded)).To(Equal(body))
+			})
+
+			It("should reuse its encoders across responses", func() {
+				request.Header.Set("Accept-Encoding", "zstd")
+				mw := MiddlewareCompress()
+
+				for i := 0; i < 3; i++ {
+					response = serveChain(request, mw, jsonHandler(body))
+
+					dec, err := zstd.NewReader(nil)
+					Expect(err).ToNot(HaveOccurred())
+					decoded, err := dec.DecodeAll(response.Body.Bytes(), nil)
+					dec.Close()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(string(decoded)).To(Equal(body))
+				}
+			})
+		})
+
+		Context("when the request is a HEAD request", func() {
+			It("should not compress", func() {
+				request.Method = "HEAD"
+				request.Header.Set("Accept-Encoding", "gzip")
+				resp := MiddlewareCompress()(response, request)
+				Expect(resp).To(BeNil())
+			})
+		})
+
+		Context("when combined with the static file middleware", func() {
+			var testPath string
+
+			BeforeEach(func() {
+				testPath, _ = os.Getwd()
+				request.URL, _ = url.Parse("/thisstuff")
+				request.Header.Set("Accept-Encoding", "gzip")
+			})
+
+			It("should compress the file and drop its Content-Length", func() {
+				response = serveChain(request,
+					NewMiddlewareCompress(CompressConfig{MinSize: 1}),
+					NewStaticFile(testPath+"/static-examples/dist/index.html"),
+				)
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(response.Header().Get("Content-Encoding")).To(Equal("gzip"))
+				Expect(response.Header().Get("Content-Length")).To(BeEmpty())
+
+				gz, err := gzip.NewReader(response.Body)
+				Expect(err).ToNot(HaveOccurred())
+				decoded, _ := ioutil.ReadAll(gz)
+				Expect(string(decoded)).To(ContainSubstring("Index.html"))
+			})
+
+			It("should not compress a range request", func() {
+				request.Header.Set("Range", "bytes=0-5")
+				response = serveChain(request,
+					NewMiddlewareCompress(CompressConfig{MinSize: 1}),
+					NewStaticFile(testPath+"/static-examples/dist/index.html"),
+				)
+
+				Expect(response.Code).To(Equal(http.StatusPartialContent))
+				Expect(response.Header().Get("Content-Encoding")).To(BeEmpty())
+				Expect(response.Body.Len()).To(Equal(6))
+			})
+		})
+	})
+})
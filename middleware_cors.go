@@ -1,7 +1,15 @@
 package rye
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cactus/go-statsd-client/statsd"
 )
 
 const (
@@ -11,27 +19,82 @@ const (
 	DEFAULT_CORS_ALLOW_HEADERS = "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Access-Token"
 )
 
+// CORSConfig is used to configure the CORS middleware.
+type CORSConfig struct {
+	// AllowOrigins lists the allowed origins. An entry can be an exact origin
+	// ("https://app.example.com"), a wildcard subdomain ("https://*.example.com")
+	// or "*" to allow any origin.
+	AllowOrigins []string
+
+	// AllowOriginPatterns are matched against the full request origin, as if
+	// they were anchored with ^ and $.
+	AllowOriginPatterns []*regexp.Regexp
+
+	// AllowOriginFunc allows for custom origin checks.
+	AllowOriginFunc func(origin string) bool
+
+	AllowMethods  []string
+	AllowHeaders  []string
+	ExposeHeaders []string
+
+	// AllowCredentials permits cookies and auth headers on cross-origin
+	// requests. The matched origin is echoed in that case, as browsers
+	// reject "*" for credentialed requests; it can't be combined with the
+	// "*" origin, which would let any site make credentialed reads.
+	AllowCredentials bool
+
+	// MaxAge is how long a preflight response may be cached for.
+	MaxAge time.Duration
+
+	// AllowPrivateNetwork answers Private Network Access preflights, sent by
+	// browsers when a public site calls a server on a private network.
+	AllowPrivateNetwork bool
+
+	// Statter, if set, receives a counter for every rejected cross-origin
+	// request (cors.rejected.origin, cors.rejected.method, cors.rejected.headers).
+	Statter  statsd.Statter
+	StatRate float32
+}
+
 type cors struct {
-	CORSAllowOrigin  string
 	CORSAllowMethods string
 	CORSAllowHeaders string
+
+	allowAll         bool
+	origins          map[string]bool
+	wildcards        []corsWildcard
+	patterns         []*regexp.Regexp
+	originFunc       func(string) bool
+	exposeHeaders    string
+	allowCredentials bool
+	maxAge           string
+
+	methods             map[string]bool
+	headers             map[string]bool
+	allowAllHeaders     bool
+	allowPrivateNetwork bool
+	statter             statsd.Statter
+	statRate            float32
+}
+
+// corsWildcard matches origins ending in suffix, with an optional scheme
+type corsWildcard struct {
+	scheme string
+	suffix string
 }
 
 // MiddlewareCORS is the struct to represent configuration of the CORS handler.
 func MiddlewareCORS() func(rw http.ResponseWriter, req *http.Request) *Response {
-	c := &cors{
-		CORSAllowOrigin:  DEFAULT_CORS_ALLOW_ORIGIN,
-		CORSAllowMethods: DEFAULT_CORS_ALLOW_METHODS,
-		CORSAllowHeaders: DEFAULT_CORS_ALLOW_HEADERS,
-	}
-
-	return c.handle
+	return NewMiddlewareCORS(DEFAULT_CORS_ALLOW_ORIGIN, DEFAULT_CORS_ALLOW_METHODS, DEFAULT_CORS_ALLOW_HEADERS)
 }
 
 /*
 NewMiddlewareCORS creates a new handler to support CORS functionality. You can use this middleware by specifying `rye.MiddlewareCORS()` or `rye.NewMiddlewareCORS(origin, methods, headers)`
 when defining your routes.
 
+The origin param can be "*" or a comma separated allow-list of origins, see
+`NewMiddlewareCORSWithConfig` for the accepted formats.
+
 Default CORS Values:
 
 	DEFAULT_CORS_ALLOW_ORIGIN**: "*"
@@ -57,18 +120,149 @@ OR:
 		})).Methods("PUT", "OPTIONS")
 */
 func NewMiddlewareCORS(origin, methods, headers string) func(rw http.ResponseWriter, req *http.Request) *Response {
+	// Without credentials the config can't be invalid
+	mw, _ := NewMiddlewareCORSWithConfig(CORSConfig{
+		AllowOrigins: splitHeaderList(origin),
+		AllowMethods: splitHeaderList(methods),
+		AllowHeaders: splitHeaderList(headers),
+	})
+
+	return mw
+}
+
+/*
+NewMiddlewareCORSWithConfig creates a new CORS handler which matches the request
+`Origin` against an allow-list. The allow-list is made up of:
+
+	AllowOrigins:        exact origins, wildcard subdomains ("https://*.example.com") or "*"
+	AllowOriginPatterns: regular expressions matched against the whole origin
+	AllowOriginFunc:     a custom check
+
+When an origin is allowed, it is echoed back in `Access-Control-Allow-Origin`
+(or "*" is sent if any origin is allowed) and
+`Vary: Origin` is set so that caches keep the responses apart. Requests from
+origins that are not allowed get no CORS headers at all, so browsers block them.
+
+A preflight is an OPTIONS request carrying `Access-Control-Request-Method`.
+Preflights from a disallowed origin, or asking for a method or headers that
+are not allowed, are rejected with a `403 Forbidden`. CORS-safelisted methods
+(GET, HEAD, POST) and headers never need to be listed. Any other OPTIONS
+request continues down the chain like a regular request.
+
+An error is returned if `AllowCredentials` is combined with the "*" origin.
+
+Example use case:
+
+	cors, err := rye.NewMiddlewareCORSWithConfig(rye.CORSConfig{
+		AllowOrigins:     []string{"https://app.example.com", "https://*.example.org"},
+		AllowMethods:     []string{"GET", "POST"},
+		AllowHeaders:     []string{"Content-Type", "Authorization"},
+		ExposeHeaders:    []string{"X-Request-Id"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	if err != nil {
+		log.Fatalf("Invalid CORS config: %v", err)
+	}
+
+	routes.Handle("/some/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			cors,
+			yourHandler,
+		})).Methods("GET", "POST", "OPTIONS")
+*/
+func NewMiddlewareCORSWithConfig(config CORSConfig) (func(rw http.ResponseWriter, req *http.Request) *Response, error) {
 	c := &cors{
-		CORSAllowOrigin:  origin,
-		CORSAllowMethods: methods,
-		CORSAllowHeaders: headers,
+		CORSAllowMethods: strings.Join(config.AllowMethods, ", "),
+		CORSAllowHeaders: strings.Join(config.AllowHeaders, ", "),
+
+		origins:          make(map[string]bool),
+		originFunc:       config.AllowOriginFunc,
+		exposeHeaders:    strings.Join(config.ExposeHeaders, ", "),
+		allowCredentials: config.AllowCredentials,
+
+		methods:             make(map[string]bool),
+		headers:             make(map[string]bool),
+		allowPrivateNetwork: config.AllowPrivateNetwork,
+		statter:             config.Statter,
+		statRate:            config.StatRate,
 	}
 
-	return c.handle
+	// CORS-safelisted methods and headers never need to be listed
+	for _, method := range []string{"GET", "HEAD", "POST"} {
+		c.methods[method] = true
+	}
+
+	for _, method := range config.AllowMethods {
+		c.methods[strings.ToUpper(strings.TrimSpace(method))] = true
+	}
+
+	for _, header := range []string{"accept", "accept-language", "content-language", "content-type"} {
+		c.headers[header] = true
+	}
+
+	for _, header := range config.AllowHeaders {
+		header = strings.ToLower(strings.TrimSpace(header))
+
+		// A wildcard is taken literally on credentialed requests
+		if header == "*" && !config.AllowCredentials {
+			c.allowAllHeaders = true
+		}
+
+		c.headers[header] = true
+	}
+
+	for _, origin := range config.AllowOrigins {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+
+		switch {
+		case origin == "*":
+			if config.AllowCredentials {
+				return nil, errors.New("CORS: the * origin can't be used with AllowCredentials")
+			}
+			c.allowAll = true
+
+		case strings.Contains(origin, "*."):
+			i := strings.Index(origin, "*.")
+			c.wildcards = append(c.wildcards, corsWildcard{
+				scheme: origin[:i],
+				suffix: origin[i+1:],
+			})
+
+		default:
+			c.origins[origin] = true
+		}
+	}
+
+	// Anchor the patterns, so that ie. `https://.*\.example\.com` can't match
+	// https://evil.example.com.attacker.net
+	for _, p := range config.AllowOriginPatterns {
+		anchored, err := regexp.Compile(`^(?:` + p.String() + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("CORS: invalid origin pattern %q: %v", p, err)
+		}
+
+		c.patterns = append(c.patterns, anchored)
+	}
+
+	if config.MaxAge > 0 {
+		c.maxAge = strconv.FormatInt(int64(config.MaxAge/time.Second), 10)
+	}
+
+	return c.handle, nil
 }
 
 // If `Origin` header gets passed, add required response headers for CORS support.
 // Return bool if `Origin` header was detected.
 func (c *cors) handle(rw http.ResponseWriter, req *http.Request) *Response {
+	h := rw.Header()
+
+	// The response depends on the origin unless we always send "*"
+	echo := !c.allowAll
+	if echo {
+		h.Add("Vary", "Origin")
+	}
+
 	origin := req.Header.Get("Origin")
 
 	// Origin header not provided, nothing for CORS to do
@@ -76,16 +270,133 @@ func (c *cors) handle(rw http.ResponseWriter, req *http.Request) *Response {
 		return nil
 	}
 
-	rw.Header().Set("Access-Control-Allow-Origin", c.CORSAllowOrigin)
-	rw.Header().Set("Access-Control-Allow-Methods", c.CORSAllowMethods)
-	rw.Header().Set("Access-Control-Allow-Headers", c.CORSAllowHeaders)
+	// A preflight is an OPTIONS request asking permission for a method
+	preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+
+	if !c.allowed(origin) {
+		c.reportRejection("origin")
+
+		if preflight {
+			return &Response{
+				Err:        errors.New("CORS preflight rejected: origin " + origin + " is not allowed"),
+				StatusCode: http.StatusForbidden,
+			}
+		}
+
+		return nil
+	}
+
+	if preflight {
+		if err := c.checkPreflight(req); err != nil {
+			return &Response{
+				Err:        err,
+				StatusCode: http.StatusForbidden,
+			}
+		}
+	}
+
+	if echo {
+		h.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+
+	if c.allowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	h.Set("Access-Control-Allow-Methods", c.CORSAllowMethods)
+	h.Set("Access-Control-Allow-Headers", c.CORSAllowHeaders)
 
 	// If this was a preflight request, stop further middleware execution
-	if req.Method == "OPTIONS" {
+	if preflight {
+		if c.maxAge != "" {
+			h.Set("Access-Control-Max-Age", c.maxAge)
+		}
+
+		if c.allowPrivateNetwork && req.Header.Get("Access-Control-Request-Private-Network") == "true" {
+			h.Set("Access-Control-Allow-Private-Network", "true")
+		}
+
 		return &Response{
 			StopExecution: true,
 		}
 	}
 
+	if c.exposeHeaders != "" {
+		h.Set("Access-Control-Expose-Headers", c.exposeHeaders)
+	}
+
+	return nil
+}
+
+// checkPreflight verifies the requested method and headers are allowed
+func (c *cors) checkPreflight(req *http.Request) error {
+	method := req.Header.Get("Access-Control-Request-Method")
+	if !c.methods[strings.ToUpper(method)] {
+		c.reportRejection("method")
+		return errors.New("CORS preflight rejected: method " + method + " is not allowed")
+	}
+
+	if c.allowAllHeaders {
+		return nil
+	}
+
+	for _, header := range splitHeaderList(req.Header.Get("Access-Control-Request-Headers")) {
+		if !c.headers[strings.ToLower(header)] {
+			c.reportRejection("headers")
+			return errors.New("CORS preflight rejected: header " + header + " is not allowed")
+		}
+	}
+
 	return nil
 }
+
+func (c *cors) reportRejection(reason string) {
+	if c.statter == nil {
+		return
+	}
+
+	go c.statter.Inc("cors.rejected."+reason, 1, c.statRate)
+}
+
+// allowed checks the origin against the allow-list
+func (c *cors) allowed(origin string) bool {
+	if c.allowAll {
+		return true
+	}
+
+	lower := strings.ToLower(origin)
+
+	if c.origins[lower] {
+		return true
+	}
+
+	for _, w := range c.wildcards {
+		if strings.HasPrefix(lower, w.scheme) && strings.HasSuffix(lower, w.suffix) &&
+			len(lower) > len(w.scheme)+len(w.suffix) {
+			return true
+		}
+	}
+
+	for _, p := range c.patterns {
+		if p.MatchString(origin) {
+			return true
+		}
+	}
+
+	return c.originFunc != nil && c.originFunc(origin)
+}
+
+// splitHeaderList splits a comma separated header value into its elements
+func splitHeaderList(list string) []string {
+	var elements []string
+
+	for _, e := range strings.Split(list, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			elements = append(elements, e)
+		}
+	}
+
+	return elements
+}
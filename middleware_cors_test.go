@@ -3,6 +3,10 @@ package rye
 import (
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"time"
+
+	"github.com/InVisionApp/rye/fakes/statsdfakes"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -22,6 +26,12 @@ var _ = Describe("CORS Middleware", func() {
 		}
 	})
 
+	newCORS := func(config CORSConfig) Handler {
+		mw, err := NewMiddlewareCORSWithConfig(config)
+		Expect(err).ToNot(HaveOccurred())
+		return mw
+	}
+
 	Describe("handle", func() {
 		Context("when origin header is not set", func() {
 			It("should return nil", func() {
@@ -65,12 +75,261 @@ var _ = Describe("CORS Middleware", func() {
 				It("should return a response with StopExecution", func() {
 					request.Method = "OPTIONS"
 					request.Header.Add("Origin", "*.invisionapp.com")
+					request.Header.Add("Access-Control-Request-Method", "PUT")
 					resp := MiddlewareCORS()(response, request)
 
 					Expect(resp).ToNot(BeNil())
 					Expect(resp.StopExecution).To(BeTrue())
 				})
 			})
+
+			Context("and we got an OPTIONS request which is not a preflight", func() {
+				It("should continue the chain", func() {
+					request.Method = "OPTIONS"
+					request.Header.Add("Origin", "*.invisionapp.com")
+					resp := MiddlewareCORS()(response, request)
+
+					Expect(resp).To(BeNil())
+					Expect(response.Header().Get("Access-Control-Allow-Origin")).To(Equal(DEFAULT_CORS_ALLOW_ORIGIN))
+				})
+			})
+		})
+
+		Context("when CORS was instantiated with a config", func() {
+			var config CORSConfig
+
+			BeforeEach(func() {
+				config = CORSConfig{
+					AllowOrigins:        []string{"https://app.example.com", "https://*.example.org"},
+					AllowOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`^https://pr-\d+\.preview\.dev$`)},
+					AllowMethods:        []string{"GET", "POST"},
+					AllowHeaders:        []string{"Content-Type"},
+					ExposeHeaders:       []string{"X-Request-Id", "X-Total"},
+				}
+			})
+
+			It("should echo an exact origin and set Vary", func() {
+				request.Header.Add("Origin", "https://app.example.com")
+				resp := newCORS(config)(response, request)
+
+				Expect(resp).To(BeNil())
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://app.example.com"))
+				Expect(response.Header().Get("Access-Control-Allow-Methods")).To(Equal("GET, POST"))
+				Expect(response.Header().Get("Access-Control-Expose-Headers")).To(Equal("X-Request-Id, X-Total"))
+				Expect(response.Header().Get("Vary")).To(Equal("Origin"))
+				Expect(response.Header().Get("Access-Control-Allow-Credentials")).To(BeEmpty())
+			})
+
+			It("should match a wildcard subdomain", func() {
+				request.Header.Add("Origin", "https://api.eu.example.org")
+				newCORS(config)(response, request)
+
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://api.eu.example.org"))
+			})
+
+			It("should not match the wildcard's bare domain or another scheme", func() {
+				request.Header.Add("Origin", "https://example.org")
+				newCORS(config)(response, request)
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+
+				response = httptest.NewRecorder()
+				request.Header.Set("Origin", "http://api.example.org")
+				newCORS(config)(response, request)
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+			})
+
+			It("should match a regex pattern", func() {
+				request.Header.Add("Origin", "https://pr-42.preview.dev")
+				newCORS(config)(response, request)
+
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://pr-42.preview.dev"))
+			})
+
+			It("should match a regex pattern against the whole origin", func() {
+				config.AllowOriginPatterns = []*regexp.Regexp{regexp.MustCompile(`https://.*\.example\.com`)}
+				request.Header.Add("Origin", "https://evil.example.com.attacker.net")
+				newCORS(config)(response, request)
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+
+				response = httptest.NewRecorder()
+				request.Header.Set("Origin", "https://app.example.com")
+				newCORS(config)(response, request)
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://app.example.com"))
+			})
+
+			It("should match with a custom func", func() {
+				config.AllowOriginFunc = func(origin string) bool { return origin == "https://custom.io" }
+				request.Header.Add("Origin", "https://custom.io")
+				newCORS(config)(response, request)
+
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://custom.io"))
+			})
+
+			It("should set no CORS headers for a disallowed origin", func() {
+				request.Header.Add("Origin", "https://evil.com")
+				resp := newCORS(config)(response, request)
+
+				Expect(resp).To(BeNil())
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+				Expect(response.Header().Get("Access-Control-Allow-Methods")).To(BeEmpty())
+				Expect(response.Header().Get("Vary")).To(Equal("Origin"))
+			})
+
+			It("should echo the origin when credentials are allowed", func() {
+				config.AllowCredentials = true
+				request.Header.Add("Origin", "https://app.example.com")
+				newCORS(config)(response, request)
+
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://app.example.com"))
+				Expect(response.Header().Get("Access-Control-Allow-Credentials")).To(Equal("true"))
+				Expect(response.Header().Get("Vary")).To(Equal("Origin"))
+			})
+
+			It("should refuse credentials for any origin", func() {
+				config.AllowOrigins = []string{"https://app.example.com", "*"}
+				config.AllowCredentials = true
+
+				_, err := NewMiddlewareCORSWithConfig(config)
+				Expect(err).To(MatchError("CORS: the * origin can't be used with AllowCredentials"))
+			})
+
+			It("should set Max-Age on preflight requests", func() {
+				config.MaxAge = 10 * time.Minute
+				request.Method = "OPTIONS"
+				request.Header.Add("Origin", "https://app.example.com")
+				request.Header.Add("Access-Control-Request-Method", "POST")
+				resp := newCORS(config)(response, request)
+
+				Expect(resp.StopExecution).To(BeTrue())
+				Expect(response.Header().Get("Access-Control-Max-Age")).To(Equal("600"))
+				Expect(response.Header().Get("Access-Control-Expose-Headers")).To(BeEmpty())
+			})
+		})
+
+		Context("when CORS was instantiated with an origin list", func() {
+			It("should only echo listed origins", func() {
+				mw := NewMiddlewareCORS("https://a.com, https://b.com", "GET", "")
+
+				request.Header.Add("Origin", "https://b.com")
+				mw(response, request)
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://b.com"))
+
+				response = httptest.NewRecorder()
+				request.Header.Set("Origin", "https://c.com")
+				mw(response, request)
+				Expect(response.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+			})
+		})
+
+		Context("when validating a preflight request", func() {
+			var (
+				config      CORSConfig
+				fakeStatter *statsdfakes.FakeStatter
+				inc         chan string
+			)
+
+			BeforeEach(func() {
+				fakeStatter = &statsdfakes.FakeStatter{}
+				// Each spec's stub sends to its own channel
+				ch := make(chan string, 1)
+				inc = ch
+				fakeStatter.IncStub = func(name string, value int64, rate float32) error {
+					ch <- name
+					return nil
+				}
+
+				config = CORSConfig{
+					AllowOrigins: []string{"https://app.example.com"},
+					AllowMethods: []string{"PUT", "DELETE"},
+					AllowHeaders: []string{"Authorization", "X-Custom"},
+					Statter:      fakeStatter,
+					StatRate:     1,
+				}
+
+				request.Method = "OPTIONS"
+				request.Header.Set("Origin", "https://app.example.com")
+			})
+
+			It("should allow a listed method and headers", func() {
+				request.Header.Set("Access-Control-Request-Method", "DELETE")
+				request.Header.Set("Access-Control-Request-Headers", "authorization, x-custom, content-type")
+				resp := newCORS(config)(response, request)
+
+				Expect(resp.StopExecution).To(BeTrue())
+				Expect(resp.Err).To(BeNil())
+			})
+
+			It("should allow safelisted methods without listing them", func() {
+				request.Header.Set("Access-Control-Request-Method", "POST")
+				resp := newCORS(config)(response, request)
+
+				Expect(resp.StopExecution).To(BeTrue())
+			})
+
+			It("should reject a method which is not allowed", func() {
+				request.Header.Set("Access-Control-Request-Method", "PATCH")
+				resp := newCORS(config)(response, request)
+
+				Expect(resp.Err).To(HaveOccurred())
+				Expect(resp.Error()).To(ContainSubstring("method PATCH is not allowed"))
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+				Eventually(inc).Should(Receive(Equal("cors.rejected.method")))
+			})
+
+			It("should reject a header which is not allowed", func() {
+				request.Header.Set("Access-Control-Request-Method", "PUT")
+				request.Header.Set("Access-Control-Request-Headers", "authorization, x-secret")
+				resp := newCORS(config)(response, request)
+
+				Expect(resp.Error()).To(ContainSubstring("header x-secret is not allowed"))
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+				Eventually(inc).Should(Receive(Equal("cors.rejected.headers")))
+			})
+
+			It("should allow any header with a wildcard", func() {
+				config.AllowHeaders = []string{"*"}
+				request.Header.Set("Access-Control-Request-Method", "PUT")
+				request.Header.Set("Access-Control-Request-Headers", "x-anything")
+				resp := newCORS(config)(response, request)
+
+				Expect(resp.StopExecution).To(BeTrue())
+			})
+
+			It("should reject a disallowed origin", func() {
+				request.Header.Set("Origin", "https://evil.com")
+				request.Header.Set("Access-Control-Request-Method", "GET")
+				resp := newCORS(config)(response, request)
+
+				Expect(resp.Error()).To(ContainSubstring("origin https://evil.com is not allowed"))
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+				Eventually(inc).Should(Receive(Equal("cors.rejected.origin")))
+			})
+
+			It("should count a disallowed origin on a regular request", func() {
+				request.Method = "GET"
+				request.Header.Set("Origin", "https://evil.com")
+				resp := newCORS(config)(response, request)
+
+				Expect(resp).To(BeNil())
+				Eventually(inc).Should(Receive(Equal("cors.rejected.origin")))
+			})
+
+			It("should answer private network requests when allowed", func() {
+				config.AllowPrivateNetwork = true
+				request.Header.Set("Access-Control-Request-Method", "GET")
+				request.Header.Set("Access-Control-Request-Private-Network", "true")
+				newCORS(config)(response, request)
+
+				Expect(response.Header().Get("Access-Control-Allow-Private-Network")).To(Equal("true"))
+			})
+
+			It("should not answer private network requests by default", func() {
+				request.Header.Set("Access-Control-Request-Method", "GET")
+				request.Header.Set("Access-Control-Request-Private-Network", "true")
+				newCORS(config)(response, request)
+
+				Expect(response.Header().Get("Access-Control-Allow-Private-Network")).To(BeEmpty())
+			})
 		})
 	})
 })
@@ -0,0 +1,499 @@
+package rye
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CSRF specific constants
+	CSRF_MODE_DOUBLE_SUBMIT = "double-submit"
+	CSRF_MODE_SYNCHRONIZER  = "synchronizer"
+
+	DEFAULT_CSRF_COOKIE_NAME         = "_csrf"
+	DEFAULT_CSRF_SESSION_COOKIE_NAME = "_csrf_session"
+	DEFAULT_CSRF_HEADER_NAME         = "X-CSRF-Token"
+	DEFAULT_CSRF_FIELD_NAME          = "csrf_token"
+	DEFAULT_CSRF_TOKEN_TTL           = 12 * time.Hour
+	DEFAULT_CSRF_MAX_TOKENS          = 100000
+
+	CONTEXT_CSRF_TOKEN = "rye-middlewarecsrf-token"
+)
+
+var defaultCSRFExemptAuthSchemes = []string{"Bearer"}
+
+// CSRFTokenStore keeps server-side tokens for the synchronizer token pattern.
+// Implementations must be safe for concurrent use.
+type CSRFTokenStore interface {
+	Get(sessionID string) (string, bool)
+	Set(sessionID, token string)
+}
+
+// CSRFConfig is used to configure the CSRF middleware. Any zero value field
+// falls back to its default.
+type CSRFConfig struct {
+	// Mode is either CSRF_MODE_DOUBLE_SUBMIT (default) or CSRF_MODE_SYNCHRONIZER
+	Mode string
+
+	// HeaderName and FieldName are where the token is looked for on unsafe
+	// requests; the header first, then the form field.
+	HeaderName string
+	FieldName  string
+
+	// CookieName is the token cookie in double-submit mode and the session
+	// cookie in synchronizer mode (when SessionID is not set).
+	CookieName     string
+	CookieDomain   string
+	CookiePath     string
+	CookieSecure   bool
+	CookieSameSite http.SameSite
+
+	// SessionID returns the session a synchronizer token is bound to. If nil,
+	// rye manages its own HttpOnly session cookie.
+	SessionID func(*http.Request) string
+
+	// Store keeps synchronizer tokens; defaults to an in-memory store with
+	// the default TTL and size bound, see `NewMemoryCSRFTokenStore`.
+	Store CSRFTokenStore
+
+	// TrustedOrigins lists the origins, other than the request's own host,
+	// allowed to make unsafe requests, ie. "https://app.example.com".
+	TrustedOrigins []string
+
+	// RequireOrigin rejects unsafe requests carrying neither an Origin nor
+	// a Referer header.
+	RequireOrigin bool
+
+	// Requests using one of ExemptAuthSchemes in their Authorization header
+	// or carrying any of ExemptHeaders are not subject to CSRF checks, as a
+	// browser won't attach those on its own. Exempt allows for custom rules.
+	ExemptAuthSchemes []string
+	ExemptHeaders     []string
+	Exempt            func(*http.Request) bool
+}
+
+type csrf struct {
+	config CSRFConfig
+}
+
+// MiddlewareCSRF creates a CSRF handler using the double-submit cookie pattern
+// with the default config.
+func MiddlewareCSRF() func(rw http.ResponseWriter, req *http.Request) *Response {
+	return NewMiddlewareCSRF(CSRFConfig{})
+}
+
+/*
+NewMiddlewareCSRF creates a new handler to protect cookie-authenticated routes
+against cross-site request forgery.
+
+Two patterns are supported:
+
+	CSRF_MODE_DOUBLE_SUBMIT: the token is kept in a cookie which the client must
+	                         echo back in the header or form field.
+	CSRF_MODE_SYNCHRONIZER:  the token is kept server-side in a CSRFTokenStore,
+	                         bound to the session, and must be sent back in the
+	                         header or form field.
+
+Safe requests (GET, HEAD, OPTIONS, TRACE) are issued a token, which is put in
+the context for use by later handlers (see `CSRFToken`), ie. to render it
+into a form or a meta tag.
+
+Unsafe requests must pass an `Origin` (or `Referer`) check against the
+request host and `TrustedOrigins`, and must then carry a valid token. Failing
+either results in a `403 Forbidden`.
+
+API clients authenticating with a token rather than a cookie are exempt; by
+default any request with a `Bearer` Authorization header.
+
+Default CSRF values:
+
+	Mode:              CSRF_MODE_DOUBLE_SUBMIT
+	HeaderName:        "X-CSRF-Token"
+	FieldName:         "csrf_token"
+	CookieName:        "_csrf" ("_csrf_session" in synchronizer mode)
+	CookiePath:        "/"
+	CookieSameSite:    http.SameSiteLaxMode
+	ExemptAuthSchemes: "Bearer"
+
+Example use case:
+
+	routes.Handle("/some/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			rye.MiddlewareCSRF(), // double-submit cookie with defaults
+			yourHandler,
+		})).Methods("GET", "POST")
+
+OR:
+
+	routes.Handle("/some/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareCSRF(rye.CSRFConfig{
+				Mode:           rye.CSRF_MODE_SYNCHRONIZER,
+				SessionID:      yourSessionIDFunc,
+				TrustedOrigins: []string{"https://app.example.com"},
+				CookieSecure:   true,
+			}),
+			yourHandler,
+		})).Methods("GET", "POST")
+*/
+func NewMiddlewareCSRF(config CSRFConfig) func(rw http.ResponseWriter, req *http.Request) *Response {
+	if config.Mode == "" {
+		config.Mode = CSRF_MODE_DOUBLE_SUBMIT
+	}
+
+	if config.HeaderName == "" {
+		config.HeaderName = DEFAULT_CSRF_HEADER_NAME
+	}
+
+	if config.FieldName == "" {
+		config.FieldName = DEFAULT_CSRF_FIELD_NAME
+	}
+
+	if config.CookieName == "" {
+		config.CookieName = DEFAULT_CSRF_COOKIE_NAME
+		if config.Mode == CSRF_MODE_SYNCHRONIZER {
+			config.CookieName = DEFAULT_CSRF_SESSION_COOKIE_NAME
+		}
+	}
+
+	if config.CookiePath == "" {
+		config.CookiePath = "/"
+	}
+
+	if config.CookieSameSite == 0 {
+		config.CookieSameSite = http.SameSiteLaxMode
+	}
+
+	if config.Store == nil {
+		config.Store = NewMemoryCSRFTokenStore(0, 0)
+	}
+
+	if config.ExemptAuthSchemes == nil {
+		config.ExemptAuthSchemes = defaultCSRFExemptAuthSchemes
+	}
+
+	c := &csrf{config: config}
+	return c.handle
+}
+
+/*
+CSRFToken returns the CSRF token the middleware placed in the request context,
+or an empty string if there is none.
+
+	func formHandler(rw http.ResponseWriter, r *http.Request) *rye.Response {
+		tmpl.Execute(rw, map[string]string{"csrf": rye.CSRFToken(r)})
+		return nil
+	}
+*/
+func CSRFToken(r *http.Request) string {
+	token, _ := r.Context().Value(CONTEXT_CSRF_TOKEN).(string)
+	return token
+}
+
+func (c *csrf) handle(rw http.ResponseWriter, r *http.Request) *Response {
+	if c.exempt(r) {
+		return nil
+	}
+
+	// Vary on Cookie as the token (and so the page) differs per client
+	rw.Header().Add("Vary", "Cookie")
+
+	if !isSafeMethod(r.Method) {
+		if err := c.checkOrigin(r); err != nil {
+			return &Response{
+				Err:        err,
+				StatusCode: http.StatusForbidden,
+			}
+		}
+
+		if err := c.checkToken(r); err != nil {
+			return &Response{
+				Err:        err,
+				StatusCode: http.StatusForbidden,
+			}
+		}
+	}
+
+	token, err := c.issueToken(rw, r)
+	if err != nil {
+		return &Response{
+			Err:        err,
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	return &Response{
+		Context: context.WithValue(r.Context(), CONTEXT_CSRF_TOKEN, token),
+	}
+}
+
+func (c *csrf) exempt(r *http.Request) bool {
+	if c.config.Exempt != nil && c.config.Exempt(r) {
+		return true
+	}
+
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		for _, scheme := range c.config.ExemptAuthSchemes {
+			if len(auth) > len(scheme) && strings.EqualFold(auth[:len(scheme)+1], scheme+" ") {
+				return true
+			}
+		}
+	}
+
+	for _, h := range c.config.ExemptHeaders {
+		if r.Header.Get(h) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkOrigin verifies the Origin header, or the Referer when it is absent,
+// against the request host and the trusted origins.
+func (c *csrf) checkOrigin(r *http.Request) error {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+
+	if source == "" {
+		if c.config.RequireOrigin {
+			return errors.New("forbidden: missing Origin and Referer headers")
+		}
+		return nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return errors.New("forbidden: invalid request origin")
+	}
+
+	if u.Host == r.Host {
+		return nil
+	}
+
+	origin := u.Scheme + "://" + u.Host
+	for _, trusted := range c.config.TrustedOrigins {
+		if strings.EqualFold(trusted, origin) {
+			return nil
+		}
+	}
+
+	return errors.New("forbidden: cross-origin request from " + origin)
+}
+
+func (c *csrf) checkToken(r *http.Request) error {
+	sent := r.Header.Get(c.config.HeaderName)
+	if sent == "" {
+		sent = r.PostFormValue(c.config.FieldName)
+	}
+
+	if sent == "" {
+		return errors.New("forbidden: missing CSRF token")
+	}
+
+	expected, ok := c.currentToken(r)
+	if !ok || subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) != 1 {
+		return errors.New("forbidden: invalid CSRF token")
+	}
+
+	return nil
+}
+
+// currentToken returns the token the client was issued, if any
+func (c *csrf) currentToken(r *http.Request) (string, bool) {
+	if c.config.Mode == CSRF_MODE_SYNCHRONIZER {
+		session := c.sessionID(r)
+		if session == "" {
+			return "", false
+		}
+		return c.config.Store.Get(session)
+	}
+
+	cookie, err := r.Cookie(c.config.CookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+
+	return cookie.Value, true
+}
+
+// issueToken returns the client's current token, creating one if needed
+func (c *csrf) issueToken(rw http.ResponseWriter, r *http.Request) (string, error) {
+	if token, ok := c.currentToken(r); ok {
+		return token, nil
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	if c.config.Mode != CSRF_MODE_SYNCHRONIZER {
+		// Readable by scripts so they can echo it in the header
+		c.setCookie(rw, token, false)
+		return token, nil
+	}
+
+	session := c.sessionID(r)
+	if session == "" {
+		if session, err = randomToken(); err != nil {
+			return "", err
+		}
+		c.setCookie(rw, session, true)
+	}
+
+	c.config.Store.Set(session, token)
+	return token, nil
+}
+
+func (c *csrf) sessionID(r *http.Request) string {
+	if c.config.SessionID != nil {
+		return c.config.SessionID(r)
+	}
+
+	cookie, err := r.Cookie(c.config.CookieName)
+	if err != nil {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+func (c *csrf) setCookie(rw http.ResponseWriter, value string, httpOnly bool) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     c.config.CookieName,
+		Value:    value,
+		Domain:   c.config.CookieDomain,
+		Path:     c.config.CookiePath,
+		Secure:   c.config.CookieSecure,
+		SameSite: c.config.CookieSameSite,
+		HttpOnly: httpOnly,
+	})
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/*******************
+ In-memory token store
+*******************/
+
+type memoryCSRFTokenStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	maxTokens int
+	now       func() time.Time
+
+	// ll is ordered from the most to the least recently set token, which
+	// is also the order they expire in
+	ll     *list.List
+	tokens map[string]*list.Element
+}
+
+type memoryCSRFToken struct {
+	sessionID string
+	token     string
+	expires   time.Time
+}
+
+/*
+NewMemoryCSRFTokenStore creates an in-memory CSRFTokenStore. Tokens expire
+ttl after they were set, and once the store holds maxTokens the oldest is
+evicted, so clients without a session can't grow it without bound. Zero
+values fall back to DEFAULT_CSRF_TOKEN_TTL and DEFAULT_CSRF_MAX_TOKENS.
+
+An evicted token fails the next unsafe request of its session, and a new one
+is issued on its next safe request; use a shared store in a multi-instance
+deployment.
+*/
+func NewMemoryCSRFTokenStore(ttl time.Duration, maxTokens int) CSRFTokenStore {
+	if ttl <= 0 {
+		ttl = DEFAULT_CSRF_TOKEN_TTL
+	}
+
+	if maxTokens <= 0 {
+		maxTokens = DEFAULT_CSRF_MAX_TOKENS
+	}
+
+	return &memoryCSRFTokenStore{
+		ttl:       ttl,
+		maxTokens: maxTokens,
+		now:       time.Now,
+		ll:        list.New(),
+		tokens:    make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryCSRFTokenStore) Get(sessionID string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.tokens[sessionID]
+	if !ok {
+		return "", false
+	}
+
+	entry := el.Value.(*memoryCSRFToken)
+	if !m.now().Before(entry.expires) {
+		m.remove(el)
+		return "", false
+	}
+
+	return entry.token, true
+}
+
+func (m *memoryCSRFTokenStore) Set(sessionID, token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+
+	if el, ok := m.tokens[sessionID]; ok {
+		m.remove(el)
+	}
+
+	m.tokens[sessionID] = m.ll.PushFront(&memoryCSRFToken{
+		sessionID: sessionID,
+		token:     token,
+		expires:   now.Add(m.ttl),
+	})
+
+	// Drop the expired tokens, then the oldest ones over the limit
+	for oldest := m.ll.Back(); oldest != nil; oldest = m.ll.Back() {
+		if m.ll.Len() <= m.maxTokens && now.Before(oldest.Value.(*memoryCSRFToken).expires) {
+			break
+		}
+		m.remove(oldest)
+	}
+}
+
+func (m *memoryCSRFTokenStore) remove(el *list.Element) {
+	m.ll.Remove(el)
+	delete(m.tokens, el.Value.(*memoryCSRFToken).sessionID)
+}
@@ -0,0 +1,279 @@
+package rye
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CSRF Middleware", func() {
+
+	var (
+		request  *http.Request
+		response *httptest.ResponseRecorder
+		csrfMW   Handler
+	)
+
+	// issue performs a safe request and returns the issued token and cookie
+	issue := func() (string, *http.Cookie) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://example.com/form", nil)
+		resp := csrfMW(rec, req)
+		Expect(resp).ToNot(BeNil())
+		Expect(resp.Context).ToNot(BeNil())
+
+		cookies := rec.Result().Cookies()
+		Expect(cookies).To(HaveLen(1))
+
+		return CSRFToken(req.WithContext(resp.Context)), cookies[0]
+	}
+
+	BeforeEach(func() {
+		response = httptest.NewRecorder()
+		request = httptest.NewRequest("POST", "http://example.com/form", nil)
+		csrfMW = MiddlewareCSRF()
+	})
+
+	Describe("handle", func() {
+		Context("when a safe request is made", func() {
+			It("should issue a token in a cookie and the context", func() {
+				token, cookie := issue()
+				Expect(token).ToNot(BeEmpty())
+				Expect(cookie.Name).To(Equal(DEFAULT_CSRF_COOKIE_NAME))
+				Expect(cookie.Value).To(Equal(token))
+				Expect(cookie.HttpOnly).To(BeFalse())
+				Expect(cookie.SameSite).To(Equal(http.SameSiteLaxMode))
+			})
+
+			It("should reuse an existing token", func() {
+				token, cookie := issue()
+
+				req := httptest.NewRequest("GET", "http://example.com/form", nil)
+				req.AddCookie(cookie)
+				resp := csrfMW(response, req)
+
+				Expect(CSRFToken(req.WithContext(resp.Context))).To(Equal(token))
+				Expect(response.Result().Cookies()).To(BeEmpty())
+			})
+		})
+
+		Context("when using the double-submit pattern", func() {
+			It("should accept a matching header token", func() {
+				token, cookie := issue()
+				request.AddCookie(cookie)
+				request.Header.Set("X-CSRF-Token", token)
+
+				resp := csrfMW(response, request)
+				Expect(resp.Err).To(BeNil())
+				Expect(resp.Context).ToNot(BeNil())
+			})
+
+			It("should accept a matching form token", func() {
+				token, cookie := issue()
+				request = httptest.NewRequest("POST", "http://example.com/form",
+					strings.NewReader(url.Values{"csrf_token": {token}}.Encode()))
+				request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				request.AddCookie(cookie)
+
+				resp := csrfMW(response, request)
+				Expect(resp.Err).To(BeNil())
+			})
+
+			It("should reject a missing token", func() {
+				_, cookie := issue()
+				request.AddCookie(cookie)
+
+				resp := csrfMW(response, request)
+				Expect(resp.Err).To(HaveOccurred())
+				Expect(resp.Error()).To(ContainSubstring("missing CSRF token"))
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			})
+
+			It("should reject a mismatched token", func() {
+				_, cookie := issue()
+				request.AddCookie(cookie)
+				request.Header.Set("X-CSRF-Token", "forged")
+
+				resp := csrfMW(response, request)
+				Expect(resp.Error()).To(ContainSubstring("invalid CSRF token"))
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			})
+
+			It("should reject a token without its cookie", func() {
+				request.Header.Set("X-CSRF-Token", "anything")
+
+				resp := csrfMW(response, request)
+				Expect(resp.Error()).To(ContainSubstring("invalid CSRF token"))
+			})
+		})
+
+		Context("when using the synchronizer pattern", func() {
+			var store CSRFTokenStore
+
+			BeforeEach(func() {
+				store = NewMemoryCSRFTokenStore(0, 0)
+				csrfMW = NewMiddlewareCSRF(CSRFConfig{
+					Mode:  CSRF_MODE_SYNCHRONIZER,
+					Store: store,
+				})
+			})
+
+			It("should bind the token to an HttpOnly session cookie", func() {
+				token, cookie := issue()
+				Expect(cookie.Name).To(Equal(DEFAULT_CSRF_SESSION_COOKIE_NAME))
+				Expect(cookie.HttpOnly).To(BeTrue())
+				Expect(cookie.Value).ToNot(Equal(token))
+
+				stored, ok := store.Get(cookie.Value)
+				Expect(ok).To(BeTrue())
+				Expect(stored).To(Equal(token))
+			})
+
+			It("should accept the session's token", func() {
+				token, cookie := issue()
+				request.AddCookie(cookie)
+				request.Header.Set("X-CSRF-Token", token)
+
+				resp := csrfMW(response, request)
+				Expect(resp.Err).To(BeNil())
+			})
+
+			It("should reject the session cookie value as a token", func() {
+				_, cookie := issue()
+				request.AddCookie(cookie)
+				request.Header.Set("X-CSRF-Token", cookie.Value)
+
+				resp := csrfMW(response, request)
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			})
+
+			It("should use a custom session ID func", func() {
+				csrfMW = NewMiddlewareCSRF(CSRFConfig{
+					Mode:      CSRF_MODE_SYNCHRONIZER,
+					Store:     store,
+					SessionID: func(r *http.Request) string { return r.Header.Get("X-Session") },
+				})
+				store.Set("session-1", "token-1")
+
+				request.Header.Set("X-Session", "session-1")
+				request.Header.Set("X-CSRF-Token", "token-1")
+
+				resp := csrfMW(response, request)
+				Expect(resp.Err).To(BeNil())
+			})
+		})
+
+		Describe("NewMemoryCSRFTokenStore", func() {
+			var (
+				store *memoryCSRFTokenStore
+				now   time.Time
+			)
+
+			BeforeEach(func() {
+				now = time.Now()
+				store = NewMemoryCSRFTokenStore(time.Hour, 2).(*memoryCSRFTokenStore)
+				store.now = func() time.Time { return now }
+			})
+
+			It("should expire tokens", func() {
+				store.Set("session-1", "token-1")
+
+				now = now.Add(time.Hour)
+				_, ok := store.Get("session-1")
+				Expect(ok).To(BeFalse())
+				Expect(store.tokens).To(BeEmpty())
+			})
+
+			It("should evict the oldest tokens over the limit", func() {
+				store.Set("session-1", "token-1")
+				store.Set("session-2", "token-2")
+				store.Set("session-1", "token-1b")
+				store.Set("session-3", "token-3")
+
+				_, ok := store.Get("session-2")
+				Expect(ok).To(BeFalse())
+				token, _ := store.Get("session-1")
+				Expect(token).To(Equal("token-1b"))
+				token, _ = store.Get("session-3")
+				Expect(token).To(Equal("token-3"))
+			})
+		})
+
+		Context("when checking the origin", func() {
+			var token string
+
+			BeforeEach(func() {
+				csrfMW = NewMiddlewareCSRF(CSRFConfig{
+					TrustedOrigins: []string{"https://app.example.com"},
+				})
+
+				var cookie *http.Cookie
+				token, cookie = issue()
+				request.AddCookie(cookie)
+				request.Header.Set("X-CSRF-Token", token)
+			})
+
+			It("should accept the same host", func() {
+				request.Header.Set("Origin", "http://example.com")
+				Expect(csrfMW(response, request).Err).To(BeNil())
+			})
+
+			It("should accept a trusted origin", func() {
+				request.Header.Set("Origin", "https://app.example.com")
+				Expect(csrfMW(response, request).Err).To(BeNil())
+			})
+
+			It("should reject an untrusted origin", func() {
+				request.Header.Set("Origin", "https://evil.com")
+
+				resp := csrfMW(response, request)
+				Expect(resp.Error()).To(ContainSubstring("cross-origin request from https://evil.com"))
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			})
+
+			It("should fall back to the Referer", func() {
+				request.Header.Set("Referer", "https://evil.com/page")
+
+				resp := csrfMW(response, request)
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			})
+
+			It("should reject a missing origin when required", func() {
+				csrfMW = NewMiddlewareCSRF(CSRFConfig{RequireOrigin: true})
+
+				resp := csrfMW(response, request)
+				Expect(resp.Error()).To(ContainSubstring("missing Origin and Referer"))
+			})
+		})
+
+		Context("when the request is token-authenticated", func() {
+			It("should exempt Bearer auth", func() {
+				request.Header.Set("Authorization", "Bearer abc")
+				Expect(csrfMW(response, request)).To(BeNil())
+			})
+
+			It("should not exempt Basic auth", func() {
+				request.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+				Expect(csrfMW(response, request).StatusCode).To(Equal(http.StatusForbidden))
+			})
+
+			It("should exempt configured headers", func() {
+				csrfMW = NewMiddlewareCSRF(CSRFConfig{ExemptHeaders: []string{"X-Access-Token"}})
+				request.Header.Set("X-Access-Token", "abc")
+				Expect(csrfMW(response, request)).To(BeNil())
+			})
+
+			It("should exempt via a custom func", func() {
+				csrfMW = NewMiddlewareCSRF(CSRFConfig{
+					Exempt: func(r *http.Request) bool { return r.URL.Path == "/form" },
+				})
+				Expect(csrfMW(response, request)).To(BeNil())
+			})
+		})
+	})
+})
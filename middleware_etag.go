@@ -0,0 +1,234 @@
+package rye
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type etag struct {
+	weak bool
+}
+
+// MiddlewareETag creates an ETag handler that generates strong ETags.
+func MiddlewareETag() func(rw http.ResponseWriter, req *http.Request) *Response {
+	return NewMiddlewareETag(false)
+}
+
+/*
+NewMiddlewareETag creates a new handler which adds conditional GET support to
+dynamic responses. It buffers the body written by the rest of the chain,
+computes an ETag from it (unless the handler already set one) and answers a
+matching `If-None-Match` with a `304 Not Modified`. When the handler sets a
+`Last-Modified` header, `If-Modified-Since` is honoured as well.
+
+Pass `weak` as true to generate weak ETags (`W/"..."`), ie. for payloads that
+are semantically but not byte-for-byte identical between requests.
+
+Only successful GET and HEAD requests are considered. Streaming responses
+(`text/event-stream` or any response that calls Flush) are passed through
+without an ETag.
+
+Example use case:
+
+	routes.Handle("/some/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			rye.MiddlewareETag(), // strong ETags
+			yourHandler,
+		})).Methods("GET")
+
+OR:
+
+	routes.Handle("/some/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareETag(true), // weak ETags
+			yourHandler,
+		})).Methods("GET")
+*/
+func NewMiddlewareETag(weak bool) func(rw http.ResponseWriter, req *http.Request) *Response {
+	e := &etag{weak: weak}
+	return e.handle
+}
+
+func (e *etag) handle(rw http.ResponseWriter, req *http.Request) *Response {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil
+	}
+
+	return &Response{
+		ResponseWriter: &etagWriter{
+			ResponseWriter: rw,
+			etag:           e,
+			req:            req,
+			statusCode:     http.StatusOK,
+		},
+	}
+}
+
+// generate returns a quoted ETag for the given body
+func (e *etag) generate(body []byte) string {
+	sum := sha256.Sum256(body)
+	tag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+
+	if e.weak {
+		return "W/" + tag
+	}
+
+	return tag
+}
+
+// etagWriter buffers the whole response so it can be hashed on Close
+type etagWriter struct {
+	http.ResponseWriter
+
+	etag       *etag
+	req        *http.Request
+	statusCode int
+
+	headerCalled bool
+	streaming    bool
+	buf          bytes.Buffer
+}
+
+func (ew *etagWriter) WriteHeader(statusCode int) {
+	if ew.headerCalled {
+		return
+	}
+
+	ew.headerCalled = true
+	ew.statusCode = statusCode
+
+	if strings.HasPrefix(ew.Header().Get("Content-Type"), "text/event-stream") {
+		ew.stream()
+	}
+}
+
+func (ew *etagWriter) Write(p []byte) (int, error) {
+	if !ew.headerCalled {
+		ew.WriteHeader(http.StatusOK)
+	}
+
+	if ew.streaming {
+		return ew.ResponseWriter.Write(p)
+	}
+
+	return ew.buf.Write(p)
+}
+
+// Flush gives up on the ETag; the handler wants its data sent now.
+func (ew *etagWriter) Flush() {
+	if !ew.streaming {
+		if !ew.headerCalled {
+			ew.WriteHeader(http.StatusOK)
+		}
+		ew.stream()
+	}
+
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (ew *etagWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// stream switches to pass-through mode, writing out anything buffered so far
+func (ew *etagWriter) stream() {
+	ew.streaming = true
+	ew.ResponseWriter.WriteHeader(ew.statusCode)
+
+	if ew.buf.Len() > 0 {
+		ew.ResponseWriter.Write(ew.buf.Bytes())
+		ew.buf.Reset()
+	}
+}
+
+// Close is called by rye once the chain has finished; this is where the
+// ETag is computed and the conditional headers are evaluated.
+func (ew *etagWriter) Close() error {
+	if ew.streaming || (!ew.headerCalled && ew.buf.Len() == 0) {
+		return nil
+	}
+
+	h := ew.Header()
+
+	if ew.statusCode != http.StatusOK {
+		ew.ResponseWriter.WriteHeader(ew.statusCode)
+		_, err := ew.ResponseWriter.Write(ew.buf.Bytes())
+		return err
+	}
+
+	// A handler answering HEAD without a body can't be tagged from it; the
+	// ETag and length of an empty body wouldn't match the GET
+	bodiless := ew.req.Method == http.MethodHead && ew.buf.Len() == 0
+
+	tag := h.Get("ETag")
+	if tag == "" && !bodiless {
+		tag = ew.etag.generate(ew.buf.Bytes())
+		h.Set("ETag", tag)
+	}
+
+	if notModified(ew.req, tag, h.Get("Last-Modified")) {
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		h.Del("Content-Encoding")
+		ew.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	if !bodiless {
+		h.Set("Content-Length", strconv.Itoa(ew.buf.Len()))
+	}
+	ew.ResponseWriter.WriteHeader(ew.statusCode)
+
+	_, err := ew.ResponseWriter.Write(ew.buf.Bytes())
+	return err
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since only
+// when the former is absent (RFC 7232 section 6).
+func notModified(req *http.Request, tag, lastModified string) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return etagListMatches(inm, tag)
+	}
+
+	ims := req.Header.Get("If-Modified-Since")
+	if ims == "" || lastModified == "" {
+		return false
+	}
+
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// etagListMatches checks an If-None-Match list using the weak comparison
+func etagListMatches(list, tag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,210 @@
+package rye
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ETag Middleware", func() {
+
+	var (
+		request  *http.Request
+		response *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		response = httptest.NewRecorder()
+		request = &http.Request{
+			Method: "GET",
+			Header: make(map[string][]string, 0),
+		}
+	})
+
+	jsonHandler := func(rw http.ResponseWriter, r *http.Request) *Response {
+		WriteJSONResponse(rw, http.StatusOK, []byte(`{"hello":"world"}`))
+		return nil
+	}
+
+	Describe("handle", func() {
+		Context("when no conditional headers are sent", func() {
+			It("should set a strong ETag and Content-Length", func() {
+				response = serveChain(request, MiddlewareETag(), jsonHandler)
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(response.Header().Get("ETag")).To(MatchRegexp(`^"[A-Za-z0-9_-]+"$`))
+				Expect(response.Header().Get("Content-Length")).To(Equal("17"))
+				Expect(response.Body.String()).To(Equal(`{"hello":"world"}`))
+			})
+
+			It("should set a weak ETag when configured", func() {
+				response = serveChain(request, NewMiddlewareETag(true), jsonHandler)
+
+				Expect(response.Header().Get("ETag")).To(HavePrefix(`W/"`))
+			})
+
+			It("should generate the same ETag for the same payload", func() {
+				response = serveChain(request, MiddlewareETag(), jsonHandler)
+				first := response.Header().Get("ETag")
+
+				response = serveChain(request, MiddlewareETag(), jsonHandler)
+				Expect(response.Header().Get("ETag")).To(Equal(first))
+			})
+		})
+
+		Context("when If-None-Match matches", func() {
+			It("should return a 304 without a body", func() {
+				response = serveChain(request, MiddlewareETag(), jsonHandler)
+				tag := response.Header().Get("ETag")
+
+				request.Header.Set("If-None-Match", `"other", `+tag)
+				response = serveChain(request, MiddlewareETag(), jsonHandler)
+
+				Expect(response.Code).To(Equal(http.StatusNotModified))
+				Expect(response.Header().Get("ETag")).To(Equal(tag))
+				Expect(response.Header().Get("Content-Type")).To(BeEmpty())
+				Expect(response.Body.Len()).To(Equal(0))
+			})
+
+			It("should use the weak comparison", func() {
+				response = serveChain(request, MiddlewareETag(), jsonHandler)
+				tag := response.Header().Get("ETag")
+
+				request.Header.Set("If-None-Match", "W/"+tag)
+				response = serveChain(request, MiddlewareETag(), jsonHandler)
+
+				Expect(response.Code).To(Equal(http.StatusNotModified))
+			})
+
+			It("should respect an ETag set by the handler", func() {
+				request.Header.Set("If-None-Match", `"v1"`)
+				response = serveChain(request, MiddlewareETag(), func(rw http.ResponseWriter, r *http.Request) *Response {
+					rw.Header().Set("ETag", `"v1"`)
+					rw.Write([]byte("hello"))
+					return nil
+				})
+
+				Expect(response.Code).To(Equal(http.StatusNotModified))
+			})
+		})
+
+		Context("when If-None-Match does not match", func() {
+			It("should return the full response", func() {
+				request.Header.Set("If-None-Match", `"stale"`)
+				response = serveChain(request, MiddlewareETag(), jsonHandler)
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(response.Body.String()).To(Equal(`{"hello":"world"}`))
+			})
+		})
+
+		Context("when the handler sets Last-Modified", func() {
+			var lastModified time.Time
+
+			lmHandler := func(rw http.ResponseWriter, r *http.Request) *Response {
+				rw.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+				rw.Write([]byte("hello"))
+				return nil
+			}
+
+			BeforeEach(func() {
+				lastModified = time.Now().Add(-time.Hour).UTC()
+			})
+
+			It("should return a 304 if not modified since", func() {
+				request.Header.Set("If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+				response = serveChain(request, MiddlewareETag(), lmHandler)
+
+				Expect(response.Code).To(Equal(http.StatusNotModified))
+			})
+
+			It("should return a 200 if modified since", func() {
+				request.Header.Set("If-Modified-Since", lastModified.Add(-time.Hour).Format(http.TimeFormat))
+				response = serveChain(request, MiddlewareETag(), lmHandler)
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+			})
+
+			It("should ignore If-Modified-Since when If-None-Match is present", func() {
+				request.Header.Set("If-None-Match", `"stale"`)
+				request.Header.Set("If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+				response = serveChain(request, MiddlewareETag(), lmHandler)
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("when the response is not a 200", func() {
+			It("should pass it through without an ETag", func() {
+				response = serveChain(request, MiddlewareETag(), failureHandler)
+
+				Expect(response.Code).To(Equal(505))
+				Expect(response.Header().Get("ETag")).To(BeEmpty())
+				Expect(response.Body.String()).To(ContainSubstring("Foo"))
+			})
+		})
+
+		Context("when the response is streamed", func() {
+			It("should pass it through without an ETag", func() {
+				response = serveChain(request, MiddlewareETag(), func(rw http.ResponseWriter, r *http.Request) *Response {
+					rw.Write([]byte("data: 1\n\n"))
+					rw.(http.Flusher).Flush()
+
+					recorder := rw.(*etagWriter).ResponseWriter.(*httptest.ResponseRecorder)
+					Expect(recorder.Body.String()).To(Equal("data: 1\n\n"))
+					return nil
+				})
+
+				Expect(response.Flushed).To(BeTrue())
+				Expect(response.Header().Get("ETag")).To(BeEmpty())
+			})
+		})
+
+		Context("when a HEAD request gets no body", func() {
+			It("should not tag or size the empty body", func() {
+				request.Method = "HEAD"
+				response = serveChain(request, MiddlewareETag(), func(rw http.ResponseWriter, r *http.Request) *Response {
+					rw.Header().Set("Content-Type", "application/json")
+					rw.WriteHeader(http.StatusOK)
+					return nil
+				})
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(response.Header().Get("ETag")).To(BeEmpty())
+				Expect(response.Header().Get("Content-Length")).To(BeEmpty())
+			})
+
+			It("should keep an ETag set by the handler", func() {
+				request.Method = "HEAD"
+				response = serveChain(request, MiddlewareETag(), func(rw http.ResponseWriter, r *http.Request) *Response {
+					rw.Header().Set("ETag", `"v1"`)
+					rw.WriteHeader(http.StatusOK)
+					return nil
+				})
+
+				Expect(response.Header().Get("ETag")).To(Equal(`"v1"`))
+			})
+		})
+
+		Context("when the request is not a GET", func() {
+			It("should do nothing", func() {
+				request.Method = "POST"
+				resp := MiddlewareETag()(response, request)
+				Expect(resp).To(BeNil())
+			})
+		})
+
+		Context("when combined with the compress middleware", func() {
+			It("should weaken the ETag of the compressed response", func() {
+				request.Header.Set("Accept-Encoding", "gzip")
+				response = serveChain(request, NewMiddlewareCompress(CompressConfig{MinSize: 1}), MiddlewareETag(), jsonHandler)
+
+				Expect(response.Header().Get("Content-Encoding")).To(Equal("gzip"))
+				Expect(response.Header().Get("ETag")).To(HavePrefix(`W/"`))
+			})
+		})
+	})
+})
@@ -0,0 +1,370 @@
+package rye
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cactus/go-statsd-client/statsd"
+)
+
+const (
+	// Fail2Ban specific constants
+	DEFAULT_FAIL2BAN_THRESHOLD    = 5
+	DEFAULT_FAIL2BAN_WINDOW       = time.Minute
+	DEFAULT_FAIL2BAN_BAN_DURATION = 10 * time.Minute
+)
+
+// Fail2BanConfig is used to configure a Fail2Ban middleware.
+type Fail2BanConfig struct {
+	// KeyFuncs identify who a request comes from, ie. `Fail2BanByIP` and
+	// `Fail2BanByUsername`. Failures are counted, and bans applied, per key;
+	// a request is rejected if any of its keys is banned. An empty key is
+	// ignored. Defaults to `Fail2BanByIP`.
+	KeyFuncs []func(*http.Request) string
+
+	// StatusCodes are the response codes counted as failures; defaults to
+	// 401 and 403.
+	StatusCodes []int
+
+	// Threshold failures within Window get a key banned for BanDuration.
+	Threshold   int
+	Window      time.Duration
+	BanDuration time.Duration
+
+	// BanStatusCode is returned while banned; defaults to 429.
+	BanStatusCode int
+
+	// Statter, if set, receives a counter for every ban (fail2ban.banned)
+	// and every request rejected because of one (fail2ban.rejected).
+	Statter  statsd.Statter
+	StatRate float32
+}
+
+// Ban is a key that is currently banned.
+type Ban struct {
+	Key   string    `json:"key"`
+	Until time.Time `json:"until"`
+}
+
+/*
+Fail2Ban temporarily bans clients which keep failing authentication. It
+watches the status codes written by the rest of the chain, so it must come
+before the auth middlewares it protects.
+
+Use its `Handle` method as the middleware, and `Bans`, `Unban` or
+`AdminHandler` to manage the bans.
+*/
+type Fail2Ban struct {
+	config Fail2BanConfig
+	codes  map[int]bool
+
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	bans      map[string]time.Time
+	lastSweep time.Time
+
+	// now is swapped in tests
+	now func() time.Time
+}
+
+/*
+NewFail2Ban creates a new Fail2Ban middleware.
+
+Default Fail2Ban values:
+
+	KeyFuncs:      rye.Fail2BanByIP
+	StatusCodes:   401, 403
+	Threshold:     DEFAULT_FAIL2BAN_THRESHOLD (5)
+	Window:        DEFAULT_FAIL2BAN_WINDOW (1 minute)
+	BanDuration:   DEFAULT_FAIL2BAN_BAN_DURATION (10 minutes)
+	BanStatusCode: 429
+
+Example usage:
+
+	fail2ban := rye.NewFail2Ban(rye.Fail2BanConfig{
+		KeyFuncs: []func(*http.Request) string{rye.Fail2BanByIP, rye.Fail2BanByUsername},
+	})
+
+	routes.Handle("/some/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			fail2ban.Handle,
+			rye.NewMiddlewareAuth(rye.NewBasicAuthFunc(users)),
+			yourHandler,
+		})).Methods("POST")
+
+	// Lists the bans on GET, and lifts one on DELETE ?key=ip:10.0.0.1
+	adminRoutes.Handle("/admin/bans", fail2ban.AdminHandler())
+*/
+func NewFail2Ban(config Fail2BanConfig) *Fail2Ban {
+	if len(config.KeyFuncs) == 0 {
+		config.KeyFuncs = []func(*http.Request) string{Fail2BanByIP}
+	}
+
+	if len(config.StatusCodes) == 0 {
+		config.StatusCodes = []int{http.StatusUnauthorized, http.StatusForbidden}
+	}
+
+	if config.Threshold <= 0 {
+		config.Threshold = DEFAULT_FAIL2BAN_THRESHOLD
+	}
+
+	if config.Window <= 0 {
+		config.Window = DEFAULT_FAIL2BAN_WINDOW
+	}
+
+	if config.BanDuration <= 0 {
+		config.BanDuration = DEFAULT_FAIL2BAN_BAN_DURATION
+	}
+
+	if config.BanStatusCode == 0 {
+		config.BanStatusCode = http.StatusTooManyRequests
+	}
+
+	f := &Fail2Ban{
+		config:   config,
+		codes:    make(map[int]bool),
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]time.Time),
+		now:      time.Now,
+	}
+
+	for _, code := range config.StatusCodes {
+		f.codes[code] = true
+	}
+
+	return f
+}
+
+// Fail2BanByIP keys requests by client IP, as resolved by the client IP
+// middleware if it ran earlier in the chain.
+func Fail2BanByIP(r *http.Request) string {
+	return "ip:" + ClientIP(r)
+}
+
+// Fail2BanByUsername keys requests by the username they try to
+// authenticate as with basic auth.
+func Fail2BanByUsername(r *http.Request) string {
+	u, _, ok := parseBasicAuth(r.Header.Get("Authorization"))
+	if !ok || u == "" {
+		return ""
+	}
+
+	return "user:" + u
+}
+
+// Handle rejects banned requests and watches the response of the others; it
+// meets the rye.Handler type.
+func (f *Fail2Ban) Handle(rw http.ResponseWriter, r *http.Request) *Response {
+	keys := make([]string, 0, len(f.config.KeyFuncs))
+	for _, keyFunc := range f.config.KeyFuncs {
+		if key := keyFunc(r); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if until, banned := f.banned(keys); banned {
+		f.report("fail2ban.rejected")
+
+		retryAfter := int(until.Sub(f.now()).Seconds()) + 1
+		rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+		return &Response{
+			Err:        fmt.Errorf("Too many failed attempts; try again in %d seconds", retryAfter),
+			StatusCode: f.config.BanStatusCode,
+		}
+	}
+
+	return &Response{
+		ResponseWriter: &fail2banWriter{ResponseWriter: rw, f: f, keys: keys},
+	}
+}
+
+// Bans returns the current bans, soonest to expire first.
+func (f *Fail2Ban) Bans() []Ban {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+
+	bans := make([]Ban, 0, len(f.bans))
+	for key, until := range f.bans {
+		if until.After(now) {
+			bans = append(bans, Ban{Key: key, Until: until})
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+
+	return bans
+}
+
+// Unban lifts the ban on a key and forgets its failures. It returns false if
+// the key was not banned.
+func (f *Fail2Ban) Unban(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	until, ok := f.bans[key]
+	delete(f.bans, key)
+	delete(f.failures, key)
+
+	return ok && until.After(f.now())
+}
+
+// AdminHandler returns an http.Handler listing the bans as JSON on GET, and
+// lifting the ban given by the `key` query parameter on DELETE. It should be
+// mounted behind authentication of its own.
+func (f *Fail2Ban) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			data, _ := json.Marshal(f.Bans())
+			WriteJSONResponse(rw, http.StatusOK, data)
+
+		case "DELETE":
+			key := r.URL.Query().Get("key")
+			if !f.Unban(key) {
+				WriteJSONStatus(rw, "error", fmt.Sprintf("No ban found for '%s'", key), http.StatusNotFound)
+				return
+			}
+			WriteJSONStatus(rw, "ok", fmt.Sprintf("Unbanned '%s'", key), http.StatusOK)
+
+		default:
+			rw.Header().Set("Allow", "GET, DELETE")
+			WriteJSONStatus(rw, "error", "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// banned returns the latest expiry of the bans on any of the keys
+func (f *Fail2Ban) banned(keys []string) (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+
+	var latest time.Time
+	for _, key := range keys {
+		if until, ok := f.bans[key]; ok && until.After(now) && until.After(latest) {
+			latest = until
+		}
+	}
+
+	return latest, !latest.IsZero()
+}
+
+// fail records a failure for every key, banning those over the threshold
+func (f *Fail2Ban) fail(keys []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	f.sweep(now)
+
+	for _, key := range keys {
+		failures := append(recent(f.failures[key], now.Add(-f.config.Window)), now)
+
+		if len(failures) < f.config.Threshold {
+			f.failures[key] = failures
+			continue
+		}
+
+		delete(f.failures, key)
+		f.bans[key] = now.Add(f.config.BanDuration)
+		f.report("fail2ban.banned")
+	}
+}
+
+// sweep drops expired bans and failures, at most once per window, so keys
+// which never come back don't pile up
+func (f *Fail2Ban) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) < f.config.Window {
+		return
+	}
+	f.lastSweep = now
+
+	for key, until := range f.bans {
+		if !until.After(now) {
+			delete(f.bans, key)
+		}
+	}
+
+	for key, failures := range f.failures {
+		if failures = recent(failures, now.Add(-f.config.Window)); len(failures) == 0 {
+			delete(f.failures, key)
+		} else {
+			f.failures[key] = failures
+		}
+	}
+}
+
+// recent returns the times after since; times are in ascending order
+func recent(times []time.Time, since time.Time) []time.Time {
+	for i, t := range times {
+		if t.After(since) {
+			return times[i:]
+		}
+	}
+
+	return times[:0]
+}
+
+func (f *Fail2Ban) report(stat string) {
+	if f.config.Statter == nil {
+		return
+	}
+
+	go f.config.Statter.Inc(stat, 1, f.config.StatRate)
+}
+
+// fail2banWriter records a failure when a failure status code is written
+type fail2banWriter struct {
+	http.ResponseWriter
+
+	f           *Fail2Ban
+	keys        []string
+	wroteHeader bool
+}
+
+func (fw *fail2banWriter) WriteHeader(statusCode int) {
+	if !fw.wroteHeader {
+		fw.wroteHeader = true
+
+		if fw.f.codes[statusCode] {
+			fw.f.fail(fw.keys)
+		}
+	}
+
+	fw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (fw *fail2banWriter) Write(p []byte) (int, error) {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+
+	return fw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher
+func (fw *fail2banWriter) Flush() {
+	if f, ok := fw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (fw *fail2banWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
@@ -0,0 +1,207 @@
+package rye
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/InVisionApp/rye/fakes/statsdfakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fail2Ban Middleware", func() {
+
+	var (
+		fail2ban *Fail2Ban
+		handler  http.Handler
+		now      time.Time
+		status   int
+		config   Fail2BanConfig
+	)
+
+	send := func(remoteAddr string, setup ...func(*http.Request)) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/login", nil)
+		request.RemoteAddr = remoteAddr
+		for _, s := range setup {
+			s(request)
+		}
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	build := func() {
+		fail2ban = NewFail2Ban(config)
+		fail2ban.now = func() time.Time { return now }
+
+		handler = NewMWHandler(Config{}).Handle([]Handler{
+			fail2ban.Handle,
+			func(rw http.ResponseWriter, r *http.Request) *Response {
+				if status != http.StatusOK {
+					return &Response{Err: errors.New("unauthorized"), StatusCode: status}
+				}
+				return nil
+			},
+		})
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		status = http.StatusUnauthorized
+		config = Fail2BanConfig{Threshold: 3, Window: time.Minute, BanDuration: 10 * time.Minute}
+		build()
+	})
+
+	Context("when a client keeps failing", func() {
+		It("should ban it once it reaches the threshold", func() {
+			for i := 0; i < 3; i++ {
+				Expect(send("10.0.0.1:80").Code).To(Equal(http.StatusUnauthorized))
+			}
+
+			response := send("10.0.0.1:80")
+			Expect(response.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(response.Header().Get("Retry-After")).To(Equal("601"))
+			Expect(response.Body.String()).To(ContainSubstring("Too many failed attempts"))
+
+			// even with the right credentials
+			status = http.StatusOK
+			Expect(send("10.0.0.1:80").Code).To(Equal(http.StatusTooManyRequests))
+
+			// other clients are unaffected
+			Expect(send("10.0.0.2:80").Code).To(Equal(http.StatusOK))
+		})
+
+		It("should lift the ban once it expires", func() {
+			for i := 0; i < 3; i++ {
+				send("10.0.0.1:80")
+			}
+
+			now = now.Add(10*time.Minute + time.Second)
+			Expect(send("10.0.0.1:80").Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should only count failures within the window", func() {
+			send("10.0.0.1:80")
+			send("10.0.0.1:80")
+
+			now = now.Add(2 * time.Minute)
+			send("10.0.0.1:80")
+			send("10.0.0.1:80")
+
+			Expect(fail2ban.Bans()).To(BeEmpty())
+		})
+
+		It("should not count successful requests", func() {
+			status = http.StatusOK
+			for i := 0; i < 5; i++ {
+				Expect(send("10.0.0.1:80").Code).To(Equal(http.StatusOK))
+			}
+
+			Expect(fail2ban.Bans()).To(BeEmpty())
+		})
+	})
+
+	Context("when keyed by username", func() {
+		BeforeEach(func() {
+			config.KeyFuncs = []func(*http.Request) string{Fail2BanByIP, Fail2BanByUsername}
+			build()
+		})
+
+		It("should ban the username from every IP", func() {
+			login := func(r *http.Request) { r.SetBasicAuth("admin", "guess") }
+
+			send("10.0.0.1:80", login)
+			send("10.0.0.2:80", login)
+			send("10.0.0.3:80", login)
+
+			Expect(fail2ban.Bans()).To(Equal([]Ban{{Key: "user:admin", Until: now.Add(10 * time.Minute)}}))
+			Expect(send("10.0.0.4:80", login).Code).To(Equal(http.StatusTooManyRequests))
+			Expect(send("10.0.0.4:80").Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("when a custom ban status is configured", func() {
+		It("should respond with it", func() {
+			config.BanStatusCode = http.StatusForbidden
+			build()
+
+			for i := 0; i < 3; i++ {
+				send("10.0.0.1:80")
+			}
+			Expect(send("10.0.0.1:80").Code).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Context("when a statter is configured", func() {
+		It("should report bans and rejections", func() {
+			inc := make(chan string, 2)
+			fakeStatter := &statsdfakes.FakeStatter{}
+			fakeStatter.IncStub = func(name string, value int64, rate float32) error {
+				inc <- name
+				return nil
+			}
+
+			config.Statter = fakeStatter
+			build()
+
+			for i := 0; i < 3; i++ {
+				send("10.0.0.1:80")
+			}
+			Eventually(inc).Should(Receive(Equal("fail2ban.banned")))
+
+			send("10.0.0.1:80")
+			Eventually(inc).Should(Receive(Equal("fail2ban.rejected")))
+		})
+	})
+
+	Describe("managing bans", func() {
+		BeforeEach(func() {
+			for i := 0; i < 3; i++ {
+				send("10.0.0.1:80")
+			}
+		})
+
+		It("should list and lift bans", func() {
+			Expect(fail2ban.Bans()).To(Equal([]Ban{{Key: "ip:10.0.0.1", Until: now.Add(10 * time.Minute)}}))
+
+			Expect(fail2ban.Unban("ip:10.0.0.1")).To(BeTrue())
+			Expect(fail2ban.Unban("ip:10.0.0.1")).To(BeFalse())
+			Expect(fail2ban.Bans()).To(BeEmpty())
+
+			Expect(send("10.0.0.1:80").Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should list bans through the admin handler", func() {
+			response := httptest.NewRecorder()
+			fail2ban.AdminHandler().ServeHTTP(response, httptest.NewRequest("GET", "/bans", nil))
+
+			var bans []Ban
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(json.Unmarshal(response.Body.Bytes(), &bans)).To(Succeed())
+			Expect(bans).To(HaveLen(1))
+			Expect(bans[0].Key).To(Equal("ip:10.0.0.1"))
+		})
+
+		It("should unban through the admin handler", func() {
+			response := httptest.NewRecorder()
+			fail2ban.AdminHandler().ServeHTTP(response, httptest.NewRequest("DELETE", "/bans?key=ip:10.0.0.1", nil))
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(fail2ban.Bans()).To(BeEmpty())
+
+			response = httptest.NewRecorder()
+			fail2ban.AdminHandler().ServeHTTP(response, httptest.NewRequest("DELETE", "/bans?key=ip:10.0.0.1", nil))
+			Expect(response.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should reject other methods", func() {
+			response := httptest.NewRecorder()
+			fail2ban.AdminHandler().ServeHTTP(response, httptest.NewRequest("POST", "/bans", nil))
+			Expect(response.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})
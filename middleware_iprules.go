@@ -0,0 +1,367 @@
+package rye
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// IPRuleSource provides the rules of an IPRuleSet.
+type IPRuleSource interface {
+	Load() ([]IPRule, error)
+}
+
+// IPRuleSourceFunc adapts a callback to an IPRuleSource.
+type IPRuleSourceFunc func() ([]IPRule, error)
+
+// Load calls f
+func (f IPRuleSourceFunc) Load() ([]IPRule, error) {
+	return f()
+}
+
+// IPRuleSetConfig is used to configure an IPRuleSet.
+type IPRuleSetConfig struct {
+	Source IPRuleSource
+
+	// DefaultAction applies when no rule matches; IP_RULE_DENY by default.
+	DefaultAction string
+
+	// ReloadInterval, if set, reloads the rules periodically. Sources which
+	// implement SourceWatcher are also reloaded whenever they change.
+	ReloadInterval time.Duration
+
+	// OnReloadError is called when a reload fails; the last good rule set
+	// stays in place. Defaults to logging the error.
+	OnReloadError func(error)
+}
+
+/*
+IPRuleSet is a mixed allow/deny rule set, with first-match semantics, that
+can be reloaded at runtime without restarting. Every reload is all or
+nothing: a source error or a single invalid rule leaves the last good rule
+set in place and is reported through `OnReloadError`.
+
+Use its `Handle` method as the middleware.
+*/
+type IPRuleSet struct {
+	cidr
+	reloader
+
+	config IPRuleSetConfig
+}
+
+/*
+NewIPRuleSet creates a new rule set from its source. The initial load must
+succeed, otherwise an error is returned.
+
+Example usage:
+
+	rules, err := rye.NewIPRuleSet(rye.IPRuleSetConfig{
+		Source: rye.NewFileIPRuleSource("/etc/myapp/ip.rules"),
+	})
+	if err != nil {
+		log.Fatalf("Unable to load IP rules: %v", err)
+	}
+	defer rules.Close()
+
+	routes.Handle("/some/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			rules.Handle,
+			yourHandler,
+		})).Methods("POST")
+
+OR, with a callback which is polled every minute:
+
+	rules, err := rye.NewIPRuleSet(rye.IPRuleSetConfig{
+		Source:         rye.IPRuleSourceFunc(loadRulesFromDB),
+		DefaultAction:  rye.IP_RULE_ALLOW,
+		ReloadInterval: time.Minute,
+	})
+*/
+func NewIPRuleSet(config IPRuleSetConfig) (*IPRuleSet, error) {
+	if config.DefaultAction == "" {
+		config.DefaultAction = IP_RULE_DENY
+	}
+
+	if config.OnReloadError == nil {
+		config.OnReloadError = func(err error) {
+			log.Errorf("Unable to reload IP rules: %v", err)
+		}
+	}
+
+	s := &IPRuleSet{config: config}
+
+	if err := s.start(s.load, config.OnReloadError, config.Source, config.ReloadInterval); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Handle checks the request IP against the current rules; it meets the
+// rye.Handler type.
+func (s *IPRuleSet) Handle(rw http.ResponseWriter, r *http.Request) *Response {
+	return s.handle(rw, r)
+}
+
+// Rules returns the rules currently in use.
+func (s *IPRuleSet) Rules() []IPRule {
+	return append([]IPRule{}, s.table.Load().(*ipRuleTable).rules...)
+}
+
+func (s *IPRuleSet) load() error {
+	rules, err := s.config.Source.Load()
+	if err != nil {
+		return err
+	}
+
+	table, err := newIPRuleTable(rules, s.config.DefaultAction)
+	if err != nil {
+		return err
+	}
+
+	s.table.Store(table)
+	return nil
+}
+
+/*******
+ Reloads
+*******/
+
+// watchDebounce is how long watchFile waits for a burst of events to settle,
+// so that a file being written in several steps is only read once complete
+var watchDebounce = 100 * time.Millisecond
+
+// SourceWatcher is implemented by the IP rule, token and policy sources which
+// can tell when their content has changed. Watch calls changed on every change
+// until stop is called.
+type SourceWatcher interface {
+	Watch(changed func()) (stop func(), err error)
+}
+
+/*
+reloader is embedded by the components whose content can be reloaded at
+runtime, ie. IPRuleSet. It serialises loads, so an older load can't overwrite
+a newer one, reports the reloads which fail and triggers them on source
+changes and at an interval.
+
+Every load is all or nothing: it must only swap in its result once it is
+fully valid, so that a failed reload leaves the last good content in place.
+*/
+type reloader struct {
+	load          func() error
+	onReloadError func(error)
+
+	mu   sync.Mutex
+	stop []func()
+}
+
+// start does the initial load, which must succeed, then reloads whenever the
+// source changes, if it is a SourceWatcher, and every interval, if set.
+func (rl *reloader) start(load func() error, onReloadError func(error), source interface{}, interval time.Duration) error {
+	rl.load = load
+	rl.onReloadError = onReloadError
+
+	rl.mu.Lock()
+	err := rl.load()
+	rl.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if w, ok := source.(SourceWatcher); ok {
+		stop, err := w.Watch(func() { rl.Reload() })
+		if err != nil {
+			return err
+		}
+		rl.stop = append(rl.stop, stop)
+	}
+
+	if interval > 0 {
+		rl.stop = append(rl.stop, every(interval, func() { rl.Reload() }))
+	}
+
+	return nil
+}
+
+// Reload loads the content from the source and swaps it in atomically. On
+// error the current content is kept and the error is also reported through
+// OnReloadError.
+func (rl *reloader) Reload() error {
+	rl.mu.Lock()
+	err := rl.load()
+	rl.mu.Unlock()
+
+	if err != nil {
+		rl.onReloadError(err)
+	}
+
+	return err
+}
+
+// Close stops watching the source and any periodic reloads, waiting for a
+// reload in progress to finish.
+func (rl *reloader) Close() error {
+	for _, stop := range rl.stop {
+		stop()
+	}
+	rl.stop = nil
+
+	return nil
+}
+
+// every calls f at every interval until stop is called; stop waits for a
+// call in progress to return
+func every(interval time.Duration, f func()) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-finished
+	}
+}
+
+/****************
+ File rule source
+****************/
+
+type fileIPRuleSource struct {
+	path string
+}
+
+/*
+NewFileIPRuleSource creates an IPRuleSource which reads rules from a file, one
+per line, as an action followed by a CIDR or IP. Blank lines and lines
+starting with '#' are ignored:
+
+	# office network, except the guest wifi
+	deny  10.0.13.0/24
+	allow 10.0.0.0/8
+
+The source watches the file, so an IPRuleSet using it reloads whenever the
+file is written, created or replaced (ie. by an atomic rename).
+*/
+func NewFileIPRuleSource(path string) IPRuleSource {
+	return &fileIPRuleSource{path: filepath.Clean(path)}
+}
+
+func (f *fileIPRuleSource) Load() ([]IPRule, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []IPRule
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%d: expected an action and a CIDR", f.path, n)
+		}
+
+		rules = append(rules, IPRule{
+			Action: strings.ToLower(fields[0]),
+			CIDR:   fields[1],
+		})
+	}
+
+	return rules, scanner.Err()
+}
+
+// Watch reloads whenever the rules file changes
+func (f *fileIPRuleSource) Watch(changed func()) (func(), error) {
+	return watchFile(f.path, changed)
+}
+
+// watchedFile is a SourceWatcher for the file at its path
+type watchedFile string
+
+func (f watchedFile) Watch(changed func()) (func(), error) {
+	return watchFile(string(f), changed)
+}
+
+// watchFile calls changed whenever the file at path is written, created or
+// replaced, once its events have settled for watchDebounce. It watches the
+// file's directory, so that the file being replaced rather than written in
+// place is picked up too. Stopping waits for a call in progress to return.
+func watchFile(path string, changed func()) (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		// settled fires once no event came in for watchDebounce
+		var settled <-chan time.Time
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					settled = time.After(watchDebounce)
+				}
+
+			case <-settled:
+				settled = nil
+				changed()
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				log.Errorf("Error watching %v: %v", path, err)
+			}
+		}
+	}()
+
+	return func() {
+		watcher.Close()
+		<-finished
+	}, nil
+}
@@ -0,0 +1,222 @@
+package rye
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IP Rules Middleware", func() {
+
+	var (
+		request  *http.Request
+		response *httptest.ResponseRecorder
+	)
+
+	check := func(handler Handler, remoteAddr string) *Response {
+		request.RemoteAddr = remoteAddr
+		return handler(response, request)
+	}
+
+	BeforeEach(func() {
+		response = httptest.NewRecorder()
+		request = &http.Request{}
+	})
+
+	Describe("NewMiddlewareCIDRDeny", func() {
+		It("should reject denied IPs and allow the rest", func() {
+			mw, err := NewMiddlewareCIDRDeny([]string{"203.0.113.0/24"})
+			Expect(err).ToNot(HaveOccurred())
+
+			resp := check(mw, "203.0.113.7:80")
+			Expect(resp).ToNot(BeNil())
+			Expect(resp.Error()).To(ContainSubstring("203.0.113.7 is not authorized"))
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+			Expect(check(mw, "198.51.100.1:80")).To(BeNil())
+		})
+	})
+
+	Describe("NewMiddlewareIPRules", func() {
+		It("should apply the first matching rule", func() {
+			mw, err := NewMiddlewareIPRules([]IPRule{
+				{Action: IP_RULE_DENY, CIDR: "10.0.13.0/24"},
+				{Action: IP_RULE_ALLOW, CIDR: "10.0.0.0/8"},
+				{Action: IP_RULE_DENY, CIDR: "10.0.1.0/24"},
+			}, IP_RULE_DENY)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(check(mw, "10.0.13.5:80")).ToNot(BeNil())
+			Expect(check(mw, "10.0.1.5:80")).To(BeNil())
+			Expect(check(mw, "10.9.9.9:80")).To(BeNil())
+			Expect(check(mw, "11.0.0.1:80")).ToNot(BeNil())
+		})
+
+		It("should apply the default action", func() {
+			mw, err := NewMiddlewareIPRules(nil, IP_RULE_ALLOW)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(check(mw, "11.0.0.1:80")).To(BeNil())
+		})
+
+		It("should reject invalid actions", func() {
+			_, err := NewMiddlewareIPRules([]IPRule{{Action: "maybe", CIDR: "10.0.0.0/8"}}, IP_RULE_DENY)
+			Expect(err).To(MatchError("invalid IP rule action: maybe"))
+
+			_, err = NewMiddlewareIPRules(nil, "")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("IPRuleSet", func() {
+		var (
+			// mu guards rules and sourceErr against periodic reloads
+			mu        sync.Mutex
+			rules     []IPRule
+			sourceErr error
+			reloadErr error
+			source    IPRuleSource
+		)
+
+		setRules := func(r []IPRule) {
+			mu.Lock()
+			defer mu.Unlock()
+			rules = r
+		}
+
+		BeforeEach(func() {
+			rules = []IPRule{{Action: IP_RULE_ALLOW, CIDR: "10.0.0.0/8"}}
+			sourceErr = nil
+			reloadErr = nil
+			source = IPRuleSourceFunc(func() ([]IPRule, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return rules, sourceErr
+			})
+		})
+
+		newRuleSet := func() *IPRuleSet {
+			s, err := NewIPRuleSet(IPRuleSetConfig{
+				Source:        source,
+				OnReloadError: func(err error) { reloadErr = err },
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return s
+		}
+
+		It("should fail if the initial load fails", func() {
+			sourceErr = errors.New("boom")
+			_, err := NewIPRuleSet(IPRuleSetConfig{Source: source})
+			Expect(err).To(MatchError("boom"))
+		})
+
+		It("should swap in new rules on reload", func() {
+			s := newRuleSet()
+			Expect(check(s.Handle, "10.0.0.1:80")).To(BeNil())
+
+			rules = []IPRule{{Action: IP_RULE_ALLOW, CIDR: "192.168.0.0/16"}}
+			Expect(s.Reload()).To(Succeed())
+
+			Expect(check(s.Handle, "10.0.0.1:80")).ToNot(BeNil())
+			Expect(check(s.Handle, "192.168.1.1:80")).To(BeNil())
+			Expect(s.Rules()).To(Equal(rules))
+		})
+
+		It("should keep the last good rules when the source fails", func() {
+			s := newRuleSet()
+
+			sourceErr = errors.New("database down")
+			Expect(s.Reload()).To(HaveOccurred())
+			Expect(reloadErr).To(MatchError("database down"))
+
+			Expect(check(s.Handle, "10.0.0.1:80")).To(BeNil())
+		})
+
+		It("should keep the last good rules when a rule is invalid", func() {
+			s := newRuleSet()
+
+			rules = []IPRule{{Action: IP_RULE_ALLOW, CIDR: "192.168.0.0/16"}, {Action: IP_RULE_DENY, CIDR: "bad"}}
+			Expect(s.Reload()).To(HaveOccurred())
+			Expect(reloadErr.Error()).To(ContainSubstring("invalid CIDR address: bad"))
+
+			Expect(check(s.Handle, "10.0.0.1:80")).To(BeNil())
+			Expect(check(s.Handle, "192.168.1.1:80")).ToNot(BeNil())
+		})
+
+		It("should reload periodically", func() {
+			s, err := NewIPRuleSet(IPRuleSetConfig{
+				Source:         source,
+				ReloadInterval: 5 * time.Millisecond,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+
+			setRules([]IPRule{{Action: IP_RULE_DENY, CIDR: "10.0.0.0/8"}})
+			Eventually(func() *Response {
+				return check(s.Handle, "10.0.0.1:80")
+			}).ShouldNot(BeNil())
+		})
+
+		Context("when using a file source", func() {
+			var (
+				dir  string
+				path string
+			)
+
+			BeforeEach(func() {
+				var err error
+				dir, err = ioutil.TempDir("", "rye-iprules")
+				Expect(err).ToNot(HaveOccurred())
+
+				path = filepath.Join(dir, "ip.rules")
+				Expect(ioutil.WriteFile(path, []byte("# comment\n\ndeny 10.0.13.0/24\nallow 10.0.0.0/8\n"), 0644)).To(Succeed())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(dir)
+			})
+
+			It("should parse the rules", func() {
+				loaded, err := NewFileIPRuleSource(path).Load()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded).To(Equal([]IPRule{
+					{Action: IP_RULE_DENY, CIDR: "10.0.13.0/24"},
+					{Action: IP_RULE_ALLOW, CIDR: "10.0.0.0/8"},
+				}))
+			})
+
+			It("should report malformed lines", func() {
+				Expect(ioutil.WriteFile(path, []byte("allow\n"), 0644)).To(Succeed())
+				_, err := NewFileIPRuleSource(path).Load()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("ip.rules:1: expected an action and a CIDR"))
+			})
+
+			It("should reload when the file is replaced", func() {
+				s, err := NewIPRuleSet(IPRuleSetConfig{
+					Source:        NewFileIPRuleSource(path),
+					OnReloadError: func(err error) {},
+				})
+				Expect(err).ToNot(HaveOccurred())
+				defer s.Close()
+
+				Expect(check(s.Handle, "10.0.13.1:80")).ToNot(BeNil())
+
+				tmp := filepath.Join(dir, "ip.rules.tmp")
+				Expect(ioutil.WriteFile(tmp, []byte("allow 10.0.0.0/8\n"), 0644)).To(Succeed())
+				Expect(os.Rename(tmp, path)).To(Succeed())
+
+				Eventually(func() *Response {
+					return check(s.Handle, "10.0.13.1:80")
+				}).Should(BeNil())
+			})
+		})
+	})
+})
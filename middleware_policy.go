@@ -0,0 +1,475 @@
+package rye
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/netip"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cactus/go-statsd-client/statsd"
+	log "github.com/sirupsen/logrus"
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	// Policy rule effects
+	POLICY_ALLOW = "allow"
+	POLICY_DENY  = "deny"
+)
+
+/*
+PolicyRule allows or denies the requests it matches. All of its conditions
+must match, and a condition lists alternatives: a rule with two paths and two
+roles matches requests to either path, from principals with either role.
+Conditions left empty match any request.
+*/
+type PolicyRule struct {
+	// Name identifies the rule in errors and logs.
+	Name string `yaml:"name" json:"name"`
+
+	// Effect is POLICY_ALLOW or POLICY_DENY.
+	Effect string `yaml:"effect" json:"effect"`
+
+	// Paths are path.Match patterns, ie. "/users/*"; a pattern ending in
+	// "/**" matches everything below the path.
+	Paths []string `yaml:"paths" json:"paths"`
+
+	Methods []string `yaml:"methods" json:"methods"`
+
+	// Subjects, Roles, Scopes and AuthMethods match the Principal put into
+	// the context by the auth middlewares; a request without one never
+	// matches them.
+	Subjects    []string `yaml:"subjects" json:"subjects"`
+	Roles       []string `yaml:"roles" json:"roles"`
+	Scopes      []string `yaml:"scopes" json:"scopes"`
+	AuthMethods []string `yaml:"auth_methods" json:"auth_methods"`
+
+	// Authenticated, if set, matches requests with (true) or without (false)
+	// a Principal.
+	Authenticated *bool `yaml:"authenticated" json:"authenticated"`
+
+	// Headers maps header names to their accepted values; an empty list
+	// only requires the header to be present.
+	Headers map[string][]string `yaml:"headers" json:"headers"`
+
+	// IPs are CIDRs or IPs matching the client IP, see `ClientIP`.
+	IPs []string `yaml:"ips" json:"ips"`
+}
+
+// PolicySource provides the rules of a PolicyEngine.
+type PolicySource interface {
+	Load() ([]PolicyRule, error)
+}
+
+// PolicySourceFunc adapts a callback to a PolicySource.
+type PolicySourceFunc func() ([]PolicyRule, error)
+
+// Load calls f
+func (f PolicySourceFunc) Load() ([]PolicyRule, error) {
+	return f()
+}
+
+// PolicyConfig is used to configure a PolicyEngine.
+type PolicyConfig struct {
+	Source PolicySource
+
+	// DefaultEffect applies when no rule matches; POLICY_DENY by default.
+	DefaultEffect string
+
+	// DryRun only logs the requests the rules deny, and lets them through,
+	// so that new rules can be audited before they are enforced.
+	DryRun bool
+
+	// ReloadInterval, if set, reloads the rules periodically. Sources which
+	// implement SourceWatcher are also reloaded whenever they change.
+	ReloadInterval time.Duration
+
+	// OnReloadError is called when a reload fails; the last good rules stay
+	// in place. Defaults to logging the error.
+	OnReloadError func(error)
+
+	// Statter, if set, receives a counter for every denied request
+	// (policy.denied), or every request that would have been denied in dry
+	// run mode (policy.dry_run_denied).
+	Statter  statsd.Statter
+	StatRate float32
+}
+
+/*
+PolicyEngine authorizes requests against declarative rules, with first-match
+semantics: the first rule matching a request decides, and the DefaultEffect
+applies if none does. The rules can be reloaded at runtime; a reload failing
+on a source error or a single invalid rule keeps the last good rules, and is
+reported through `OnReloadError`.
+
+Denied requests get a 403, or a 401 if they carry no Principal. The engine
+reads the Principal and the client IP, so it goes after the auth and client
+IP middlewares.
+
+Use its `Handle` method as the middleware.
+*/
+type PolicyEngine struct {
+	reloader
+
+	config PolicyConfig
+
+	// rules holds the current []*policyRule
+	rules atomic.Value
+}
+
+// policyRule is a parsed PolicyRule
+type policyRule struct {
+	PolicyRule
+	prefixes []netip.Prefix
+}
+
+/*
+NewPolicyEngine creates a new policy engine from its source. The initial load
+must succeed, otherwise an error is returned.
+
+Example usage, where updating an admin route requires the admin role unless
+the request comes from the office network:
+
+	# /etc/myapp/policy.yaml
+	- name: admin-office
+	  effect: allow
+	  paths: ["/admin/**"]
+	  ips: ["10.0.0.0/8"]
+	- name: admin-role
+	  effect: allow
+	  paths: ["/admin/**"]
+	  roles: [admin]
+	- name: admin
+	  effect: deny
+	  paths: ["/admin/**"]
+	  methods: [POST, PUT, DELETE]
+
+	policy, err := rye.NewPolicyEngine(rye.PolicyConfig{
+		Source:        rye.NewFilePolicySource("/etc/myapp/policy.yaml"),
+		DefaultEffect: rye.POLICY_ALLOW,
+	})
+	if err != nil {
+		log.Fatalf("Unable to load policy: %v", err)
+	}
+	defer policy.Close()
+
+	routes.PathPrefix("/").Handler(myMWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareAuth(authFunc),
+			policy.Handle,
+			yourHandler,
+		}))
+*/
+func NewPolicyEngine(config PolicyConfig) (*PolicyEngine, error) {
+	if config.DefaultEffect == "" {
+		config.DefaultEffect = POLICY_DENY
+	}
+
+	if config.DefaultEffect != POLICY_ALLOW && config.DefaultEffect != POLICY_DENY {
+		return nil, fmt.Errorf("invalid default effect: %v", config.DefaultEffect)
+	}
+
+	if config.OnReloadError == nil {
+		config.OnReloadError = func(err error) {
+			log.Errorf("Unable to reload policy: %v", err)
+		}
+	}
+
+	e := &PolicyEngine{config: config}
+
+	if err := e.start(e.load, config.OnReloadError, config.Source, config.ReloadInterval); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Handle checks the request against the current rules; it meets the
+// rye.Handler type.
+func (e *PolicyEngine) Handle(rw http.ResponseWriter, r *http.Request) *Response {
+	principal, authenticated := PrincipalFromContext(r)
+
+	rule := e.match(r, principal)
+
+	effect, name := e.config.DefaultEffect, "default"
+	if rule != nil {
+		effect, name = rule.Effect, rule.Name
+	}
+
+	if effect == POLICY_ALLOW {
+		return nil
+	}
+
+	subject := ""
+	if authenticated {
+		subject = principal.Subject
+	}
+
+	if e.config.DryRun {
+		log.Warnf("Policy %v would deny %v %v from %v (subject %q)", name, r.Method, r.URL.Path, ClientIP(r), subject)
+		e.report("policy.dry_run_denied")
+		return nil
+	}
+
+	e.report("policy.denied")
+
+	if !authenticated {
+		return &Response{
+			Err:        fmt.Errorf("unauthorized: denied by policy %v", name),
+			StatusCode: http.StatusUnauthorized,
+		}
+	}
+
+	return &Response{
+		Err:        fmt.Errorf("forbidden: denied by policy %v", name),
+		StatusCode: http.StatusForbidden,
+	}
+}
+
+// Rules returns the rules currently in use.
+func (e *PolicyEngine) Rules() []PolicyRule {
+	compiled := e.rules.Load().([]*policyRule)
+
+	rules := make([]PolicyRule, len(compiled))
+	for i, rule := range compiled {
+		rules[i] = rule.PolicyRule
+	}
+
+	return rules
+}
+
+func (e *PolicyEngine) load() error {
+	rules, err := e.config.Source.Load()
+	if err != nil {
+		return err
+	}
+
+	compiled := make([]*policyRule, len(rules))
+	for i, rule := range rules {
+		if compiled[i], err = newPolicyRule(rule); err != nil {
+			return fmt.Errorf("rule %d (%v): %v", i, rule.Name, err)
+		}
+	}
+
+	e.rules.Store(compiled)
+	return nil
+}
+
+// match returns the first rule matching the request, if any
+func (e *PolicyEngine) match(r *http.Request, principal *Principal) *policyRule {
+	// A request without a valid client IP matches no IP condition
+	ip, _, _ := remoteIP(r)
+	urlPath := cleanPath(r.URL.Path)
+
+	for _, rule := range e.rules.Load().([]*policyRule) {
+		if rule.matches(r, urlPath, principal, ip) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+func (e *PolicyEngine) report(stat string) {
+	if e.config.Statter == nil {
+		return
+	}
+
+	go e.config.Statter.Inc(stat, 1, e.config.StatRate)
+}
+
+func newPolicyRule(rule PolicyRule) (*policyRule, error) {
+	rule.Effect = strings.ToLower(rule.Effect)
+	if rule.Effect != POLICY_ALLOW && rule.Effect != POLICY_DENY {
+		return nil, fmt.Errorf("invalid effect: %q", rule.Effect)
+	}
+
+	if rule.Name == "" {
+		return nil, errors.New("missing name")
+	}
+
+	for _, pattern := range rule.Paths {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), "/"); err != nil {
+			return nil, fmt.Errorf("invalid path pattern: %v", pattern)
+		}
+	}
+
+	compiled := &policyRule{PolicyRule: rule}
+
+	for _, s := range rule.IPs {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		compiled.prefixes = append(compiled.prefixes, prefix)
+	}
+
+	return compiled, nil
+}
+
+// matches checks every condition of the rule against the request
+func (p *policyRule) matches(r *http.Request, urlPath string, principal *Principal, ip netip.Addr) bool {
+	if len(p.Paths) > 0 && !matchesAnyPath(p.Paths, urlPath) {
+		return false
+	}
+
+	if len(p.Methods) > 0 && !containsFold(p.Methods, r.Method) {
+		return false
+	}
+
+	if p.Authenticated != nil && *p.Authenticated != (principal != nil) {
+		return false
+	}
+
+	if len(p.Subjects) > 0 || len(p.Roles) > 0 || len(p.Scopes) > 0 || len(p.AuthMethods) > 0 {
+		if principal == nil {
+			return false
+		}
+
+		if len(p.Subjects) > 0 && !containsAny(p.Subjects, []string{principal.Subject}) ||
+			len(p.Roles) > 0 && !containsAny(principal.Roles, p.Roles) ||
+			len(p.Scopes) > 0 && !containsAny(principal.Scopes, p.Scopes) ||
+			len(p.AuthMethods) > 0 && !containsAny(p.AuthMethods, []string{principal.AuthMethod}) {
+			return false
+		}
+	}
+
+	for name, values := range p.Headers {
+		got, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || len(values) > 0 && !containsAny(values, got) {
+			return false
+		}
+	}
+
+	if len(p.prefixes) > 0 {
+		if !ip.IsValid() {
+			return false
+		}
+
+		found := false
+		for _, prefix := range p.prefixes {
+			if prefix.Contains(ip) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesAnyPath checks the path against the patterns; a pattern ending in
+// "/**" matches the path and everything below it
+func matchesAnyPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/**") {
+			prefix := strings.TrimSuffix(pattern, "/**")
+			if ok, _ := path.Match(prefix, p); ok {
+				return true
+			}
+
+			for dir := path.Dir(p); dir != "/" && dir != "."; dir = path.Dir(dir) {
+				if ok, _ := path.Match(prefix, dir); ok {
+					return true
+				}
+			}
+			continue
+		}
+
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cleanPath resolves the dot segments and repeated slashes of a request path,
+// keeping any trailing slash, so that ie. "//admin/x" or "/a/../admin/x"
+// can't slip past the patterns when the router doesn't clean paths
+func cleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+// containsFold checks if s is in list, case-insensitively
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/******************
+ File policy source
+******************/
+
+type filePolicySource struct {
+	path string
+}
+
+/*
+NewFilePolicySource creates a PolicySource which reads a list of rules from a
+YAML or JSON file (JSON being valid YAML too), see `PolicyRule` and
+`NewPolicyEngine`. An empty file is an error, so that a file caught halfway
+through being rewritten can't drop the rules; use [] for an empty policy.
+
+The source watches the file, so a PolicyEngine using it reloads whenever the
+file is written, created or replaced (ie. by an atomic rename).
+*/
+func NewFilePolicySource(path string) PolicySource {
+	return &filePolicySource{path: filepath.Clean(path)}
+}
+
+func (f *filePolicySource) Load() ([]PolicyRule, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []PolicyRule
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	// An empty file is more likely caught being rewritten than meant to drop
+	// every rule, so that takes an explicit []
+	err = decoder.Decode(&rules)
+	if err == io.EOF || err == nil && rules == nil {
+		return nil, fmt.Errorf("%v: no rules found; use [] for an empty policy", f.path)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", f.path, err)
+	}
+
+	return rules, nil
+}
+
+// Watch reloads whenever the policy file changes
+func (f *filePolicySource) Watch(changed func()) (func(), error) {
+	return watchFile(f.path, changed)
+}
@@ -0,0 +1,271 @@
+package rye
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/InVisionApp/rye/fakes/statsdfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy Middleware", func() {
+	var (
+		rules     []PolicyRule
+		sourceErr error
+		reloadErr error
+		config    PolicyConfig
+		response  *httptest.ResponseRecorder
+	)
+
+	alice := &Principal{
+		Subject:    "alice",
+		AuthMethod: AUTH_METHOD_JWT,
+		Scopes:     []string{"read"},
+		Roles:      []string{"admin"},
+	}
+
+	newRequest := func(method, target string, principal *Principal) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		if principal != nil {
+			r = r.WithContext(ContextWithPrincipal(context.Background(), principal))
+		}
+		return r
+	}
+
+	newEngine := func() *PolicyEngine {
+		e, err := NewPolicyEngine(config)
+		Expect(err).ToNot(HaveOccurred())
+		return e
+	}
+
+	BeforeEach(func() {
+		rules = nil
+		sourceErr = nil
+		reloadErr = nil
+		response = httptest.NewRecorder()
+		config = PolicyConfig{
+			Source: PolicySourceFunc(func() ([]PolicyRule, error) {
+				return rules, sourceErr
+			}),
+			OnReloadError: func(err error) { reloadErr = err },
+		}
+	})
+
+	It("should apply the first matching rule", func() {
+		rules = []PolicyRule{
+			{Name: "admins", Effect: POLICY_ALLOW, Paths: []string{"/admin/**"}, Roles: []string{"admin"}},
+			{Name: "admin", Effect: POLICY_DENY, Paths: []string{"/admin/**"}},
+			{Name: "public", Effect: POLICY_ALLOW, Paths: []string{"/public/*"}, Methods: []string{"get"}},
+		}
+		e := newEngine()
+
+		Expect(e.Handle(response, newRequest("POST", "/admin/users/1", alice))).To(BeNil())
+
+		resp := e.Handle(response, newRequest("GET", "/admin", &Principal{Subject: "bob"}))
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		Expect(resp.Err.Error()).To(Equal("forbidden: denied by policy admin"))
+
+		Expect(e.Handle(response, newRequest("GET", "/public/index.html", nil))).To(BeNil())
+
+		resp = e.Handle(response, newRequest("POST", "/public/index.html", nil))
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(resp.Err.Error()).To(Equal("unauthorized: denied by policy default"))
+	})
+
+	It("should apply the default effect", func() {
+		config.DefaultEffect = POLICY_ALLOW
+		Expect(newEngine().Handle(response, newRequest("GET", "/", nil))).To(BeNil())
+
+		config.DefaultEffect = "maybe"
+		_, err := NewPolicyEngine(config)
+		Expect(err).To(MatchError("invalid default effect: maybe"))
+	})
+
+	It("should match the principal", func() {
+		authenticated := true
+		rules = []PolicyRule{
+			{Name: "subject", Effect: POLICY_ALLOW, Paths: []string{"/subject"}, Subjects: []string{"alice"}},
+			{Name: "scope", Effect: POLICY_ALLOW, Paths: []string{"/scope"}, Scopes: []string{"write", "read"}},
+			{Name: "method", Effect: POLICY_ALLOW, Paths: []string{"/method"}, AuthMethods: []string{AUTH_METHOD_BASIC}},
+			{Name: "authenticated", Effect: POLICY_ALLOW, Paths: []string{"/authenticated"}, Authenticated: &authenticated},
+		}
+		e := newEngine()
+
+		Expect(e.Handle(response, newRequest("GET", "/subject", alice))).To(BeNil())
+		Expect(e.Handle(response, newRequest("GET", "/subject", &Principal{Subject: "bob"}))).ToNot(BeNil())
+		Expect(e.Handle(response, newRequest("GET", "/scope", alice))).To(BeNil())
+		Expect(e.Handle(response, newRequest("GET", "/scope", nil))).ToNot(BeNil())
+		Expect(e.Handle(response, newRequest("GET", "/method", alice))).ToNot(BeNil())
+		Expect(e.Handle(response, newRequest("GET", "/authenticated", &Principal{}))).To(BeNil())
+		Expect(e.Handle(response, newRequest("GET", "/authenticated", nil))).ToNot(BeNil())
+	})
+
+	It("should match cleaned request paths", func() {
+		rules = []PolicyRule{
+			{Name: "admin", Effect: POLICY_DENY, Paths: []string{"/admin/**"}},
+			{Name: "dir", Effect: POLICY_DENY, Paths: []string{"/dir/"}},
+		}
+		config.DefaultEffect = POLICY_ALLOW
+		e := newEngine()
+
+		for _, p := range []string{"//admin/users", "/public/../admin/users", "/admin/./users", "/dir//"} {
+			r := newRequest("GET", "/", nil)
+			r.URL.Path = p
+			Expect(e.Handle(response, r)).ToNot(BeNil(), p)
+		}
+
+		Expect(e.Handle(response, newRequest("GET", "/dir", nil))).To(BeNil())
+	})
+
+	It("should match headers and client IPs", func() {
+		rules = []PolicyRule{
+			{Name: "internal", Effect: POLICY_ALLOW, IPs: []string{"192.0.2.0/24"}, Headers: map[string][]string{"x-internal": nil}},
+			{Name: "tenant", Effect: POLICY_ALLOW, Headers: map[string][]string{"X-Tenant": {"acme"}}},
+		}
+		e := newEngine()
+
+		r := newRequest("GET", "/", nil)
+		Expect(e.Handle(response, r)).ToNot(BeNil())
+
+		r.Header.Set("X-Internal", "1")
+		Expect(e.Handle(response, r)).To(BeNil())
+
+		r.RemoteAddr = "198.51.100.1:1234"
+		Expect(e.Handle(response, r)).ToNot(BeNil())
+
+		r.Header.Set("X-Tenant", "acme")
+		Expect(e.Handle(response, r)).To(BeNil())
+	})
+
+	It("should only report denials in dry run mode", func() {
+		inc := make(chan string, 1)
+		fakeStatter := &statsdfakes.FakeStatter{}
+		fakeStatter.IncStub = func(name string, value int64, rate float32) error {
+			inc <- name
+			return nil
+		}
+		config.Statter = fakeStatter
+		config.DryRun = true
+
+		Expect(newEngine().Handle(response, newRequest("GET", "/", alice))).To(BeNil())
+		Eventually(inc).Should(Receive(Equal("policy.dry_run_denied")))
+	})
+
+	It("should fail if the initial load fails", func() {
+		sourceErr = errors.New("boom")
+		_, err := NewPolicyEngine(config)
+		Expect(err).To(MatchError("boom"))
+	})
+
+	It("should keep the last good rules when a rule is invalid", func() {
+		rules = []PolicyRule{{Name: "all", Effect: POLICY_ALLOW}}
+		e := newEngine()
+
+		rules = []PolicyRule{{Name: "none", Effect: POLICY_DENY}, {Name: "bad", Effect: "permit"}}
+		Expect(e.Reload()).To(HaveOccurred())
+		Expect(reloadErr).To(MatchError(`rule 1 (bad): invalid effect: "permit"`))
+
+		rules = []PolicyRule{{Name: "bad", Effect: POLICY_DENY, IPs: []string{"nope"}}}
+		Expect(e.Reload()).To(HaveOccurred())
+
+		Expect(e.Rules()).To(Equal([]PolicyRule{{Name: "all", Effect: POLICY_ALLOW}}))
+		Expect(e.Handle(response, newRequest("GET", "/", nil))).To(BeNil())
+	})
+
+	Context("when using a file source", func() {
+		var (
+			dir  string
+			path string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "rye-policy")
+			Expect(err).ToNot(HaveOccurred())
+
+			path = filepath.Join(dir, "policy.yaml")
+			Expect(ioutil.WriteFile(path, []byte(`
+- name: health
+  effect: allow
+  paths: ["/health"]
+  authenticated: false
+- name: admin
+  effect: deny
+  paths: ["/admin/**"]
+  methods: [POST, DELETE]
+`), 0644)).To(Succeed())
+
+			config.Source = NewFilePolicySource(path)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should parse YAML rules", func() {
+			loaded, err := NewFilePolicySource(path).Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(loaded).To(HaveLen(2))
+			Expect(*loaded[0].Authenticated).To(BeFalse())
+			Expect(loaded[1]).To(Equal(PolicyRule{
+				Name:    "admin",
+				Effect:  POLICY_DENY,
+				Paths:   []string{"/admin/**"},
+				Methods: []string{"POST", "DELETE"},
+			}))
+		})
+
+		It("should parse JSON rules", func() {
+			Expect(ioutil.WriteFile(path, []byte(`[{"name": "all", "effect": "allow", "auth_methods": ["jwt"]}]`), 0644)).To(Succeed())
+			loaded, err := NewFilePolicySource(path).Load()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(loaded).To(Equal([]PolicyRule{{Name: "all", Effect: POLICY_ALLOW, AuthMethods: []string{"jwt"}}}))
+		})
+
+		It("should reject an empty file", func() {
+			e := newEngine()
+
+			Expect(ioutil.WriteFile(path, []byte("\n"), 0644)).To(Succeed())
+			Expect(e.Reload()).To(HaveOccurred())
+			Expect(reloadErr.Error()).To(ContainSubstring("no rules found"))
+			Expect(e.Rules()).To(HaveLen(2))
+
+			_, err := NewPolicyEngine(config)
+			Expect(err).To(HaveOccurred())
+
+			Expect(ioutil.WriteFile(path, []byte("[]\n"), 0644)).To(Succeed())
+			Expect(e.Reload()).To(Succeed())
+			Expect(e.Rules()).To(BeEmpty())
+		})
+
+		It("should reject unknown fields", func() {
+			Expect(ioutil.WriteFile(path, []byte("- name: all\n  effect: allow\n  role: [admin]\n"), 0644)).To(Succeed())
+			_, err := NewFilePolicySource(path).Load()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("field role not found"))
+		})
+
+		It("should reload when the file is replaced", func() {
+			config.DefaultEffect = POLICY_ALLOW
+			e := newEngine()
+			defer e.Close()
+
+			Expect(e.Handle(response, newRequest("POST", "/admin/users", alice))).ToNot(BeNil())
+
+			tmp := filepath.Join(dir, "policy.yaml.tmp")
+			Expect(ioutil.WriteFile(tmp, []byte("- name: admin\n  effect: deny\n  paths: [\"/admin/**\"]\n  methods: [DELETE]\n"), 0644)).To(Succeed())
+			Expect(os.Rename(tmp, path)).To(Succeed())
+
+			Eventually(func() *Response {
+				return e.Handle(response, newRequest("POST", "/admin/users", alice))
+			}).Should(BeNil())
+		})
+	})
+})
@@ -2,13 +2,15 @@ package rye
 
 import (
 	"net/http"
+	"net/netip"
 
 	log "github.com/sirupsen/logrus"
 )
 
 /*
 MiddlewareRouteLogger creates a new handler to provide simple logging output for the specific route. You can use this middleware by specifying `rye.MiddlewareRouteLogger`
-when defining your routes.
+when defining your routes. The values of the query parameters tokens are read
+from (see `TokenQuery`) are redacted from the logged request URI.
 
 Example use case:
 
@@ -20,7 +22,14 @@ Example use case:
 */
 func MiddlewareRouteLogger() func(rw http.ResponseWriter, req *http.Request) *Response {
 	return func(rw http.ResponseWriter, r *http.Request) *Response {
-		log.Infof("%s \"%s %s %s\"", r.RemoteAddr, r.Method, r.RequestURI, r.Proto)
+		remote := r.RemoteAddr
+
+		// Prefer the client IP resolved by the client IP middleware
+		if _, ok := r.Context().Value(CONTEXT_CLIENT_IP).(netip.Addr); ok {
+			remote = ClientIP(r)
+		}
+
+		log.Infof("%s \"%s %s %s\"", remote, r.Method, redactTokenQuery(r.RequestURI), r.Proto)
 		return nil
 	}
 }
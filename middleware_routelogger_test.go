@@ -1,8 +1,13 @@
 package rye
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -13,6 +18,8 @@ var _ = Describe("Route Logger Middleware", func() {
 	var (
 		request  *http.Request
 		response *httptest.ResponseRecorder
+		hook     *test.Hook
+		oldHooks logrus.LevelHooks
 	)
 
 	BeforeEach(func() {
@@ -20,6 +27,17 @@ var _ = Describe("Route Logger Middleware", func() {
 		request = &http.Request{
 			Header: make(map[string][]string, 0),
 		}
+
+		oldHooks = logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+		hook = test.NewLocal(logrus.StandardLogger())
+		logrus.SetLevel(logrus.InfoLevel)
+		logrus.SetOutput(ioutil.Discard)
+	})
+
+	AfterEach(func() {
+		logrus.StandardLogger().ReplaceHooks(oldHooks)
+		logrus.SetLevel(logrus.FatalLevel)
+		logrus.SetOutput(os.Stderr)
 	})
 
 	Describe("MiddlewareRouteLogger", func() {
@@ -29,5 +47,36 @@ var _ = Describe("Route Logger Middleware", func() {
 				Expect(resp).To(BeNil())
 			})
 		})
+
+		Context("when the client IP was resolved", func() {
+			It("should log the resolved client IP", func() {
+				clientIP, err := NewMiddlewareClientIP(ClientIPConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+				Expect(err).ToNot(HaveOccurred())
+
+				request = httptest.NewRequest("GET", "/thing", nil)
+				request.RemoteAddr = "10.0.0.1:1234"
+				request.Header.Set("X-Forwarded-For", "203.0.113.7")
+				serveChain(request, clientIP, MiddlewareRouteLogger(), successHandler)
+
+				Expect(hook.LastEntry()).ToNot(BeNil())
+				Expect(hook.LastEntry().Message).To(Equal(`203.0.113.7 "GET /thing HTTP/1.1"`))
+			})
+		})
+
+		Context("when a token is passed in the query string", func() {
+			It("should redact it from the logged URI", func() {
+				tokens := NewMiddlewareAccessQueryToken("logger_token", []string{"secret"})
+
+				m := NewMWHandler(Config{})
+				m.Use(MiddlewareRouteLogger())
+
+				request = httptest.NewRequest("GET", "/ws?room=1&logger_token=secret&b=2", nil)
+				m.Handle([]Handler{tokens, successHandler}).ServeHTTP(response, request)
+
+				Expect(response.Code).To(Equal(http.StatusOK))
+				Expect(hook.LastEntry().Message).To(HaveSuffix(`"GET /ws?room=1&logger_token=REDACTED&b=2 HTTP/1.1"`))
+				Expect(request.RequestURI).To(Equal("/ws?room=1&logger_token=secret&b=2"))
+			})
+		})
 	})
 })
@@ -0,0 +1,200 @@
+package rye
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Security headers specific constants
+	CSP_NONCE_PLACEHOLDER = "{nonce}"
+
+	CONTEXT_CSP_NONCE = "rye-middlewaresecurityheaders-nonce"
+)
+
+// SecurityHeadersConfig is used to configure the security headers middleware.
+// A header is only set if its field is non-zero.
+type SecurityHeadersConfig struct {
+	// Strict-Transport-Security
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+
+	// Content-Security-Policy. Every CSP_NONCE_PLACEHOLDER in the policy is
+	// replaced with a fresh nonce per request, ie. "script-src 'nonce-{nonce}'".
+	ContentSecurityPolicy string
+	CSPReportOnly         bool
+
+	// X-Content-Type-Options: nosniff
+	ContentTypeNosniff bool
+
+	// X-Frame-Options, ie. "DENY" or "SAMEORIGIN"
+	FrameOptions string
+
+	ReferrerPolicy    string
+	PermissionsPolicy string
+}
+
+// APISecurityHeaders is a preset for JSON API routes, which should never be
+// rendered or framed by a browser.
+var APISecurityHeaders = SecurityHeadersConfig{
+	HSTSMaxAge:            365 * 24 * time.Hour,
+	HSTSIncludeSubdomains: true,
+	ContentSecurityPolicy: "default-src 'none'; frame-ancestors 'none'",
+	ContentTypeNosniff:    true,
+	FrameOptions:          "DENY",
+	ReferrerPolicy:        "no-referrer",
+}
+
+// StaticSecurityHeaders is a preset for UI routes served with NewStaticFile or
+// NewStaticFilesystem, which load their own scripts and styles.
+var StaticSecurityHeaders = SecurityHeadersConfig{
+	HSTSMaxAge:            365 * 24 * time.Hour,
+	HSTSIncludeSubdomains: true,
+	ContentSecurityPolicy: "default-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'self'",
+	ContentTypeNosniff:    true,
+	FrameOptions:          "SAMEORIGIN",
+	ReferrerPolicy:        "strict-origin-when-cross-origin",
+	PermissionsPolicy:     "camera=(), microphone=(), geolocation=()",
+}
+
+type securityHeaders struct {
+	config SecurityHeadersConfig
+	hsts   string
+	nonce  bool
+}
+
+// MiddlewareSecurityHeadersAPI creates a security headers handler using the
+// APISecurityHeaders preset.
+func MiddlewareSecurityHeadersAPI() func(rw http.ResponseWriter, req *http.Request) *Response {
+	return NewMiddlewareSecurityHeaders(APISecurityHeaders)
+}
+
+// MiddlewareSecurityHeadersStatic creates a security headers handler using the
+// StaticSecurityHeaders preset.
+func MiddlewareSecurityHeadersStatic() func(rw http.ResponseWriter, req *http.Request) *Response {
+	return NewMiddlewareSecurityHeaders(StaticSecurityHeaders)
+}
+
+/*
+NewMiddlewareSecurityHeaders creates a new handler which sets the common
+security response headers: Strict-Transport-Security, Content-Security-Policy,
+X-Content-Type-Options, X-Frame-Options, Referrer-Policy and Permissions-Policy.
+
+Two presets are provided, `APISecurityHeaders` and `StaticSecurityHeaders`,
+which can be used as is through `rye.MiddlewareSecurityHeadersAPI()` and
+`rye.MiddlewareSecurityHeadersStatic()`, or copied and tweaked.
+
+If the Content-Security-Policy contains the `{nonce}` placeholder, a fresh
+nonce is generated for every request and put in the context for use by later
+handlers (see `CSPNonce`), ie. to render it into inline script tags.
+
+Example use case:
+
+	routes.Handle("/api/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			rye.MiddlewareSecurityHeadersAPI(),
+			yourHandler,
+		})).Methods("GET")
+
+OR:
+
+	config := rye.StaticSecurityHeaders
+	config.ContentSecurityPolicy = "default-src 'self'; script-src 'self' 'nonce-{nonce}'"
+
+	routes.Handle("/ui/route", a.Dependencies.MWHandler.Handle(
+		[]rye.Handler{
+			rye.NewMiddlewareSecurityHeaders(config),
+			yourTemplateHandler,
+		})).Methods("GET")
+*/
+func NewMiddlewareSecurityHeaders(config SecurityHeadersConfig) func(rw http.ResponseWriter, req *http.Request) *Response {
+	s := &securityHeaders{
+		config: config,
+		nonce:  strings.Contains(config.ContentSecurityPolicy, CSP_NONCE_PLACEHOLDER),
+	}
+
+	if config.HSTSMaxAge > 0 {
+		s.hsts = "max-age=" + strconv.FormatInt(int64(config.HSTSMaxAge/time.Second), 10)
+		if config.HSTSIncludeSubdomains {
+			s.hsts += "; includeSubDomains"
+		}
+		if config.HSTSPreload {
+			s.hsts += "; preload"
+		}
+	}
+
+	return s.handle
+}
+
+/*
+CSPNonce returns the Content-Security-Policy nonce the middleware placed in the
+request context, or an empty string if there is none.
+
+	func pageHandler(rw http.ResponseWriter, r *http.Request) *rye.Response {
+		fmt.Fprintf(rw, `<script nonce="%s">...</script>`, rye.CSPNonce(r))
+		return nil
+	}
+*/
+func CSPNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(CONTEXT_CSP_NONCE).(string)
+	return nonce
+}
+
+func (s *securityHeaders) handle(rw http.ResponseWriter, r *http.Request) *Response {
+	h := rw.Header()
+
+	if s.hsts != "" {
+		h.Set("Strict-Transport-Security", s.hsts)
+	}
+
+	if s.config.ContentTypeNosniff {
+		h.Set("X-Content-Type-Options", "nosniff")
+	}
+
+	if s.config.FrameOptions != "" {
+		h.Set("X-Frame-Options", s.config.FrameOptions)
+	}
+
+	if s.config.ReferrerPolicy != "" {
+		h.Set("Referrer-Policy", s.config.ReferrerPolicy)
+	}
+
+	if s.config.PermissionsPolicy != "" {
+		h.Set("Permissions-Policy", s.config.PermissionsPolicy)
+	}
+
+	if s.config.ContentSecurityPolicy == "" {
+		return nil
+	}
+
+	cspHeader := "Content-Security-Policy"
+	if s.config.CSPReportOnly {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
+
+	if !s.nonce {
+		h.Set(cspHeader, s.config.ContentSecurityPolicy)
+		return nil
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return &Response{
+			Err:        err,
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	nonce := base64.StdEncoding.EncodeToString(b)
+
+	h.Set(cspHeader, strings.Replace(s.config.ContentSecurityPolicy, CSP_NONCE_PLACEHOLDER, nonce, -1))
+
+	return &Response{
+		Context: context.WithValue(r.Context(), CONTEXT_CSP_NONCE, nonce),
+	}
+}
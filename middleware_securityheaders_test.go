@@ -0,0 +1,101 @@
+package rye
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Security Headers Middleware", func() {
+
+	var (
+		request  *http.Request
+		response *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		response = httptest.NewRecorder()
+		request = httptest.NewRequest("GET", "/", nil)
+	})
+
+	Describe("handle", func() {
+		Context("when using the API preset", func() {
+			It("should set the API headers", func() {
+				resp := MiddlewareSecurityHeadersAPI()(response, request)
+				Expect(resp).To(BeNil())
+
+				h := response.Header()
+				Expect(h.Get("Strict-Transport-Security")).To(Equal("max-age=31536000; includeSubDomains"))
+				Expect(h.Get("Content-Security-Policy")).To(Equal("default-src 'none'; frame-ancestors 'none'"))
+				Expect(h.Get("X-Content-Type-Options")).To(Equal("nosniff"))
+				Expect(h.Get("X-Frame-Options")).To(Equal("DENY"))
+				Expect(h.Get("Referrer-Policy")).To(Equal("no-referrer"))
+				Expect(h.Get("Permissions-Policy")).To(BeEmpty())
+			})
+		})
+
+		Context("when using the static preset", func() {
+			It("should set the static UI headers", func() {
+				resp := MiddlewareSecurityHeadersStatic()(response, request)
+				Expect(resp).To(BeNil())
+
+				h := response.Header()
+				Expect(h.Get("Content-Security-Policy")).To(ContainSubstring("default-src 'self'"))
+				Expect(h.Get("X-Frame-Options")).To(Equal("SAMEORIGIN"))
+				Expect(h.Get("Referrer-Policy")).To(Equal("strict-origin-when-cross-origin"))
+				Expect(h.Get("Permissions-Policy")).To(Equal("camera=(), microphone=(), geolocation=()"))
+			})
+		})
+
+		Context("when using a custom config", func() {
+			It("should only set the configured headers", func() {
+				resp := NewMiddlewareSecurityHeaders(SecurityHeadersConfig{
+					HSTSMaxAge:  time.Hour,
+					HSTSPreload: true,
+				})(response, request)
+				Expect(resp).To(BeNil())
+
+				Expect(response.Header().Get("Strict-Transport-Security")).To(Equal("max-age=3600; preload"))
+				Expect(response.Header()).To(HaveLen(1))
+			})
+
+			It("should set a report-only policy", func() {
+				NewMiddlewareSecurityHeaders(SecurityHeadersConfig{
+					ContentSecurityPolicy: "default-src 'self'",
+					CSPReportOnly:         true,
+				})(response, request)
+
+				Expect(response.Header().Get("Content-Security-Policy")).To(BeEmpty())
+				Expect(response.Header().Get("Content-Security-Policy-Report-Only")).To(Equal("default-src 'self'"))
+			})
+		})
+
+		Context("when the policy contains a nonce placeholder", func() {
+			It("should generate a nonce per request and put it in the context", func() {
+				mw := NewMiddlewareSecurityHeaders(SecurityHeadersConfig{
+					ContentSecurityPolicy: "script-src 'nonce-{nonce}'",
+				})
+
+				resp := mw(response, request)
+				Expect(resp).ToNot(BeNil())
+				Expect(resp.Context).ToNot(BeNil())
+
+				nonce := CSPNonce(request.WithContext(resp.Context))
+				Expect(nonce).ToNot(BeEmpty())
+				Expect(response.Header().Get("Content-Security-Policy")).To(Equal("script-src 'nonce-" + nonce + "'"))
+
+				other := mw(httptest.NewRecorder(), request)
+				Expect(CSPNonce(request.WithContext(other.Context))).ToNot(Equal(nonce))
+			})
+		})
+
+		Context("when there is no nonce in the context", func() {
+			It("should return an empty string", func() {
+				Expect(CSPNonce(request)).To(BeEmpty())
+			})
+		})
+	})
+})
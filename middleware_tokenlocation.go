@@ -0,0 +1,160 @@
+package rye
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	// Token location kinds
+	TOKEN_LOCATION_HEADER      = "header"
+	TOKEN_LOCATION_AUTH_SCHEME = "auth-scheme"
+	TOKEN_LOCATION_QUERY       = "query"
+	TOKEN_LOCATION_COOKIE      = "cookie"
+	TOKEN_LOCATION_FORM        = "form"
+)
+
+// tokenQueryParams holds the names of the query parameters tokens are read
+// from, for the route logger to redact
+var tokenQueryParams sync.Map
+
+// TokenLocation is a place in a request where a token can be passed. Use
+// `TokenHeader`, `TokenAuthScheme`, `TokenQuery`, `TokenCookie` or
+// `TokenForm` to create one.
+type TokenLocation struct {
+	Kind string
+	Name string
+}
+
+// TokenHeader looks for a token in the named header.
+func TokenHeader(name string) TokenLocation {
+	return TokenLocation{Kind: TOKEN_LOCATION_HEADER, Name: name}
+}
+
+// TokenAuthScheme looks for a token in the Authorization header, after the
+// given scheme, ie. "Token" for "Authorization: Token xyz". The scheme is
+// matched case-insensitively.
+func TokenAuthScheme(scheme string) TokenLocation {
+	return TokenLocation{Kind: TOKEN_LOCATION_AUTH_SCHEME, Name: scheme}
+}
+
+// TokenQuery looks for a token in the named query parameter. The parameter's
+// value is redacted from the request URIs logged by `MiddlewareRouteLogger`.
+func TokenQuery(name string) TokenLocation {
+	tokenQueryParams.Store(name, true)
+	return TokenLocation{Kind: TOKEN_LOCATION_QUERY, Name: name}
+}
+
+// TokenCookie looks for a token in the named cookie.
+func TokenCookie(name string) TokenLocation {
+	return TokenLocation{Kind: TOKEN_LOCATION_COOKIE, Name: name}
+}
+
+// TokenForm looks for a token in the named field of a url-encoded or
+// multipart form body.
+func TokenForm(name string) TokenLocation {
+	return TokenLocation{Kind: TOKEN_LOCATION_FORM, Name: name}
+}
+
+// String describes the location for error messages
+func (l TokenLocation) String() string {
+	switch l.Kind {
+	case TOKEN_LOCATION_AUTH_SCHEME:
+		return fmt.Sprintf("'Authorization: %s' header", l.Name)
+	case TOKEN_LOCATION_QUERY:
+		return fmt.Sprintf("the '%s' parameter", l.Name)
+	case TOKEN_LOCATION_COOKIE:
+		return fmt.Sprintf("the '%s' cookie", l.Name)
+	case TOKEN_LOCATION_FORM:
+		return fmt.Sprintf("the '%s' form field", l.Name)
+	default:
+		return fmt.Sprintf("'%s' in header", l.Name)
+	}
+}
+
+// extract returns the token passed at the location, if any
+func (l TokenLocation) extract(r *http.Request) string {
+	switch l.Kind {
+	case TOKEN_LOCATION_HEADER:
+		return r.Header.Get(l.Name)
+
+	case TOKEN_LOCATION_AUTH_SCHEME:
+		auth := r.Header.Get("Authorization")
+		if len(auth) <= len(l.Name) || !strings.EqualFold(auth[:len(l.Name)], l.Name) || auth[len(l.Name)] != ' ' {
+			return ""
+		}
+		return strings.TrimSpace(auth[len(l.Name)+1:])
+
+	case TOKEN_LOCATION_QUERY:
+		if r.URL == nil {
+			return ""
+		}
+
+		q, ok := r.URL.Query()[l.Name]
+		if !ok {
+			return ""
+		}
+		return q[0]
+
+	case TOKEN_LOCATION_COOKIE:
+		c, err := r.Cookie(l.Name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+
+	case TOKEN_LOCATION_FORM:
+		return r.PostFormValue(l.Name)
+	}
+
+	return ""
+}
+
+// extractToken returns the first token found, in the order of the locations
+func extractToken(r *http.Request, locations []TokenLocation) (string, TokenLocation, bool) {
+	for _, l := range locations {
+		if token := l.extract(r); token != "" {
+			return token, l, true
+		}
+	}
+
+	return "", TokenLocation{}, false
+}
+
+// missingTokenMessage lists the locations a token can be passed in
+func missingTokenMessage(kind string, locations []TokenLocation) string {
+	places := make([]string, len(locations))
+	for i, l := range locations {
+		places[i] = l.String()
+	}
+
+	return fmt.Sprintf("No %s found; ensure you pass %s", kind, strings.Join(places, " or "))
+}
+
+// redactTokenQuery hides the values of the token query parameters in a
+// request URI, keeping the order of the other parameters
+func redactTokenQuery(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 {
+		return uri
+	}
+
+	params := strings.Split(uri[i+1:], "&")
+	for j, param := range params {
+		key := param
+		if k := strings.IndexByte(param, '='); k >= 0 {
+			key = param[:k]
+		}
+
+		if name, err := url.QueryUnescape(key); err == nil {
+			if _, ok := tokenQueryParams.Load(name); ok {
+				params[j] = key + "=REDACTED"
+			}
+		}
+	}
+
+	return uri[:i+1] + strings.Join(params, "&")
+}
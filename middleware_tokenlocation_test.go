@@ -0,0 +1,94 @@
+package rye
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Token Locations", func() {
+
+	var request *http.Request
+
+	BeforeEach(func() {
+		request = httptest.NewRequest("GET", "/thing?token=q&other=1", nil)
+	})
+
+	Describe("extract", func() {
+		It("should read a named header", func() {
+			request.Header.Set("X-Api-Key", "h")
+			Expect(TokenHeader("x-api-key").extract(request)).To(Equal("h"))
+			Expect(TokenHeader("X-Other").extract(request)).To(BeEmpty())
+		})
+
+		It("should read an Authorization scheme case-insensitively", func() {
+			request.Header.Set("Authorization", "apikey  a ")
+			Expect(TokenAuthScheme("ApiKey").extract(request)).To(Equal("a"))
+			Expect(TokenAuthScheme("Api").extract(request)).To(BeEmpty())
+			Expect(TokenAuthScheme("Bearer").extract(request)).To(BeEmpty())
+
+			request.Header.Set("Authorization", "ApiKey")
+			Expect(TokenAuthScheme("ApiKey").extract(request)).To(BeEmpty())
+		})
+
+		It("should read a query parameter", func() {
+			Expect(TokenQuery("token").extract(request)).To(Equal("q"))
+			Expect(TokenQuery("missing").extract(request)).To(BeEmpty())
+
+			request.URL = nil
+			Expect(TokenQuery("token").extract(request)).To(BeEmpty())
+		})
+
+		It("should read a cookie", func() {
+			request.AddCookie(&http.Cookie{Name: "session", Value: "c"})
+			Expect(TokenCookie("session").extract(request)).To(Equal("c"))
+			Expect(TokenCookie("missing").extract(request)).To(BeEmpty())
+		})
+
+		It("should read a form field, but not from the query", func() {
+			Expect(TokenForm("token").extract(request)).To(BeEmpty())
+
+			request = httptest.NewRequest("POST", "/thing?token=q", strings.NewReader("token=f"))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			Expect(TokenForm("token").extract(request)).To(Equal("f"))
+		})
+	})
+
+	Describe("extractToken", func() {
+		It("should return the first location holding a token", func() {
+			request.AddCookie(&http.Cookie{Name: "session", Value: "c"})
+			locations := []TokenLocation{TokenHeader("X-Api-Key"), TokenCookie("session"), TokenQuery("token")}
+
+			token, location, ok := extractToken(request, locations)
+			Expect(ok).To(BeTrue())
+			Expect(token).To(Equal("c"))
+			Expect(location).To(Equal(TokenCookie("session")))
+
+			_, _, ok = extractToken(request, locations[:1])
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("missingTokenMessage", func() {
+		It("should describe every location", func() {
+			Expect(missingTokenMessage("token", []TokenLocation{
+				TokenHeader("X-Api-Key"), TokenAuthScheme("Token"), TokenQuery("t"), TokenCookie("c"), TokenForm("f"),
+			})).To(Equal("No token found; ensure you pass 'X-Api-Key' in header or 'Authorization: Token' header or " +
+				"the 't' parameter or the 'c' cookie or the 'f' form field"))
+		})
+	})
+
+	Describe("redactTokenQuery", func() {
+		It("should hide the values of token query parameters only", func() {
+			TokenQuery("redact_me")
+
+			Expect(redactTokenQuery("/a?x=1&redact_me=s&redact%5Fme=t&redact_me&y=2")).
+				To(Equal("/a?x=1&redact_me=REDACTED&redact%5Fme=REDACTED&redact_me=REDACTED&y=2"))
+			Expect(redactTokenQuery("/a?x=1")).To(Equal("/a?x=1"))
+			Expect(redactTokenQuery("/a")).To(Equal("/a"))
+		})
+	})
+})
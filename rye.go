@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"reflect"
 	"runtime"
@@ -55,11 +56,16 @@ type JSONStatus struct {
 // ie. a middleware can return a *Response as a way to indicate
 // that further middleware execution should stop (without an error) or return a
 // a hard error by setting `Err` + `StatusCode`.
+//
+// A middleware can also set `ResponseWriter` to wrap the writer handed to the
+// rest of the chain (ie. to compress or buffer the output). If the wrapping
+// writer implements io.Closer, rye closes it once the chain has finished.
 type Response struct {
-	Err           error
-	StatusCode    int
-	StopExecution bool
-	Context       context.Context
+	Err            error
+	StatusCode     int
+	StopExecution  bool
+	Context        context.Context
+	ResponseWriter http.ResponseWriter
 }
 
 // Error bubbles a response error providing an implementation of the Error interface.
@@ -90,24 +96,45 @@ func (m *MWHandler) Use(handler Handler) {
 // It returns a http.HandlerFunc from net/http that can be set as a route in your http server.
 func (m *MWHandler) Handle(customHandlers []Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		exit := false
+		var closers []io.Closer
+
+		// Close wrapped writers last-in first-out, so that each one
+		// flushes into the writer it wraps
+		defer func() {
+			for i := len(closers) - 1; i >= 0; i-- {
+				closers[i].Close()
+			}
+		}()
+
+		// run calls a single handler, swapping in any writer it returns
+		run := func(handler Handler) bool {
+			exit, rw, req := m.do(w, r, handler)
+
+			if rw != w {
+				if c, ok := rw.(io.Closer); ok {
+					closers = append(closers, c)
+				}
+			}
+
+			w, r = rw, req
+			return exit
+		}
+
 		for _, handler := range m.beforeHandlers {
-			exit, r = m.do(w, r, handler)
-			if exit {
+			if run(handler) {
 				return
 			}
 		}
 
 		for _, handler := range customHandlers {
-			exit, r = m.do(w, r, handler)
-			if exit {
+			if run(handler) {
 				return
 			}
 		}
 	})
 }
 
-func (m *MWHandler) do(w http.ResponseWriter, r *http.Request, handler Handler) (bool, *http.Request) {
+func (m *MWHandler) do(w http.ResponseWriter, r *http.Request, handler Handler) (bool, http.ResponseWriter, *http.Request) {
 	var resp *Response
 
 	// Record handler runtime
@@ -122,6 +149,12 @@ func (m *MWHandler) do(w http.ResponseWriter, r *http.Request, handler Handler)
 					return
 				}
 
+				// If a writer is returned, the rest of the
+				// chain will write through it instead
+				if resp.ResponseWriter != nil {
+					w = resp.ResponseWriter
+				}
+
 				// If a context is returned, we will
 				// replace the current request with a new request
 				if resp.Context != nil {
@@ -129,6 +162,10 @@ func (m *MWHandler) do(w http.ResponseWriter, r *http.Request, handler Handler)
 					return
 				}
 
+				if resp.ResponseWriter != nil && resp.Err == nil {
+					return
+				}
+
 				// If there's no error but we have a response
 				if resp.Err == nil {
 					resp.Err = errors.New("Problem with middleware; neither Err or StopExecution is set")
@@ -169,10 +206,10 @@ func (m *MWHandler) do(w http.ResponseWriter, r *http.Request, handler Handler)
 	// stop executing rest of the
 	// handlers if we encounter an error
 	if resp != nil && (resp.StopExecution || resp.Err != nil) {
-		return true, r
+		return true, w, r
 	}
 
-	return false, r
+	return false, w, r
 }
 
 func (m *MWHandler) reportError() {
@@ -1,6 +1,8 @@
 package rye
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -16,3 +18,10 @@ func TestAPISuite(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Rye Suite")
 }
+
+// serveChain runs the handlers as a single rye chain and records the response
+func serveChain(request *http.Request, handlers ...Handler) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	NewMWHandler(Config{}).Handle(handlers).ServeHTTP(response, request)
+	return response
+}
@@ -245,6 +245,28 @@ var _ = Describe("Rye", func() {
 			})
 		})
 
+		Context("when a handler returns a ResponseWriter", func() {
+			It("should hand the new writer to the rest of the chain and close it", func() {
+				wrapped := &closingWriter{ResponseWriter: response}
+				wrapHandler := func(rw http.ResponseWriter, r *http.Request) *Response {
+					return &Response{ResponseWriter: wrapped}
+				}
+				checkWriterHandler := func(rw http.ResponseWriter, r *http.Request) *Response {
+					if rw == wrapped {
+						os.Setenv(RYE_TEST_HANDLER_ENV_VAR, "1")
+					}
+					return nil
+				}
+
+				h := mwHandler.Handle([]Handler{wrapHandler, checkWriterHandler})
+				h.ServeHTTP(response, request)
+
+				Expect(os.Getenv(RYE_TEST_HANDLER_ENV_VAR)).To(Equal("1"))
+				Expect(wrapped.closed).To(BeTrue())
+				Expect(response.Code).To(Equal(http.StatusOK))
+			})
+		})
+
 		Context("when a handler returns a response with neither error or StopExecution set", func() {
 			It("should return a 500 + error message (and stop execution)", func() {
 				h := mwHandler.Handle([]Handler{badResponseHandler, successHandler})
@@ -493,6 +515,16 @@ func stopExecutionWithStatusHandler(rw http.ResponseWriter, r *http.Request) *Re
 	}
 }
 
+type closingWriter struct {
+	http.ResponseWriter
+	closed bool
+}
+
+func (c *closingWriter) Close() error {
+	c.closed = true
+	return nil
+}
+
 func testFunc() {}
 
 func HaveTiming(name string, statrate float32) types.GomegaMatcher {